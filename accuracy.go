@@ -0,0 +1,63 @@
+package flowstopper
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Accuracy selects how exactly a Limiter returned by NewLimiter tracks the
+// actions of each item, trading the precision of its decisions for the
+// memory and work they take in redis.
+type Accuracy int
+
+const (
+	// Exact keeps a sliding log of every action, as a Stopper does: no more
+	// than the Limit ever passes within any Interval. Each item takes a
+	// sorted set member, about a hundred bytes, per action in its window,
+	// and each decision takes time logarithmic in their number.
+	Exact Accuracy = iota
+
+	// Balanced estimates a sliding window from two fixed windows, as an
+	// ApproxWindow does: each item takes two counters whatever its rate.
+	// Decisions are exact for actions spread evenly over the Interval.
+	// Otherwise up to twice the Limit may pass within an Interval, but only
+	// when the actions of a window clustered at its end, and never in a
+	// burst around the start of a window.
+	Balanced
+
+	// Fast counts actions in fixed windows, as a FixedWindow does: each item
+	// takes a single counter, and each decision a single increment. Up to
+	// twice the Limit may pass within an Interval, in a burst around the
+	// start of a window.
+	Fast
+)
+
+// NewLimiter returns a Limiter allowing limit actions per item during
+// interval, keeping its state under namespace in redis in the mode accuracy
+// selects, for callers who would rather not choose between the limiters
+// themselves. It is validated like NewStopper, and configured further by
+// opts; only those setting the pool, the clock, the Separator and
+// RedactItems apply to the Balanced and Fast modes. It fails with
+// ErrInvalidConfig for an unknown accuracy.
+func NewLimiter(pool *redis.Pool, namespace string, interval time.Duration, limit int64, accuracy Accuracy, opts ...Option) (Limiter, error) {
+	var (
+		l   Limiter
+		err error
+	)
+	switch accuracy {
+	case Exact:
+		l, err = NewStopper(pool, namespace, interval, limit, opts...)
+	case Balanced:
+		l, err = NewApproxWindow(pool, namespace, interval, limit, opts...)
+	case Fast:
+		l, err = NewFixedWindow(pool, namespace, interval, limit, opts...)
+	default:
+		return nil, fmt.Errorf("%w: unknown accuracy %d", ErrInvalidConfig, accuracy)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
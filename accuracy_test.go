@@ -0,0 +1,82 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAccuracy(t *testing.T) {
+	const limit = 10
+	interval := time.Minute
+
+	// drive attempts three actions a second for five minutes, more than the
+	// limit allows, returning the times of those passed.
+	drive := func(accuracy Accuracy) []time.Time {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		l, err := NewLimiter(&connPool, "accuracy", interval, limit, accuracy, WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var passed []time.Time
+		for i := 0; i < 5*60; i++ {
+			for j := 0; j < 3; j++ {
+				ok, err := l.Pass("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					passed = append(passed, clock.Now())
+				}
+				clock.AddTime(time.Millisecond)
+			}
+			clock.AddTime(time.Second - 3*time.Millisecond)
+		}
+		return passed
+	}
+
+	// most returns the most actions passed within any span of d.
+	most := func(passed []time.Time, d time.Duration) int {
+		var n int
+		for i := range passed {
+			j := i
+			for j < len(passed) && passed[j].Sub(passed[i]) < d {
+				j++
+			}
+			if j-i > n {
+				n = j - i
+			}
+		}
+		return n
+	}
+
+	Convey("Given a limiter of each accuracy", t, func() {
+		Convey("Exact never passes more than the limit within an interval", func() {
+			passed := drive(Exact)
+			So(most(passed, interval), ShouldEqual, limit)
+			So(len(passed), ShouldEqual, 5*limit)
+		})
+
+		Convey("Balanced passes up to twice the limit, but never in a burst", func() {
+			passed := drive(Balanced)
+			So(most(passed, interval), ShouldBeLessThanOrEqualTo, 2*limit)
+			So(most(passed, 5*time.Second), ShouldBeLessThanOrEqualTo, limit)
+			So(len(passed), ShouldBeBetweenOrEqual, 5*limit-limit, 5*limit+limit)
+		})
+
+		Convey("Fast passes no more than twice the limit within an interval", func() {
+			passed := drive(Fast)
+			So(most(passed, interval), ShouldBeLessThanOrEqualTo, 2*limit)
+			So(len(passed), ShouldEqual, 5*limit)
+		})
+
+		Convey("Unknown accuracies are rejected", func() {
+			_, err := NewLimiter(&connPool, "accuracy", interval, limit, Fast+1)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+}
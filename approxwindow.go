@@ -0,0 +1,164 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// approxWindowScript estimates the actions in the sliding window from the
+// counter of the current fixed window at KEYS[1] and that of the previous
+// one at KEYS[2], weighted by ARGV[1], the fraction of the previous window
+// the sliding one still overlaps. Unless the estimate reaches ARGV[2], the
+// action is counted in the current window, which then expires after ARGV[3]
+// milliseconds, once it can no longer be the previous window. It returns 1
+// if the action was counted and 0 otherwise.
+var approxWindowScript = newScript(2, `
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local previous = tonumber(redis.call("GET", KEYS[2]) or "0")
+if previous * tonumber(ARGV[1]) + current >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// ApproxWindow is a rate limiter approximating a sliding window of Interval
+// with two fixed windows per item, like FixedWindow's. The actions in the
+// sliding window are estimated as those of the current fixed window plus
+// those of the previous one, weighted by how much of it the sliding window
+// still overlaps, which assumes the previous window's actions were spread
+// evenly.
+//
+// It trades accuracy for memory: each item takes two counters in redis
+// regardless of its rate, where a Stopper keeps a member per action. When
+// actions cluster within the previous window, the estimate is off by up to
+// that window's count, letting through more or fewer actions than an exact
+// sliding log would, but never the twofold burst of FixedWindow at window
+// edges. This suits items of high cardinality and throughput where
+// exactness isn't required.
+type ApproxWindow struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain the
+	// Separator.
+	Namespace string
+
+	// The separator placed between the Namespace, the item and the start of
+	// the window in keys, ":" by default.
+	Separator string
+
+	// The length of the sliding window.
+	Interval time.Duration
+
+	// The maximum amount of actions allowed during the Interval.
+	Limit int64
+
+	// When set, the location whose wall clock the fixed windows are aligned
+	// to, like with a FixedWindow. The sliding window estimated from them
+	// spans the Interval regardless.
+	Location *time.Location
+
+	// When set, items are replaced by a hash of themselves in errors, like
+	// with the RedactItems of a Stopper.
+	RedactItems bool
+
+	c clock.Clock
+}
+
+// NewApproxWindow returns an ApproxWindow allowing limit actions per item
+// during interval, keeping its counters under namespace in redis. It is
+// validated like NewStopper, and of opts, those setting the pool, the clock,
+// the Separator and RedactItems apply to it.
+func NewApproxWindow(pool *redis.Pool, namespace string, interval time.Duration, limit int64, opts ...Option) (*ApproxWindow, error) {
+	s, err := NewStopper(pool, namespace, interval, limit, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ApproxWindow{ConnPool: s.ConnPool, Pool: s.Pool, Namespace: namespace, Separator: s.Separator, Interval: interval, Limit: limit, RedactItems: s.RedactItems, c: s.c}, nil
+}
+
+// Pass sends an item through the ApproxWindow, returning false should the
+// estimated rate for this item exceed the limit. Rejected actions are not
+// counted. It fails with ErrInvalidConfig should the Interval or the Limit
+// not be positive.
+func (w *ApproxWindow) Pass(item string) (bool, error) {
+	base, current, previous, weight, err := w.keys(item)
+	if err != nil {
+		return false, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), base)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	counted, err := redis.Int64(approxWindowScript.run(c, current, previous, strconv.FormatFloat(weight, 'f', -1, 64), w.Limit, durationMillis(2*w.Interval)))
+	if err != nil {
+		return false, fmt.Errorf("flowstopper: %q: %w", redactItem(item, w.RedactItems), err)
+	}
+	return counted == 1, nil
+}
+
+// Peek returns the estimated number of actions for item in the sliding
+// window, rounded down, without counting one. An action passes while it is
+// below the Limit.
+func (w *ApproxWindow) Peek(item string) (int64, error) {
+	base, current, previous, weight, err := w.keys(item)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), base)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	values, err := redis.Values(c.Do("MGET", current, previous))
+	if err != nil {
+		return 0, fmt.Errorf("flowstopper: %q: %w", redactItem(item, w.RedactItems), err)
+	}
+	var cur, prev int64
+	if _, err := redis.Scan(values, &cur, &prev); err != nil {
+		return 0, fmt.Errorf("flowstopper: %q: %w", redactItem(item, w.RedactItems), err)
+	}
+	return int64(float64(prev)*weight) + cur, nil
+}
+
+// keys returns the key under which the windows of item are kept, those of
+// the counters of the current and the previous fixed window, and the weight
+// of the previous one.
+func (w *ApproxWindow) keys(item string) (base, current, previous string, weight float64, err error) {
+	if err := checkWindow(w.Interval, w.Limit); err != nil {
+		return "", "", "", 0, err
+	}
+	base, err = joinKey(w.Namespace, w.Separator, item)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	start, elapsed := windowStart(w.now(), w.Interval, w.Location)
+	interval := int64(w.Interval)
+	prefix := base + separatorOr(w.Separator)
+	current = prefix + strconv.FormatInt(start, 10)
+	previous = prefix + strconv.FormatInt(start-interval, 10)
+	return base, current, previous, 1 - float64(elapsed)/float64(interval), nil
+}
+
+func (w *ApproxWindow) now() time.Time {
+	if w.c == nil {
+		return Now()
+	}
+	return w.c.Now()
+}
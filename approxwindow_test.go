@@ -0,0 +1,62 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApproxWindow(t *testing.T) {
+	Convey("Given an approximate sliding window limiter", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		window := &ApproxWindow{
+			Namespace: "approxwindow",
+			Interval:  time.Minute,
+			Limit:     4,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := window.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Actions up to the limit pass", func() {
+			So([]bool{pass(), pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, true, false})
+
+			Convey("And the previous window is weighted by its overlap", func() {
+				// Half way into the next window, half of the previous four
+				// actions are estimated to remain.
+				clock.AddTime(90 * time.Second)
+				count, err := window.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+				So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, false})
+			})
+
+			Convey("No twofold burst passes at the window's start", func() {
+				clock.AddTime(time.Minute)
+				So(pass(), ShouldBeFalse)
+			})
+		})
+
+		Convey("Only two counters are stored per item", func() {
+			for i := 0; i < 3; i++ {
+				pass()
+				clock.AddTime(time.Minute)
+			}
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			keys, err := redis.Strings(conn.Do("KEYS", "approxwindow:foo:*"))
+			So(err, ShouldBeNil)
+			So(len(keys), ShouldBeLessThanOrEqualTo, 3)
+		})
+	})
+}
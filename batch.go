@@ -0,0 +1,365 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// CheckRequest describes a single check made by PassBatch.
+type CheckRequest struct {
+	// The item to check.
+	Item string
+
+	// The maximum amount of actions allowed during the Interval. When zero,
+	// the Stopper's Limit is used.
+	Limit int64
+
+	// The duration for which actions are tracked. When zero, the Stopper's
+	// Interval is used.
+	Interval time.Duration
+
+	// The number of actions this check accounts for. When zero, the check
+	// accounts for a single action.
+	Cost int64
+
+	// The time of the check, as given to PassAt. When zero, the Stopper's
+	// clock is used.
+	at time.Time
+
+	// The namespace of the check, as given to PassNS. When empty, the
+	// Stopper's Namespace is used.
+	namespace string
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	// Whether the check passed.
+	Allowed bool
+
+	// The number of actions recorded during the interval, including those
+	// of the check itself.
+	Count int64
+}
+
+// PassBatch sends several checks through the Stopper in a single round trip
+// to redis, returning their results in the same order. Each check is decided
+// independently against its own limit and interval, so that, for example,
+// per-route and per-user limits can be applied to a request together.
+// SoftLimit is not applied to batched checks. Unlimited and limits of zero
+// or less apply as for Pass, deciding on the checks they cover without
+// sending them to redis, and so do the lockouts of the Penalty, though the
+// rejections of batched checks don't count as offenses.
+func (s *Stopper) PassBatch(requests []CheckRequest) ([]Result, error) {
+	return s.passBatch(context.Background(), requests, s.now(), 0)
+}
+
+// passBatch is PassBatch for checks made at now, numbering the members of
+// the batch from seq onwards.
+func (s *Stopper) passBatch(ctx context.Context, requests []CheckRequest, now time.Time, seq int) ([]Result, error) {
+	keys := make([]string, len(requests))
+	limitKeys := make([]string, len(requests))
+	for i, r := range requests {
+		key, err := s.validKeyIn(s.Namespace, r.Item)
+		if err != nil {
+			return nil, err
+		}
+		interval, _, _ := s.checkParams(r)
+		keys[i], limitKeys[i] = s.windowKey(key, interval), auxKey(key, "limit")
+	}
+
+	// With Unlimited, every check passes, while those with a limit of zero
+	// or less are rejected, both without involving redis, as by Pass.
+	results := make([]Result, len(requests))
+	var sent []int
+	for i, r := range requests {
+		if _, limit, _ := s.checkParams(r); s.Unlimited || limit <= 0 {
+			results[i].Allowed = s.Unlimited
+			s.decided(r.Item, results[i].Allowed, 0, false)
+			continue
+		}
+		sent = append(sent, i)
+	}
+	if len(sent) == 0 {
+		return results, nil
+	}
+
+	c, err := s.batchConn(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+
+	// The checks of items locked out by the Penalty are rejected without
+	// being sent either.
+	if s.Penalty != nil {
+		lockKeys := make([]string, len(sent))
+		for j, i := range sent {
+			lockKeys[j] = keys[i]
+		}
+		locked, err := s.lockedOut(c, lockKeys, now)
+		if err != nil {
+			return nil, err
+		}
+		open := sent[:0]
+		for j, i := range sent {
+			if locked[j] {
+				s.decided(requests[i].Item, false, 0, false)
+				continue
+			}
+			open = append(open, i)
+		}
+		if sent = open; len(sent) == 0 {
+			return results, nil
+		}
+	}
+
+	// Checks of the same item are recorded at the same instant, so their
+	// members are numbered across the whole batch to keep them distinct.
+	args := make([][]interface{}, len(sent))
+	for j, i := range sent {
+		r := requests[i]
+		interval, limit, cost := s.checkParams(r)
+		args[j] = append(recordArgs(keys[i], limitKeys[i], now, interval, cost, seq, limit, s.UseServerTime), s.optionArgs(r.Item, limit)...)
+		seq += int(cost)
+	}
+
+	values, err := execRecords(c, args)
+	if err == nil && len(values) > 0 && isNoScript(values[0]) {
+		// Either every script in the transaction ran or none did, so the
+		// batch can be retried as a whole once the script is loaded.
+		if err := passScript.load(c); err != nil {
+			return nil, err
+		}
+		values, err = execRecords(c, args)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range sent {
+		r := requests[i]
+		reply, err := scanRecord(values[j], nil)
+		if err != nil {
+			return nil, s.itemError(r.Item, err)
+		}
+		s.trimmed(r.Item, reply.trimmed)
+
+		_, limit, cost := s.checkParams(r)
+		if reply.limit > 0 {
+			limit = reply.limit
+		}
+		results[i] = Result{
+			Allowed: cost <= limit && (reply.inGrace || reply.count <= limit),
+			Count:   reply.count,
+		}
+		changed := reply.tripped || reply.cleared
+		s.decided(r.Item, results[i].Allowed, results[i].Count, changed)
+	}
+	return results, nil
+}
+
+// PassMulti sends several items through the Stopper in a single round trip
+// to redis, returning whether each passed in the same order. Each item is
+// trimmed, counted and recorded like by Pass, but as with PassBatch,
+// SoftLimit and FreeAllowance are not applied, and rejections don't count
+// as offenses of the Penalty, whose lockouts apply nonetheless.
+func (s *Stopper) PassMulti(items []string) ([]bool, error) {
+	requests := make([]CheckRequest, len(items))
+	for i, item := range items {
+		requests[i].Item = item
+	}
+	results, err := s.PassBatch(requests)
+	if err != nil {
+		return nil, err
+	}
+	passed := make([]bool, len(results))
+	for i, r := range results {
+		passed[i] = r.Allowed
+	}
+	return passed, nil
+}
+
+// passMultiChunk is the number of items PassMultiContext sends to redis in
+// each round trip.
+const passMultiChunk = 32
+
+// PartialError is returned by PassMultiContext when it stopped before all
+// items were evaluated, telling which were and which may have been.
+type PartialError struct {
+	// The number of items evaluated, which are the first ones. Their
+	// results are valid.
+	Evaluated int
+
+	// The number of items following those which were sent to redis, but
+	// whose reply was lost. They may or may not have been recorded, so
+	// retrying them risks counting them twice.
+	Uncertain int
+
+	// Why evaluation stopped, such as the context's error.
+	Err error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("flowstopper: %d items evaluated, %d uncertain: %v", e.Evaluated, e.Uncertain, e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// PassMultiContext is like PassMulti, but sends the items to redis in
+// chunks, each in a round trip of its own, so that it makes progress while
+// redis is slow and stops once ctx is done. Should it stop before all items
+// were evaluated, the results of those which were are returned along with a
+// *PartialError telling how many they are and how many more may have been
+// recorded, so that a retry with only the remaining items does not count
+// any twice. The results of the others are false.
+func (s *Stopper) PassMultiContext(ctx context.Context, items []string) ([]bool, error) {
+	for _, item := range items {
+		if _, err := s.key(item); err != nil {
+			return nil, err
+		}
+	}
+	now := s.now()
+	passed := make([]bool, len(items))
+	for start := 0; start < len(items); start += passMultiChunk {
+		if err := ctx.Err(); err != nil {
+			return passed, &PartialError{Evaluated: start, Err: err}
+		}
+		end := start + passMultiChunk
+		if end > len(items) {
+			end = len(items)
+		}
+		requests := make([]CheckRequest, end-start)
+		for i, item := range items[start:end] {
+			requests[i].Item = item
+		}
+		results, err := s.passBatch(ctx, requests, now, start)
+		if err != nil {
+			return passed, &PartialError{Evaluated: start, Uncertain: end - start, Err: err}
+		}
+		for i, r := range results {
+			passed[start+i] = r.Allowed
+		}
+	}
+	return passed, nil
+}
+
+// PeekMulti returns the number of actions passed during the current interval
+// for each of items, keyed by item, like Peek for each but in a single round
+// trip to redis. Items without a window are counted as zero.
+func (s *Stopper) PeekMulti(items []string) (map[string]int64, error) {
+	windowStart := s.now().Add(s.Interval * -1).UnixNano()
+	var tx transaction
+	keys := make([]string, len(items))
+	for i, item := range items {
+		key, err := s.key(item)
+		if err != nil {
+			return nil, err
+		}
+		tx.add("ZREMRANGEBYSCORE", key, "-inf", windowStart)
+		tx.add("ZCARD", key)
+		tx.add("ZRANGEBYSCORE", weightsArgs(key, windowStart)...)
+		keys[i] = key
+	}
+
+	c, err := s.batchConn(context.Background(), keys)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+
+	counts := make(map[string]int64, len(items))
+	if len(items) == 0 {
+		return counts, nil
+	}
+	values, err := tx.execAll(c)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		var trimmed, count int64
+		var weighted []string
+		if _, err := redis.Scan(values[3*i:], &trimmed, &count, &weighted); err != nil {
+			return nil, s.itemError(item, err)
+		}
+		s.trimmed(item, trimmed)
+		counts[item] = count + parseWeights(weighted).extra()
+	}
+	return counts, nil
+}
+
+// ResetMulti clears the windows of items like Reset for each, along with the
+// state of their Penalty and their grace periods, but with a single DEL in
+// one round trip to redis. Items without a window are skipped.
+func (s *Stopper) ResetMulti(items []string) error {
+	keys := make([]string, len(items))
+	args := make([]interface{}, 0, len(items))
+	for i, item := range items {
+		key, err := s.key(item)
+		if err != nil {
+			return err
+		}
+		keys[i] = key
+		args = append(args, key, auxKey(key, "blocked"), auxKey(key, "grace"), auxKey(key, "weights"))
+		if s.Penalty != nil {
+			args = append(args, auxKey(key, "offenses"), auxKey(key, "lockouts"), auxKey(key, "penalty"))
+		}
+	}
+
+	c, err := s.batchConn(context.Background(), keys)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := c.Do("DEL", args...); err != nil {
+		return fmt.Errorf("flowstopper: resetting %d items: %w", len(items), err)
+	}
+	return nil
+}
+
+// batchConn takes a connection for an operation on the items stored at keys,
+// which must all be on the same shard, bound to ctx.
+func (s *Stopper) batchConn(ctx context.Context, keys []string) (*operationConn, error) {
+	if err := sameShard(s.pool(), keys); err != nil {
+		return nil, err
+	}
+	var key string
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	return s.connContext(ctx, key)
+}
+
+// execRecords evaluates passScript with each of args in a single
+// transaction, returning its replies.
+func execRecords(c *operationConn, args [][]interface{}) ([]interface{}, error) {
+	var tx transaction
+	for _, a := range args {
+		tx.add("EVALSHA", passScript.args(a)...)
+	}
+	return tx.exec(c)
+}
+
+// checkParams returns the interval, limit and cost of r, falling back to the
+// Stopper's defaults.
+func (s *Stopper) checkParams(r CheckRequest) (time.Duration, int64, int64) {
+	interval, limit, cost := r.Interval, r.Limit, r.Cost
+	if interval == 0 {
+		interval = s.Interval
+	}
+	if limit == 0 {
+		limit = s.Limit
+	}
+	if cost < 1 {
+		cost = 1
+	}
+	return interval, limit, cost
+}
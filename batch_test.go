@@ -0,0 +1,434 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPassBatch(t *testing.T) {
+	Convey("Given a stopper with a mock redis", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		multi := conn.Command("MULTI")
+		eval := conn.GenericCommand("EVALSHA").Expect("QUEUED")
+		exec := conn.Command("EXEC").Expect([]interface{}{
+			[]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil},
+			[]interface{}{int64(0), int64(7), int64(0), nil, nil, nil, nil, nil},
+		})
+
+		Convey("When I pass a mixed batch", func() {
+			results, err := stopper.PassBatch([]CheckRequest{
+				{Item: "route:/search"},
+				{Item: "user:alice", Limit: 10, Interval: time.Minute, Cost: 3},
+			})
+
+			Convey("It takes a single round trip", func() {
+				So(err, ShouldBeNil)
+				So(conn.Stats(multi), ShouldEqual, 1)
+				So(conn.Stats(eval), ShouldEqual, 2)
+				So(conn.Stats(exec), ShouldEqual, 1)
+			})
+
+			Convey("Each check is decided against its own limit", func() {
+				So(results, ShouldResemble, []Result{
+					{Allowed: true, Count: 1},
+					{Allowed: true, Count: 7},
+				})
+			})
+		})
+
+		Convey("When redis does not know the script yet", func() {
+			exec := conn.Command("EXEC").ExpectSlice(redis.Error("NOSCRIPT No matching script. Please use EVAL."), redis.Error("NOSCRIPT No matching script. Please use EVAL.")).
+				Expect([]interface{}{
+					[]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil},
+					[]interface{}{int64(0), int64(7), int64(0), nil, nil, nil, nil, nil},
+				})
+			load := conn.GenericCommand("SCRIPT").Expect(passScript.Hash())
+			results, err := stopper.PassBatch([]CheckRequest{
+				{Item: "route:/search"},
+				{Item: "user:alice", Limit: 10, Interval: time.Minute, Cost: 3},
+			})
+
+			Convey("It is loaded and the batch retried as a whole", func() {
+				So(err, ShouldBeNil)
+				So(conn.Stats(load), ShouldEqual, 1)
+				So(conn.Stats(exec), ShouldEqual, 2)
+				So(results, ShouldResemble, []Result{
+					{Allowed: true, Count: 1},
+					{Allowed: true, Count: 7},
+				})
+			})
+		})
+	})
+
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "batch",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+
+		Convey("When I pass a batch with per-check limits and costs", func() {
+			results, err := stopper.PassBatch([]CheckRequest{
+				{Item: "route", Cost: 2},
+				{Item: "user", Limit: 1},
+				{Item: "route", Cost: 2},
+				{Item: "other", Limit: 10, Cost: 10},
+			})
+
+			Convey("Each check is decided independently", func() {
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []Result{
+					{Allowed: true, Count: 2},
+					{Allowed: true, Count: 1},
+					{Allowed: false, Count: 4},
+					{Allowed: true, Count: 10},
+				})
+			})
+
+			Convey("The intervals are honored per check", func() {
+				clock.AddTime(stopper.Interval)
+				results, err := stopper.PassBatch([]CheckRequest{
+					{Item: "route"},
+					{Item: "other", Limit: 10, Interval: time.Minute},
+				})
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []Result{
+					{Allowed: true, Count: 1},
+					{Allowed: false, Count: 11},
+				})
+			})
+		})
+
+		Convey("When a check closes the gate with a negative limit", func() {
+			results, err := stopper.PassBatch([]CheckRequest{
+				{Item: "route"},
+				{Item: "user", Limit: -1},
+			})
+
+			Convey("It is rejected without being sent", func() {
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []Result{
+					{Allowed: true, Count: 1},
+					{Allowed: false},
+				})
+				count, err := stopper.Peek("user")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the stopper is unlimited", func() {
+			stopper.Unlimited = true
+			results, err := stopper.PassBatch([]CheckRequest{
+				{Item: "route", Cost: 5},
+				{Item: "route", Cost: 5},
+			})
+
+			Convey("Every check passes without being recorded", func() {
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []Result{{Allowed: true}, {Allowed: true}})
+				count, err := stopper.Peek("route")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestPassMulti(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		stopper := Stopper{
+			Namespace: "multi",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock.NewMockClock(now),
+		}
+
+		Convey("Items are decided like by Pass, in order", func() {
+			passed, err := stopper.PassMulti([]string{"foo", "bar", "foo", "foo"})
+			So(err, ShouldBeNil)
+			So(passed, ShouldResemble, []bool{true, true, true, false})
+
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+		})
+
+		Convey("Unlimited lets every item through", func() {
+			stopper.Unlimited = true
+			passed, err := stopper.PassMulti([]string{"foo", "foo", "foo"})
+			So(err, ShouldBeNil)
+			So(passed, ShouldResemble, []bool{true, true, true})
+		})
+
+		Convey("A closed gate rejects every item", func() {
+			stopper.Limit = 0
+			passed, err := stopper.PassMulti([]string{"foo", "bar"})
+			So(err, ShouldBeNil)
+			So(passed, ShouldResemble, []bool{false, false})
+		})
+	})
+}
+
+func TestPeekMulti(t *testing.T) {
+	Convey("Given a stopper with actions for some items", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "peekmulti",
+			Interval:  5 * time.Second,
+			Limit:     int64(5),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		for _, item := range []string{"foo", "foo", "bar"} {
+			if _, err := stopper.Pass(item); err != nil {
+				t.Fatal(err)
+			}
+			clock.AddTime(time.Millisecond)
+		}
+
+		Convey("Each item is counted, missing ones as zero", func() {
+			counts, err := stopper.PeekMulti([]string{"foo", "bar", "baz"})
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[string]int64{"foo": 2, "bar": 1, "baz": 0})
+		})
+
+		Convey("Expired actions are trimmed first", func() {
+			clock.AddTime(5*time.Second - 3*time.Millisecond)
+			counts, err := stopper.PeekMulti([]string{"foo", "bar"})
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[string]int64{"foo": 1, "bar": 1})
+		})
+	})
+}
+
+func TestResetMulti(t *testing.T) {
+	Convey("Given a stopper with actions for some items", t, func() {
+		flushRealRedis(t)
+		stopper := Stopper{
+			Namespace: "resetmulti",
+			Interval:  5 * time.Second,
+			Limit:     int64(5),
+			ConnPool:  &connPool,
+			c:         clock.NewMockClock(now),
+		}
+		for _, item := range []string{"foo", "bar", "baz"} {
+			if _, err := stopper.Pass(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		Convey("Resetting several clears each, skipping missing ones", func() {
+			So(stopper.ResetMulti([]string{"foo", "bar", "unknown"}), ShouldBeNil)
+			counts, err := stopper.PeekMulti([]string{"foo", "bar", "baz"})
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[string]int64{"foo": 0, "bar": 0, "baz": 1})
+		})
+
+		Convey("Resetting several ends their grace periods", func() {
+			So(stopper.ResetWithGrace("foo", time.Minute), ShouldBeNil)
+			So(stopper.ResetMulti([]string{"foo"}), ShouldBeNil)
+			for i := int64(0); i < stopper.Limit; i++ {
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+		})
+
+		Convey("Resetting none does nothing", func() {
+			So(stopper.ResetMulti(nil), ShouldBeNil)
+		})
+	})
+}
+
+func benchmarkItems() []string {
+	items := make([]string, 100)
+	for i := range items {
+		items[i] = fmt.Sprintf("item%d", i)
+	}
+	return items
+}
+
+func BenchmarkPassMulti(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: int64(b.N + 1), ConnPool: &connPool}
+	items := benchmarkItems()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stopper.PassMulti(items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPass100(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: int64(b.N + 1), ConnPool: &connPool}
+	items := benchmarkItems()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			if _, err := stopper.Pass(item); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPeekMulti(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: 1, ConnPool: &connPool}
+	items := benchmarkItems()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stopper.PeekMulti(items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPeek100(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: 1, ConnPool: &connPool}
+	items := benchmarkItems()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			if _, err := stopper.Peek(item); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkResetMulti(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: 1, ConnPool: &connPool}
+	items := benchmarkItems()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := stopper.ResetMulti(items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReset100(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: 1, ConnPool: &connPool}
+	items := benchmarkItems()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			if err := stopper.Reset(item); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// cancellingPool cancels a context once it handed out a number of
+// connections.
+type cancellingPool struct {
+	Pool
+	cancel func()
+	after  int
+}
+
+func (p *cancellingPool) GetContext(ctx context.Context) (Conn, error) {
+	p.after--
+	if p.after == 0 {
+		p.cancel()
+	}
+	return p.Pool.GetContext(ctx)
+}
+
+func TestPassMultiContext(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		stopper := Stopper{
+			Namespace: "multictx",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock.NewMockClock(now),
+		}
+		items := make([]string, 2*passMultiChunk+1)
+		for i := range items {
+			items[i] = "foo"
+		}
+
+		Convey("All items are decided across chunks", func() {
+			passed, err := stopper.PassMultiContext(context.Background(), items)
+			So(err, ShouldBeNil)
+			So(passed[:3], ShouldResemble, []bool{true, true, false})
+			So(passed[len(passed)-1], ShouldBeFalse)
+
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+		})
+
+		Convey("Once the context is done, the evaluated items are reported", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stopper.Pool = &cancellingPool{Pool: RedigoPool(&connPool), cancel: cancel, after: 2}
+			passed, err := stopper.PassMultiContext(ctx, items)
+			So(passed[:3], ShouldResemble, []bool{true, true, false})
+
+			var perr *PartialError
+			So(errors.As(err, &perr), ShouldBeTrue)
+			So(perr.Evaluated, ShouldEqual, passMultiChunk)
+			So(perr.Uncertain, ShouldEqual, passMultiChunk)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+			Convey("So that only the remaining ones are retried", func() {
+				stopper.Pool = nil
+				rest := items[perr.Evaluated+perr.Uncertain:]
+				passed, err := stopper.PassMultiContext(context.Background(), rest)
+				So(err, ShouldBeNil)
+				So(passed, ShouldResemble, []bool{false})
+			})
+		})
+
+		Convey("Unlimited lets every item through across chunks", func() {
+			stopper.Unlimited = true
+			passed, err := stopper.PassMultiContext(context.Background(), items)
+			So(err, ShouldBeNil)
+			for _, p := range passed {
+				So(p, ShouldBeTrue)
+			}
+		})
+
+		Convey("A closed gate rejects every item across chunks", func() {
+			stopper.Limit = -1
+			passed, err := stopper.PassMultiContext(context.Background(), items)
+			So(err, ShouldBeNil)
+			for _, p := range passed {
+				So(p, ShouldBeFalse)
+			}
+		})
+
+		Convey("Invalid items fail before anything is sent", func() {
+			_, err := stopper.PassMultiContext(context.Background(), []string{"foo", ""})
+			So(err, ShouldEqual, ErrEmptyItem)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+	})
+}
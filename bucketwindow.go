@@ -0,0 +1,151 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// bucketWindowScript trims the buckets scored at or before ARGV[2] from the
+// index stored at KEYS[1] and their counts from the hash at KEYS[2], and
+// sums the counts of the remaining ones. Unless ARGV[5] is "0", or the sum
+// reaches ARGV[3], an action is counted in the bucket ARGV[1], and both keys
+// set to expire after ARGV[4] milliseconds. It returns whether the action
+// was counted, along with the sum including it.
+var bucketWindowScript = newScript(2, `
+local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+if #expired > 0 then
+	redis.call("HDEL", KEYS[2], unpack(expired))
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+end
+local count = 0
+for _, v in ipairs(redis.call("HVALS", KEYS[2])) do
+	count = count + tonumber(v)
+end
+if ARGV[5] == "0" or count >= tonumber(ARGV[3]) then
+	return {0, count}
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[1])
+redis.call("HINCRBY", KEYS[2], ARGV[1], 1)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[2], ARGV[4])
+return {1, count + 1}
+`)
+
+// BucketWindow is a rate limiter keeping a sliding window of Interval per
+// item like a Stopper, but counting the actions in buckets of Bucket rather
+// than recording each. Every item takes a sorted set indexing its buckets
+// and a hash of their counts, both holding at most one entry per Bucket of
+// the Interval however many actions pass, so that trimming stays cheap for
+// items of very high throughput.
+//
+// The price is precision of up to one Bucket: a bucket is only trimmed once
+// all of it has left the window, so an action may be counted for up to
+// Bucket longer than the Interval. The window thus never lets through more
+// actions than that of a Stopper would, but may turn some away a Bucket
+// early.
+type BucketWindow struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain the
+	// Separator.
+	Namespace string
+
+	// The separator placed between the Namespace and the item in keys, ":"
+	// by default.
+	Separator string
+
+	// The length of the sliding window.
+	Interval time.Duration
+
+	// The maximum amount of actions allowed during the Interval.
+	Limit int64
+
+	// The length of the buckets actions are counted in, starting at
+	// multiples of Bucket since the Unix epoch. Defaults to a tenth of the
+	// Interval, or a nanosecond for Intervals shorter than ten.
+	Bucket time.Duration
+
+	c clock.Clock
+}
+
+// NewBucketWindow returns a BucketWindow allowing limit actions per item
+// during interval, in buckets of the default size, keeping its buckets
+// under namespace in redis. It is validated like NewStopper, and of opts,
+// those setting the pool, the clock and the Separator apply to it.
+func NewBucketWindow(pool *redis.Pool, namespace string, interval time.Duration, limit int64, opts ...Option) (*BucketWindow, error) {
+	s, err := NewStopper(pool, namespace, interval, limit, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &BucketWindow{ConnPool: s.ConnPool, Pool: s.Pool, Namespace: namespace, Separator: s.Separator, Interval: interval, Limit: limit, c: s.c}, nil
+}
+
+// Pass sends an item through the BucketWindow, returning false should the
+// rate-limit for this item be exceeded. Rejected actions are not counted.
+// It fails with ErrInvalidConfig should the Interval or the Limit not be
+// positive.
+func (w *BucketWindow) Pass(item string) (bool, error) {
+	counted, _, err := w.run(item, true)
+	return counted, err
+}
+
+// Peek returns the number of actions counted for item during the current
+// Interval, including those of buckets partly past it, without counting one.
+func (w *BucketWindow) Peek(item string) (int64, error) {
+	_, count, err := w.run(item, false)
+	return count, err
+}
+
+// run evaluates bucketWindowScript for item, counting an action if record
+// is set.
+func (w *BucketWindow) run(item string, record bool) (bool, int64, error) {
+	if err := checkWindow(w.Interval, w.Limit); err != nil {
+		return false, 0, err
+	}
+	key, err := joinKey(w.Namespace, w.Separator, item)
+	if err != nil {
+		return false, 0, err
+	}
+	now := Now()
+	if w.c != nil {
+		now = w.c.Now()
+	}
+	size := int64(w.Bucket)
+	if size <= 0 {
+		size = int64(w.Interval / 10)
+	}
+	if size < 1 {
+		size = 1
+	}
+	bucket := now.UnixNano() - now.UnixNano()%size
+	cutoff := now.UnixNano() - int64(w.Interval) - size
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), key)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	flag := "1"
+	if !record {
+		flag = "0"
+	}
+	values, err := redis.Values(bucketWindowScript.run(c, key, auxKey(key, "counts"), bucket, cutoff, w.Limit, durationMillis(w.Interval+time.Duration(size)), flag))
+	if err != nil {
+		return false, 0, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	var counted, count int64
+	if _, err := redis.Scan(values, &counted, &count); err != nil {
+		return false, 0, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	return counted == 1, count, nil
+}
@@ -0,0 +1,63 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBucketWindow(t *testing.T) {
+	Convey("Given a bucketed sliding window limiter", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		window := &BucketWindow{
+			Namespace: "bucketwindow",
+			Interval:  time.Second,
+			Limit:     3,
+			Bucket:    100 * time.Millisecond,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := window.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Actions up to the limit pass", func() {
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+			count, err := window.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+
+			Convey("And are counted for up to a bucket past the interval", func() {
+				clock.AddTime(window.Interval + 50*time.Millisecond)
+				So(pass(), ShouldBeFalse)
+
+				clock.AddTime(50 * time.Millisecond)
+				So(pass(), ShouldBeTrue)
+			})
+		})
+
+		Convey("A bucket holds any number of actions in one member", func() {
+			window.Limit = 100
+			for i := 0; i < 50; i++ {
+				clock.AddTime(time.Millisecond)
+				So(pass(), ShouldBeTrue)
+			}
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			buckets, err := redis.Int64(conn.Do("ZCARD", "bucketwindow:foo"))
+			So(err, ShouldBeNil)
+			So(buckets, ShouldBeLessThanOrEqualTo, 2)
+			count, err := window.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 50)
+		})
+	})
+}
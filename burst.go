@@ -0,0 +1,125 @@
+package flowstopper
+
+import (
+	"fmt"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Constraint tells which limit rejected an action, of a BurstLimit or of
+// PassGlobal.
+type Constraint int
+
+const (
+	// ConstraintNone is the Constraint of actions which passed.
+	ConstraintNone Constraint = iota
+
+	// ConstraintBurst is the Constraint of actions exceeding the Burst.
+	ConstraintBurst
+
+	// ConstraintSustained is the Constraint of actions within the Burst,
+	// but exceeding the Sustained rate.
+	ConstraintSustained
+
+	// ConstraintItem is the Constraint of actions exceeding the Limit of
+	// their item.
+	ConstraintItem
+
+	// ConstraintGlobal is the Constraint of actions within the Limit of
+	// their item, but exceeding the GlobalLimit.
+	ConstraintGlobal
+)
+
+func (c Constraint) String() string {
+	switch c {
+	case ConstraintNone:
+		return "none"
+	case ConstraintBurst:
+		return "burst"
+	case ConstraintSustained:
+		return "sustained"
+	case ConstraintItem:
+		return "item"
+	case ConstraintGlobal:
+		return "global"
+	}
+	return fmt.Sprintf("Constraint(%d)", int(c))
+}
+
+// BurstLimit is a sliding log rate limiter allowing short bursts of actions
+// while bounding their average over a longer window, such as bursts of 20
+// actions per second but no more than 100 per minute sustained. It is a
+// MultiLimit with these two rules, so both are checked and the action
+// recorded in a single script, and an action rejected by either takes up no
+// room in the other.
+type BurstLimit struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain ":".
+	Namespace string
+
+	// The short window bounding the size of bursts.
+	Burst Rule
+
+	// The long window bounding the sustained rate of actions. Its Interval
+	// must be longer than that of the Burst.
+	Sustained Rule
+
+	c clock.Clock
+}
+
+// BurstResult is the decision of a BurstLimit.
+type BurstResult struct {
+	// Whether the action passed.
+	Allowed bool
+
+	// The window which rejected the action, if any, the Burst taking
+	// precedence should it exceed both.
+	Constraint Constraint
+
+	// The number of actions during the Interval of the Burst, counting the
+	// attempted one whether recorded or not.
+	BurstCount int64
+
+	// The number of actions during the Interval of the Sustained rule,
+	// counting the attempted one whether recorded or not.
+	SustainedCount int64
+}
+
+// Pass sends an item through the BurstLimit, returning whether it passed
+// and which constraint rejected it otherwise, so that the two windows can be
+// tuned. It fails with ErrInvalidConfig for rules which aren't positive, or
+// a Burst no shorter than the Sustained rule.
+func (b *BurstLimit) Pass(item string) (BurstResult, error) {
+	switch {
+	case b.Burst.Interval <= 0 || b.Burst.Limit <= 0:
+		return BurstResult{}, fmt.Errorf("%w: burst of %d per %s is not positive", ErrInvalidConfig, b.Burst.Limit, b.Burst.Interval)
+	case b.Sustained.Interval <= 0 || b.Sustained.Limit <= 0:
+		return BurstResult{}, fmt.Errorf("%w: sustained rate of %d per %s is not positive", ErrInvalidConfig, b.Sustained.Limit, b.Sustained.Interval)
+	case b.Burst.Interval >= b.Sustained.Interval:
+		return BurstResult{}, fmt.Errorf("%w: burst interval %s is not shorter than sustained interval %s", ErrInvalidConfig, b.Burst.Interval, b.Sustained.Interval)
+	}
+	m := &MultiLimit{
+		ConnPool:  b.ConnPool,
+		Pool:      b.Pool,
+		Namespace: b.Namespace,
+		Rules:     []Rule{b.Burst, b.Sustained},
+		c:         b.c,
+	}
+	r, err := m.Pass(item)
+	if err != nil {
+		return BurstResult{}, err
+	}
+	return BurstResult{
+		Allowed:        r.Allowed,
+		Constraint:     Constraint(r.Exceeded + 1),
+		BurstCount:     r.Counts[0],
+		SustainedCount: r.Counts[1],
+	}, nil
+}
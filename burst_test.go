@@ -0,0 +1,54 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBurstLimit(t *testing.T) {
+	Convey("Given a limiter allowing bursts", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		limiter := &BurstLimit{
+			Namespace: "burstlimit",
+			Burst:     Rule{Interval: time.Second, Limit: 3},
+			Sustained: Rule{Interval: time.Minute, Limit: 5},
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() BurstResult {
+			clock.AddTime(time.Millisecond)
+			r, err := limiter.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		Convey("A burst passes up to its limit", func() {
+			for i := 0; i < 3; i++ {
+				So(pass().Allowed, ShouldBeTrue)
+			}
+			So(pass(), ShouldResemble, BurstResult{Constraint: ConstraintBurst, BurstCount: 4, SustainedCount: 4})
+
+			Convey("And the sustained rate binds across bursts", func() {
+				clock.AddTime(time.Second)
+				So(pass(), ShouldResemble, BurstResult{Allowed: true, BurstCount: 1, SustainedCount: 4})
+				So(pass().Allowed, ShouldBeTrue)
+				r := pass()
+				So(r, ShouldResemble, BurstResult{Constraint: ConstraintSustained, BurstCount: 3, SustainedCount: 6})
+				So(r.Constraint.String(), ShouldEqual, "sustained")
+			})
+		})
+
+		Convey("A burst no shorter than the sustained window is invalid", func() {
+			limiter.Burst.Interval = time.Minute
+			_, err := limiter.Pass("foo")
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,284 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Conn is a connection to redis, used by a Stopper for a single operation
+// and closed once it is done.
+//
+// Replies are expected in the shapes redigo uses, so that clients other than
+// redigo can be adapted: int64 for integers, []byte for bulk strings, string
+// for status replies, []interface{} for arrays, a nil reply rather than an
+// error for nil, and an error value for errors nested in arrays.
+type Conn interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+	Close() error
+}
+
+// Pool hands out connections to redis. The connections must not be shared
+// with other operations until they are closed, as a Stopper may issue
+// MULTI and EXEC on them.
+type Pool interface {
+	GetContext(ctx context.Context) (Conn, error)
+}
+
+// RedigoPool adapts a redigo pool to a Pool. A Stopper whose Pool is unset
+// uses its ConnPool this way; redigo connections additionally let commands
+// be pipelined.
+func RedigoPool(p *redis.Pool) Pool {
+	return redigoPool{p}
+}
+
+// SingleConn adapts a single redigo connection to a Pool, for short-lived
+// programs and tests which have a connection at hand but no pool, and for
+// memory-constrained services which would rather share one long-lived
+// connection than keep a pool of them. Although redigo connections are not
+// safe for concurrent use, the Pool is: the connection is handed out to one
+// operation at a time, the others waiting for it to be done or for their
+// context to be done, so that a Stopper on it may be used by any number of
+// goroutines. An operation left with a transaction open, such as by a
+// failure halfway through it, has it discarded as the connection is handed
+// back. The connection is never closed, as it remains the caller's to close
+// once the Stopper is no longer used, and must not be used elsewhere
+// meanwhile.
+//
+// Redigo connections are broken for good once a command fails on the
+// network, such as when the ReadTimeout gives up waiting for a reply. Every
+// operation then fails with ErrConnUnavailable, so long-lived services are
+// better served by DialSingleConn, which dials a new one.
+func SingleConn(c redis.Conn) Pool {
+	p := &singleConn{c: c, free: make(chan struct{}, 1)}
+	p.free <- struct{}{}
+	return p
+}
+
+// DialSingleConn is like SingleConn, but dials the connection with dial when
+// it is first needed, and again whenever the one at hand is broken. The
+// connection is the Pool's, closed by its Close.
+func DialSingleConn(dial func() (redis.Conn, error)) *DialedConn {
+	p := &DialedConn{singleConn{dial: dial, free: make(chan struct{}, 1)}}
+	p.free <- struct{}{}
+	return p
+}
+
+// DialedConn is the Pool returned by DialSingleConn.
+type DialedConn struct {
+	singleConn
+}
+
+// Close closes the connection, once the operation using it, if any, is
+// done. The next operation dials a new one.
+func (p *DialedConn) Close() error {
+	<-p.free
+	defer func() { p.free <- struct{}{} }()
+	if p.c == nil {
+		return nil
+	}
+	err := p.c.Close()
+	p.c = nil
+	return err
+}
+
+type singleConn struct {
+	c    redis.Conn
+	dial func() (redis.Conn, error)
+	free chan struct{}
+}
+
+func (p *singleConn) GetContext(ctx context.Context) (Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.free:
+	}
+	if err := p.ready(); err != nil {
+		p.free <- struct{}{}
+		return nil, err
+	}
+	return &borrowedConn{Conn: p.c, free: p.free}, nil
+}
+
+// ready makes sure the connection is usable, replacing a broken one when
+// the Pool may dial.
+func (p *singleConn) ready() error {
+	if p.c != nil {
+		err := p.c.Err()
+		if err == nil {
+			return nil
+		}
+		if p.dial == nil {
+			return fmt.Errorf("flowstopper: single connection broken: %w", err)
+		}
+		_ = p.c.Close()
+		p.c = nil
+	}
+	c, err := p.dial()
+	if err != nil {
+		return err
+	}
+	p.c = c
+	return nil
+}
+
+// borrowedConn is the connection of a singleConn lent to an operation,
+// which closing returns rather than closes.
+type borrowedConn struct {
+	redis.Conn
+	free     chan struct{}
+	returned bool
+
+	// Whether a MULTI was issued without its EXEC or DISCARD, and whether
+	// commands were sent without their replies being read.
+	multi, pending bool
+}
+
+func (c *borrowedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.track(cmd)
+	c.pending = false
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *borrowedConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	c.track(cmd)
+	c.pending = false
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+func (c *borrowedConn) Send(cmd string, args ...interface{}) error {
+	c.track(cmd)
+	c.pending = true
+	return c.Conn.Send(cmd, args...)
+}
+
+// track follows whether cmd leaves a transaction open.
+func (c *borrowedConn) track(cmd string) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.multi = true
+	case "EXEC", "DISCARD":
+		c.multi = false
+	}
+}
+
+// Close hands the connection back, discarding an open transaction and
+// reading the replies still pending first, so that the next operation
+// starts on a clean connection. Redigo's pool does the same for its own.
+func (c *borrowedConn) Close() error {
+	if c.returned {
+		return nil
+	}
+	c.returned = true
+	if c.multi {
+		_ = c.Conn.Send("DISCARD")
+		c.multi, c.pending = false, true
+	}
+	if c.pending {
+		// An empty command flushes what was sent and reads the replies.
+		_, _ = c.Conn.Do("")
+	}
+	c.free <- struct{}{}
+	return nil
+}
+
+// poolOf returns pool, falling back to the redigo connPool.
+func poolOf(pool Pool, connPool *redis.Pool) Pool {
+	if pool == nil {
+		return RedigoPool(connPool)
+	}
+	return pool
+}
+
+type redigoPool struct {
+	p *redis.Pool
+}
+
+func (p redigoPool) GetContext(ctx context.Context) (Conn, error) {
+	return p.p.GetContext(ctx)
+}
+
+// pipeliner is implemented by connections able to queue several commands
+// before waiting for their replies, such as redigo's.
+type pipeliner interface {
+	Send(cmd string, args ...interface{}) error
+}
+
+// transaction collects commands to be issued as a single MULTI/EXEC
+// transaction.
+type transaction struct {
+	cmds [][]interface{}
+}
+
+func (t *transaction) add(cmd string, args ...interface{}) {
+	t.cmds = append(t.cmds, append([]interface{}{cmd}, args...))
+}
+
+// exec runs the transaction on c, returning the replies to its commands,
+// one per command, among which are the errors of commands failing within
+// the transaction. Where the connection allows, they are sent in a single
+// round trip.
+func (t *transaction) exec(c Conn) ([]interface{}, error) {
+	values, err := t.send(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(t.cmds) {
+		return nil, fmt.Errorf("flowstopper: EXEC returned %d replies to %d commands", len(values), len(t.cmds))
+	}
+	return values, nil
+}
+
+// execAll runs the transaction on c like exec, but fails with a descriptive
+// error should any of its commands have failed.
+func (t *transaction) execAll(c Conn) ([]interface{}, error) {
+	values, err := t.exec(c)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if e, ok := v.(error); ok {
+			return nil, fmt.Errorf("flowstopper: %s failed within transaction: %w", t.cmds[i][0], e)
+		}
+	}
+	return values, nil
+}
+
+// send sends the transaction to c, returning the reply to EXEC.
+func (t *transaction) send(c Conn) ([]interface{}, error) {
+	if p, ok := pipelinerOf(c); ok {
+		if err := p.Send("MULTI"); err != nil {
+			return nil, err
+		}
+		for _, cmd := range t.cmds {
+			if err := p.Send(cmd[0].(string), cmd[1:]...); err != nil {
+				return nil, err
+			}
+		}
+		return redis.Values(c.Do("EXEC"))
+	}
+
+	if _, err := c.Do("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range t.cmds {
+		if _, err := c.Do(cmd[0].(string), cmd[1:]...); err != nil {
+			_, _ = c.Do("DISCARD")
+			return nil, err
+		}
+	}
+	return redis.Values(c.Do("EXEC"))
+}
+
+// pipelinerOf returns c as a pipeliner, if the connection it wraps is one.
+func pipelinerOf(c Conn) (pipeliner, bool) {
+	if op, ok := c.(*operationConn); ok {
+		c = op.Conn
+	}
+	p, ok := c.(pipeliner)
+	return p, ok
+}
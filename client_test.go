@@ -0,0 +1,250 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// doOnlyConn hides everything but Do and Close of a connection, like an
+// adapter for a client other than redigo would.
+type doOnlyConn struct {
+	Conn
+}
+
+type doOnlyPool struct{}
+
+func (doOnlyPool) GetContext(ctx context.Context) (Conn, error) {
+	c, err := connPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return doOnlyConn{c}, nil
+}
+
+func TestPool(t *testing.T) {
+	Convey("Given a stopper on a client which cannot pipeline", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper, err := NewStopper(nil, "pool", 5*time.Second, 2, WithPool(doOnlyPool{}), WithClock(clock))
+		So(err, ShouldBeNil)
+
+		pass := func(item string) bool {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.Pass(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Actions are limited as usual", func() {
+			So(pass("foo"), ShouldBeTrue)
+			So(pass("foo"), ShouldBeTrue)
+			So(pass("foo"), ShouldBeFalse)
+
+			Convey("And transactions still work", func() {
+				So(stopper.Reset("foo"), ShouldBeNil)
+				So(pass("foo"), ShouldBeTrue)
+
+				clock.AddTime(time.Millisecond)
+				results, err := stopper.PassBatch([]CheckRequest{{Item: "foo"}, {Item: "foo"}})
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []Result{{Allowed: true, Count: 2}, {Allowed: false, Count: 3}})
+
+				r, err := stopper.ReserveWithTTL("bar", time.Second)
+				So(err, ShouldBeNil)
+				So(r.OK(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+// closeCountingConn counts the calls to Close of a connection.
+type closeCountingConn struct {
+	redis.Conn
+	closed int
+}
+
+func (c *closeCountingConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestSingleConn(t *testing.T) {
+	Convey("Given a stopper on a single connection", t, func() {
+		flushRealRedis(t)
+		conn := &closeCountingConn{Conn: connPool.Get()}
+		defer func() { _ = conn.Conn.Close() }()
+		clock := clock.NewMockClock(now)
+		stopper, err := NewStopper(nil, "singleconn", 5*time.Second, 2, WithConn(conn), WithClock(clock))
+		So(err, ShouldBeNil)
+
+		Convey("Actions are limited as usual", func() {
+			for _, want := range []bool{true, true, false} {
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldEqual, want)
+			}
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+
+			Convey("And the connection is left open", func() {
+				So(stopper.Close(context.Background()), ShouldBeNil)
+				So(conn.closed, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Concurrent actions take turns on the connection", func() {
+			stopper.Limit = 20
+			var wg sync.WaitGroup
+			var passed, failed int64
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, err := stopper.Pass("foo")
+					switch {
+					case err != nil:
+						atomic.AddInt64(&failed, 1)
+					case ok:
+						atomic.AddInt64(&passed, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			So(failed, ShouldEqual, 0)
+			So(passed, ShouldEqual, 20)
+		})
+
+		Convey("Operations wait for the connection to be free", func() {
+			pool := SingleConn(conn)
+			c, err := pool.GetContext(context.Background())
+			So(err, ShouldBeNil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err = pool.GetContext(ctx)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+
+			So(c.Close(), ShouldBeNil)
+			c, err = pool.GetContext(context.Background())
+			So(err, ShouldBeNil)
+			So(c.Close(), ShouldBeNil)
+		})
+	})
+}
+
+// breakableConn is a connection reporting itself broken on demand.
+type breakableConn struct {
+	redis.Conn
+	broken bool
+}
+
+func (c *breakableConn) Err() error {
+	if c.broken {
+		return errors.New("use of closed network connection")
+	}
+	return c.Conn.Err()
+}
+
+func TestSingleConnRecovery(t *testing.T) {
+	Convey("Given a stopper on a single connection", t, func() {
+		flushRealRedis(t)
+		conn := &breakableConn{Conn: connPool.Get()}
+		defer func() { _ = conn.Conn.Close() }()
+		pool := SingleConn(conn)
+		stopper, err := NewStopper(nil, "singleconn", 5*time.Second, 2, WithPool(pool), WithClock(clock.NewMockClock(now)))
+		So(err, ShouldBeNil)
+
+		Convey("A transaction left open is discarded as the connection is handed back", func() {
+			c, err := pool.GetContext(context.Background())
+			So(err, ShouldBeNil)
+			_, err = c.Do("MULTI")
+			So(err, ShouldBeNil)
+			_, err = c.Do("SET", "singleconn:left", "open")
+			So(err, ShouldBeNil)
+			So(c.Close(), ShouldBeNil)
+
+			c, err = pool.GetContext(context.Background())
+			So(err, ShouldBeNil)
+			defer func() { _ = c.Close() }()
+			reply, err := c.Do("GET", "singleconn:left")
+			So(err, ShouldBeNil)
+			So(reply, ShouldBeNil)
+		})
+
+		Convey("Once the connection is broken operations fail", func() {
+			conn.broken = true
+			_, err := stopper.Pass("foo")
+			So(errors.Is(err, ErrConnUnavailable), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a stopper on a single connection it dials", t, func() {
+		flushRealRedis(t)
+		var conns []*breakableConn
+		pool := DialSingleConn(func() (redis.Conn, error) {
+			c := &breakableConn{Conn: connPool.Get()}
+			conns = append(conns, c)
+			return c, nil
+		})
+		defer func() { _ = pool.Close() }()
+		stopper, err := NewStopper(nil, "singleconn", 5*time.Second, 2, WithPool(pool), WithClock(clock.NewMockClock(now)))
+		So(err, ShouldBeNil)
+
+		Convey("The connection is dialed when first needed", func() {
+			So(conns, ShouldBeEmpty)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(conns, ShouldHaveLength, 1)
+
+			Convey("And dialed again once broken", func() {
+				conns[0].broken = true
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+				So(conns, ShouldHaveLength, 2)
+			})
+
+			Convey("And closed with the pool", func() {
+				So(pool.Close(), ShouldBeNil)
+				So(conns[0].Conn.Err(), ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestTransactionReplies(t *testing.T) {
+	Convey("Given a stopper counting free actions in a transaction", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		stopper.FreeAllowance = 3
+		conn.Command("MULTI")
+		exec := conn.Command("EXEC")
+
+		Convey("A command failing within the transaction is reported", func() {
+			failure := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+			exec.Expect([]interface{}{failure, int64(1)})
+			_, err := stopper.Pass("foo")
+			So(errors.Is(err, failure), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "INCRBY failed within transaction")
+		})
+
+		Convey("A reply of the wrong length is not misread", func() {
+			exec.Expect([]interface{}{int64(1)})
+			_, err := stopper.Pass("foo")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "EXEC returned 1 replies to 2 commands")
+		})
+	})
+}
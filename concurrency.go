@@ -0,0 +1,104 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// acquireScript takes a slot in the set of in-flight operations stored at
+// KEYS[1], first removing those whose expiry, their score, is at or before
+// ARGV[1]. Unless ARGV[2] operations are in flight already, it adds token
+// ARGV[3] expiring at ARGV[4], and keeps the set for ARGV[5] milliseconds.
+// It returns 1 if the slot was taken and 0 otherwise.
+var acquireScript = newScript(1, `
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[4], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+// Concurrency is a limiter bounding the number of operations in flight for
+// each item at once, rather than their rate. Each operation holds a slot
+// from Acquire until it releases it.
+//
+// Slots are stored as tokens in a sorted set per item, scored by when they
+// expire. Should a holder crash or forget to release its slot, the slot is
+// freed once TTL elapses, so TTL should comfortably exceed the longest
+// operation.
+type Concurrency struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain ":".
+	Namespace string
+
+	// The maximum number of operations in flight for an item at once.
+	Limit int64
+
+	// How long a slot is held at most before it is freed even without a
+	// release.
+	TTL time.Duration
+
+	c clock.Clock
+}
+
+// Acquire takes a slot for an operation on item, returning false should
+// Limit operations already be in flight. When the slot is taken, release
+// frees it again, removing just this operation's token.
+func (l *Concurrency) Acquire(item string) (release func() error, ok bool, err error) {
+	if strings.Contains(l.Namespace, defaultSeparator) {
+		return nil, false, ErrInvalidNamespace
+	}
+	key := l.Namespace + defaultSeparator + item
+
+	now := Now()
+	if l.c != nil {
+		now = l.c.Now()
+	}
+	nanonow := now.UnixNano()
+	token := strconv.FormatInt(nanonow, 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+
+	c, err := getConn(context.Background(), poolOf(l.Pool, l.ConnPool), key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	taken, err := redis.Int64(acquireScript.run(c, key, nanonow, l.Limit, token, now.Add(l.TTL).UnixNano(), durationMillis(l.TTL)))
+	if err != nil {
+		return nil, false, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	if taken == 0 {
+		return nil, false, nil
+	}
+	return func() error { return l.release(item, key, token) }, true, nil
+}
+
+// release removes token from the in-flight operations of item stored at
+// key.
+func (l *Concurrency) release(item, key, token string) error {
+	c, err := getConn(context.Background(), poolOf(l.Pool, l.ConnPool), key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if _, err := c.Do("ZREM", key, token); err != nil {
+		return fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConcurrency(t *testing.T) {
+	Convey("Given a concurrency limiter", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		limiter := &Concurrency{
+			Namespace: "concurrency",
+			Limit:     2,
+			TTL:       time.Minute,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		acquire := func(item string) (func() error, bool) {
+			clock.AddTime(time.Millisecond)
+			release, ok, err := limiter.Acquire(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return release, ok
+		}
+
+		Convey("Slots are handed out up to the limit", func() {
+			release, ok := acquire("foo")
+			So(ok, ShouldBeTrue)
+			_, ok = acquire("foo")
+			So(ok, ShouldBeTrue)
+			_, ok = acquire("foo")
+			So(ok, ShouldBeFalse)
+
+			Convey("Other items have slots of their own", func() {
+				_, ok := acquire("bar")
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("Releasing one frees it for another operation", func() {
+				So(release(), ShouldBeNil)
+				_, ok := acquire("foo")
+				So(ok, ShouldBeTrue)
+				_, ok = acquire("foo")
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Slots never released are freed after the TTL", func() {
+				clock.AddTime(limiter.TTL)
+				_, ok := acquire("foo")
+				So(ok, ShouldBeTrue)
+				_, ok = acquire("foo")
+				So(ok, ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,102 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// conformanceBackends lists every backend the conformance scenarios are run
+// against. Each is constructed with fresh state.
+var conformanceBackends = []struct {
+	name string
+	new  func(t *testing.T, c clock.Clock, interval time.Duration, limit int64) Limiter
+}{
+	{"redis", func(t *testing.T, c clock.Clock, interval time.Duration, limit int64) Limiter {
+		flushRealRedis(t)
+		return &Stopper{
+			Namespace: "conformance",
+			Interval:  interval,
+			Limit:     limit,
+			ConnPool:  &connPool,
+			c:         c,
+		}
+	}},
+	{"memory", func(t *testing.T, c clock.Clock, interval time.Duration, limit int64) Limiter {
+		return &MemoryLimiter{Interval: interval, Limit: limit, c: c}
+	}},
+}
+
+type conformanceStep struct {
+	advance time.Duration
+	item    string
+	want    bool
+}
+
+var conformanceScenarios = []struct {
+	name     string
+	interval time.Duration
+	limit    int64
+	steps    []conformanceStep
+}{
+	{"up to the limit passes", 5 * time.Second, 3, []conformanceStep{
+		{time.Millisecond, "foo", true},
+		{time.Millisecond, "foo", true},
+		{time.Millisecond, "foo", true},
+		{time.Millisecond, "foo", false},
+	}},
+	{"items are limited independently", 5 * time.Second, 1, []conformanceStep{
+		{time.Millisecond, "foo", true},
+		{time.Millisecond, "bar", true},
+		{time.Millisecond, "foo", false},
+		{time.Millisecond, "bar", false},
+	}},
+	// Actions at the same instant are counted separately.
+	{"same-timestamp collisions", 5 * time.Second, 2, []conformanceStep{
+		{time.Millisecond, "foo", true},
+		{0, "foo", true},
+		{0, "foo", false},
+		{time.Millisecond, "foo", false},
+	}},
+	// Entries exactly one Interval old are outside the window. Blocked
+	// attempts are not recorded, so do not extend it.
+	{"boundary entries", 5 * time.Second, 1, []conformanceStep{
+		{time.Millisecond, "foo", true},
+		{5*time.Second - time.Millisecond, "foo", false},
+		{time.Millisecond, "foo", true},
+		{time.Millisecond, "foo", false},
+	}},
+	{"trimming frees the window", 5 * time.Second, 2, []conformanceStep{
+		{time.Millisecond, "foo", true},
+		{time.Second, "foo", true},
+		{time.Second, "foo", false},
+		{4 * time.Second, "foo", true},
+		{time.Millisecond, "foo", true},
+		{time.Millisecond, "foo", false},
+	}},
+}
+
+func TestBackendConformance(t *testing.T) {
+	for _, backend := range conformanceBackends {
+		for _, scenario := range conformanceScenarios {
+			Convey("Given the "+backend.name+" backend", t, func() {
+				clock := clock.NewMockClock(now)
+				limiter := backend.new(t, clock, scenario.interval, scenario.limit)
+
+				Convey("Decisions match for "+scenario.name, func() {
+					var got, want []bool
+					for _, step := range scenario.steps {
+						clock.AddTime(step.advance)
+						passed, err := limiter.Pass(step.item)
+						So(err, ShouldBeNil)
+						got = append(got, passed)
+						want = append(want, step.want)
+					}
+					So(got, ShouldResemble, want)
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package flowstopper
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// debounceScript admits an action if at least ARGV[2] microseconds have
+// passed since the last admitted one, stored at KEYS[1], returning nil. Else
+// it returns the time of the last admitted action. Times are kept in
+// microseconds since the epoch, which Lua's numbers represent exactly.
+var debounceScript = newScript(1, `
+local last = redis.call("GET", KEYS[1])
+if last and tonumber(ARGV[1]) - tonumber(last) < tonumber(ARGV[2]) then
+	return last
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return false
+`)
+
+// Debounce admits an action for item only if at least gap has passed since
+// the last admitted one, regardless of the Stopper's Limit and Interval. When
+// the action is not admitted, the time until the next one would be is
+// returned. The time of the last admitted action is kept in a single key,
+// which expires once gap has elapsed. A gap that isn't positive admits every
+// action without touching redis.
+func (s *Stopper) Debounce(item string, gap time.Duration) (bool, time.Duration, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return false, 0, err
+	}
+	if gap <= 0 {
+		return true, 0, nil
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	micronow := now.UnixNano() / int64(time.Microsecond)
+	gapmicros := int64(gap / time.Microsecond)
+	last, err := redis.Int64(debounceScript.run(c, auxKey(key, "debounce"), micronow, gapmicros, durationMillis(gap)))
+	if err == redis.ErrNil {
+		return true, 0, nil
+	}
+	if err != nil {
+		return false, 0, s.itemError(item, err)
+	}
+	return false, time.Duration(gapmicros-(micronow-last)) * time.Microsecond, nil
+}
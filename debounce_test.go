@@ -0,0 +1,82 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDebounce(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "debounce",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+
+		debounce := func() (bool, time.Duration) {
+			admitted, wait, err := stopper.Debounce("foo", 30*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return admitted, wait
+		}
+
+		Convey("The first action is admitted", func() {
+			admitted, wait := debounce()
+			So(admitted, ShouldBeTrue)
+			So(wait, ShouldEqual, 0)
+
+			Convey("Actions within the gap are not", func() {
+				clock.AddTime(10 * time.Second)
+				admitted, wait := debounce()
+				So(admitted, ShouldBeFalse)
+				So(wait, ShouldEqual, 20*time.Second)
+
+				clock.AddTime(20*time.Second - time.Millisecond)
+				admitted, wait = debounce()
+				So(admitted, ShouldBeFalse)
+				So(wait, ShouldEqual, time.Millisecond)
+			})
+
+			Convey("The next one is admitted once the gap has passed", func() {
+				clock.AddTime(30 * time.Second)
+				admitted, _ := debounce()
+				So(admitted, ShouldBeTrue)
+
+				Convey("And the gap starts over", func() {
+					clock.AddTime(time.Second)
+					admitted, wait := debounce()
+					So(admitted, ShouldBeFalse)
+					So(wait, ShouldEqual, 29*time.Second)
+				})
+			})
+
+			Convey("Rejected actions don't push the next one back", func() {
+				clock.AddTime(15 * time.Second)
+				debounce()
+				clock.AddTime(15 * time.Second)
+				admitted, _ := debounce()
+				So(admitted, ShouldBeTrue)
+			})
+		})
+
+		Convey("Without a gap every action is admitted", func() {
+			for i := 0; i < 3; i++ {
+				admitted, wait, err := stopper.Debounce("foo", 0)
+				So(err, ShouldBeNil)
+				So(admitted, ShouldBeTrue)
+				So(wait, ShouldEqual, 0)
+			}
+			admitted, _, err := stopper.Debounce("foo", -time.Second)
+			So(err, ShouldBeNil)
+			So(admitted, ShouldBeTrue)
+		})
+	})
+}
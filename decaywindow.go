@@ -0,0 +1,190 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// decayWindowScript trims the actions older than ARGV[2] nanoseconds from
+// the window stored at KEYS[1], and sums the weights of the remaining ones,
+// each decayed linearly by its age at ARGV[1]. Unless the sum plus ARGV[4]
+// exceeds ARGV[3], an action weighing ARGV[4] is recorded, and the window
+// set to expire after ARGV[5] milliseconds. Weights are stored in front of
+// the members, so that actions recorded at the same instant stay distinct.
+// The window start is formatted in full, as Lua would otherwise print it
+// with only 14 significant digits, rounding it to a tenth of a
+// millisecond.
+// It returns 1 if the action was recorded and 0 otherwise.
+var decayWindowScript = newScript(1, `
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local weight = tonumber(ARGV[4])
+local start = string.format("%.0f", now - interval)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", start)
+local entries = redis.call("ZRANGEBYSCORE", KEYS[1], "(" .. start, "+inf", "WITHSCORES")
+local sum = 0
+for i = 1, #entries, 2 do
+	local w = tonumber(string.match(entries[i], "^([^:]+):"))
+	local age = now - tonumber(entries[i + 1])
+	if age < 0 then
+		age = 0
+	end
+	sum = sum + w * (1 - age / interval)
+end
+if sum + weight > tonumber(ARGV[3]) then
+	return 0
+end
+local member = ARGV[4] .. ":" .. ARGV[1]
+local n = 0
+while redis.call("ZSCORE", KEYS[1], member) do
+	n = n + 1
+	member = ARGV[4] .. ":" .. ARGV[1] .. "-" .. n
+end
+redis.call("ZADD", KEYS[1], ARGV[1], member)
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+// DecayWindow is a rate limiter keeping a sliding log of weighted actions
+// per item, like a Stopper's, whose weights decay linearly to zero over the
+// Interval. An action is allowed while the decayed weights of the window,
+// plus its own, stay within the Limit.
+//
+// Where a Stopper counts an action fully until it drops out of the window
+// all at once, a DecayWindow lets its pressure fade as it ages, so room
+// returns gradually rather than in a burst at the window's edge. As decayed
+// weights sum to less than the actions they stand for, slightly more
+// actions pass over an Interval than with a Stopper of the same Limit.
+type DecayWindow struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain ":".
+	Namespace string
+
+	// The time over which the weight of an action decays to zero.
+	Interval time.Duration
+
+	// The maximum decayed weight allowed in the window.
+	Limit int64
+
+	c clock.Clock
+}
+
+// Pass sends an item through the DecayWindow as an action of weight 1,
+// returning false should the decayed weight of the item's window exceed the
+// limit with it. Rejected actions are not recorded.
+func (w *DecayWindow) Pass(item string) (bool, error) {
+	return w.PassWeight(item, 1)
+}
+
+// PassWeight is like Pass, but for an action weighing weight, such as for
+// costlier operations. A weight above the Limit never passes.
+func (w *DecayWindow) PassWeight(item string, weight float64) (bool, error) {
+	if weight <= 0 {
+		return false, fmt.Errorf("%w: weight must be positive", ErrInvalidConfig)
+	}
+	key, err := w.key(item)
+	if err != nil {
+		return false, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	recorded, err := redis.Int64(decayWindowScript.run(c, key, w.now().UnixNano(), int64(w.Interval), w.Limit, strconv.FormatFloat(weight, 'f', -1, 64), durationMillis(w.Interval)))
+	if err != nil {
+		return false, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	return recorded == 1, nil
+}
+
+// Peek returns the number of actions recorded for item during the current
+// Interval, regardless of their weights, without recording one.
+func (w *DecayWindow) Peek(item string) (int64, error) {
+	key, err := w.key(item)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	windowStart := w.now().Add(-w.Interval).UnixNano()
+	count, err := redis.Int64(c.Do("ZCOUNT", key, exclusive(windowStart), "+inf"))
+	if err != nil {
+		return 0, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	return count, nil
+}
+
+// Pressure returns the decayed weight of the actions recorded for item,
+// which a further action must fit next to within the Limit, without
+// recording one.
+func (w *DecayWindow) Pressure(item string) (float64, error) {
+	key, err := w.key(item)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	now := w.now().UnixNano()
+	values, err := redis.Values(c.Do("ZRANGEBYSCORE", key, exclusive(now-int64(w.Interval)), "+inf", "WITHSCORES"))
+	if err != nil {
+		return 0, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	var sum float64
+	for len(values) > 0 {
+		var member string
+		var score float64
+		if values, err = redis.Scan(values, &member, &score); err != nil {
+			return 0, fmt.Errorf("flowstopper: %q: %w", item, err)
+		}
+		weight, err := strconv.ParseFloat(strings.SplitN(member, ":", 2)[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("flowstopper: %q: %w", item, err)
+		}
+		age := float64(now) - score
+		if age < 0 {
+			age = 0
+		}
+		sum += weight * (1 - age/float64(w.Interval))
+	}
+	return sum, nil
+}
+
+// key returns the redis key of the window for item.
+func (w *DecayWindow) key(item string) (string, error) {
+	if strings.Contains(w.Namespace, defaultSeparator) {
+		return "", ErrInvalidNamespace
+	}
+	return w.Namespace + defaultSeparator + item, nil
+}
+
+func (w *DecayWindow) now() time.Time {
+	if w.c == nil {
+		return Now()
+	}
+	return w.c.Now()
+}
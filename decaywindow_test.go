@@ -0,0 +1,78 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDecayWindow(t *testing.T) {
+	Convey("Given a decaying window limiter", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		window := &DecayWindow{
+			Namespace: "decaywindow",
+			Interval:  time.Minute,
+			Limit:     3,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := window.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Fresh actions weigh fully against the limit", func() {
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+			count, err := window.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+
+			Convey("And their weight fades as they age", func() {
+				// Half way through the interval, the three actions weigh
+				// 1.5, leaving room for one more but not two.
+				clock.AddTime(30 * time.Second)
+				pressure, err := window.Pressure("foo")
+				So(err, ShouldBeNil)
+				So(pressure, ShouldAlmostEqual, 1.5, 1e-6)
+				So([]bool{pass(), pass()}, ShouldResemble, []bool{true, false})
+			})
+
+			Convey("And stay in the window until its very end", func() {
+				clock.AddTime(time.Minute - 30*time.Microsecond)
+				So(pass(), ShouldBeTrue)
+				count, err := window.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 4)
+			})
+
+			Convey("And drop out once fully decayed", func() {
+				clock.AddTime(time.Minute)
+				count, err := window.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+				So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true})
+			})
+		})
+
+		Convey("Weighted actions take up more room", func() {
+			passed, err := window.PassWeight("foo", 2.5)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(pass(), ShouldBeFalse)
+
+			passed, err = window.PassWeight("foo", 4)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+
+			_, err = window.PassWeight("foo", 0)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+}
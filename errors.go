@@ -0,0 +1,122 @@
+package flowstopper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// HTTPError is implemented by errors which carry the HTTP status code and
+// headers they should be rendered with, so that a central error handler in a
+// middleware chain can detect and render them.
+type HTTPError interface {
+	error
+	StatusCode() int
+	Headers() http.Header
+}
+
+// RateLimitError is returned by CheckOrError when an item exceeds its rate
+// limit.
+type RateLimitError struct {
+	// The item which was rate-limited, or its hash if the Stopper redacts
+	// items.
+	Item string
+
+	// The maximum amount of actions allowed during the interval.
+	Limit int64
+
+	// How long the caller should wait before trying again.
+	RetryAfter time.Duration
+}
+
+var _ HTTPError = (*RateLimitError)(nil)
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("flowstopper: rate limit exceeded for %q", e.Item)
+}
+
+// StatusCode returns http.StatusTooManyRequests.
+func (e *RateLimitError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// Headers returns the Retry-After and X-RateLimit-Limit headers describing
+// the rate limit. Retry-After is left out without a RetryAfter, such as for
+// rejections by a closed gate, which retrying never gets past.
+func (e *RateLimitError) Headers() http.Header {
+	h := make(http.Header)
+	if e.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(e.RetryAfter.Seconds())), 10))
+	}
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(e.Limit, 10))
+	return h
+}
+
+// WrongTypeError is returned when the key of a window holds a value other
+// than a sorted set, most likely because other data in redis collides with
+// the Namespace.
+type WrongTypeError struct {
+	// The key holding the value, with the item hashed if the Stopper
+	// redacts items.
+	Key string
+
+	// The error redis replied with.
+	Err error
+}
+
+func (e *WrongTypeError) Error() string {
+	return fmt.Sprintf("flowstopper: key %q holds a value other than a sorted set, colliding with other data: %v", e.Key, e.Err)
+}
+
+func (e *WrongTypeError) Unwrap() error {
+	return e.Err
+}
+
+// ClockRewindError is returned by a Stopper whose ClockRewind is
+// RewindReject for an action attempted before the newest one in the window,
+// because the clock went back.
+type ClockRewindError struct {
+	// The time the action was attempted at.
+	At time.Time
+
+	// The time of the newest action in the window.
+	Newest time.Time
+}
+
+func (e *ClockRewindError) Error() string {
+	return fmt.Sprintf("flowstopper: clock went back to %s, %s before the newest action", e.At.Format(time.RFC3339Nano), e.Newest.Sub(e.At))
+}
+
+// rewindError returns the ClockRewindError passScript replied with as reply
+// or err, if any.
+func rewindError(reply interface{}, err error) error {
+	if err == nil {
+		err, _ = reply.(error)
+	}
+	if err == nil {
+		return nil
+	}
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return nil
+	}
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || fields[0] != "CLOCKREWIND" {
+		return nil
+	}
+	at, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	newest, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &ClockRewindError{At: time.Unix(0, at).UTC(), Newest: time.Unix(0, newest).UTC()}
+}
@@ -0,0 +1,314 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckOrError(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		multi := conn.Command("MULTI")
+		exec := expectPass(conn, stopper, "foo")
+
+		Convey("When the action passes", func() {
+			exec.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			err := stopper.CheckOrError(context.Background(), "foo")
+
+			Convey("No error should be returned", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the rate is exceeded", func() {
+			start := now.Add(-stopper.Interval).UnixNano()
+			full := []byte(strconv.FormatInt(start+int64(3*time.Second), 10))
+			exec.Expect([]interface{}{int64(0), int64(8), int64(0), nil, full, start, now.UnixNano(), []byte("m"), int64(0), int64(0), int64(7)})
+			err := stopper.CheckOrError(context.Background(), "foo")
+
+			Convey("A RateLimitError should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &RateLimitError{})
+			})
+
+			Convey("It should carry a 429 status and rate-limit headers", func() {
+				herr, ok := err.(HTTPError)
+				So(ok, ShouldBeTrue)
+				So(herr.StatusCode(), ShouldEqual, http.StatusTooManyRequests)
+				So(herr.Headers().Get("Retry-After"), ShouldEqual, "3")
+			})
+
+			Convey("It should tell the limit the action was checked against", func() {
+				So(err.(*RateLimitError).Limit, ShouldEqual, 7)
+				So(err.(*RateLimitError).RetryAfter, ShouldEqual, 3*time.Second)
+			})
+		})
+
+		Convey("When the context is already cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := stopper.CheckOrError(ctx, "foo")
+
+			Convey("The context error should be returned without talking to redis", func() {
+				So(err, ShouldEqual, context.Canceled)
+				So(conn.Stats(multi), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestRedactItems(t *testing.T) {
+	Convey("Given a stopper whose redis returns an error", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		failure := errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		conn.GenericCommand("ZREMRANGEBYSCORE").Expect(int64(0))
+		conn.Command("ZCARD", "fakestopper:alice@example.com").ExpectError(failure)
+
+		Convey("By default the item is included in the error", func() {
+			_, err := stopper.Peek("alice@example.com")
+			So(errors.Is(err, failure), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "alice@example.com")
+		})
+
+		Convey("When items are redacted", func() {
+			stopper.RedactItems = true
+			_, err := stopper.Peek("alice@example.com")
+
+			Convey("The item is absent from the error", func() {
+				So(errors.Is(err, failure), ShouldBeTrue)
+				So(err.Error(), ShouldNotContainSubstring, "alice@example.com")
+				So(err.Error(), ShouldContainSubstring, "sha256:")
+			})
+		})
+	})
+
+	Convey("Given a stopper which redacts items", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		stopper.RedactItems = true
+		exec := expectPass(conn, stopper, "alice@example.com")
+		exec.Expect([]interface{}{int64(0), int64(6), int64(0), nil, nil, nil, nil, nil})
+
+		Convey("Rate limit errors omit the item", func() {
+			err := stopper.CheckOrError(context.Background(), "alice@example.com")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "alice@example.com")
+		})
+	})
+
+	Convey("Given limiters of other accuracies which redact items", t, func() {
+		conn := redigomock.NewConn()
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		}
+		failure := errors.New("connection reset by peer")
+		conn.GenericCommand("GET").ExpectError(failure)
+		conn.GenericCommand("MGET").ExpectError(failure)
+		redact := func(s *Stopper) { s.RedactItems = true }
+
+		for _, accuracy := range []Accuracy{Balanced, Fast} {
+			l, err := NewLimiter(pool, "redacted", time.Minute, 5, accuracy, WithClock(clock.NewMockClock(now)), redact)
+			So(err, ShouldBeNil)
+			_, err = l.(interface{ Peek(string) (int64, error) }).Peek("alice@example.com")
+			So(errors.Is(err, failure), ShouldBeTrue)
+			So(err.Error(), ShouldNotContainSubstring, "alice@example.com")
+			So(err.Error(), ShouldContainSubstring, "sha256:")
+		}
+	})
+}
+
+func TestWrongType(t *testing.T) {
+	Convey("Given a stopper whose key holds a string", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		failure := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+		conn.GenericCommand("ZREMRANGEBYSCORE").ExpectError(failure)
+
+		Convey("Peek names the colliding key", func() {
+			_, err := stopper.Peek("foo")
+			var terr *WrongTypeError
+			So(errors.As(err, &terr), ShouldBeTrue)
+			So(terr.Key, ShouldEqual, "fakestopper:foo")
+			So(errors.Is(err, failure), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, `key "fakestopper:foo" holds a value other than a sorted set`)
+		})
+
+		Convey("Unless items are redacted", func() {
+			stopper.RedactItems = true
+			_, err := stopper.Peek("foo")
+			var terr *WrongTypeError
+			So(errors.As(err, &terr), ShouldBeTrue)
+			So(terr.Key, ShouldStartWith, "fakestopper:sha256:")
+		})
+	})
+}
+
+func TestTypedErrors(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		exec := expectPass(conn, stopper, "foo")
+
+		Convey("When no connection can be made", func() {
+			stopper.ConnPool = &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return nil, errors.New("connection refused")
+				},
+			}
+
+			Convey("The error wraps ErrConnUnavailable", func() {
+				_, err := stopper.Pass("foo")
+				So(errors.Is(err, ErrConnUnavailable), ShouldBeTrue)
+				_, err = stopper.Peek("foo")
+				So(errors.Is(err, ErrConnUnavailable), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the connection fails mid-command", func() {
+			failure := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+			exec.ExpectError(failure)
+			_, err := stopper.Pass("foo")
+
+			Convey("The error wraps ErrConnUnavailable and the cause", func() {
+				So(errors.Is(err, ErrConnUnavailable), ShouldBeTrue)
+				So(errors.Is(err, failure), ShouldBeTrue)
+				So(errors.Is(err, ErrScriptFailed), ShouldBeFalse)
+			})
+		})
+
+		Convey("When redis fails to evaluate the script", func() {
+			failure := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+			exec.ExpectError(failure)
+			_, err := stopper.Pass("foo")
+
+			Convey("The error wraps ErrScriptFailed and the cause", func() {
+				So(errors.Is(err, ErrScriptFailed), ShouldBeTrue)
+				So(errors.Is(err, failure), ShouldBeTrue)
+				So(errors.Is(err, ErrConnUnavailable), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the configuration is invalid", func() {
+			_, err := NewStopper(nil, "foo", time.Second, 1)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+}
+
+func TestRetries(t *testing.T) {
+	Convey("Given a stopper retrying transient failures", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		stopper.MaxRetries = 2
+		stopper.RetryBackoff = 100 * time.Millisecond
+		clock := stopper.c.(*clock.MockClock)
+		eval := conn.GenericCommand("EVALSHA")
+		pass := func() (bool, error) {
+			type result struct {
+				passed bool
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				passed, err := stopper.Pass("foo")
+				done <- result{passed, err}
+			}()
+			for {
+				select {
+				case r := <-done:
+					return r.passed, r.err
+				case <-time.After(time.Millisecond):
+					clock.AddTime(100 * time.Millisecond)
+				}
+			}
+		}
+
+		Convey("Transient failures are retried until they pass", func() {
+			eval.ExpectError(redis.Error("LOADING Redis is loading the dataset in memory")).
+				ExpectError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}).
+				Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			passed, err := pass()
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(conn.Stats(eval), ShouldEqual, 3)
+		})
+
+		Convey("Retries give up after MaxRetries", func() {
+			failure := redis.Error("LOADING Redis is loading the dataset in memory")
+			eval.ExpectError(failure)
+			_, err := pass()
+			So(errors.Is(err, failure), ShouldBeTrue)
+			So(errors.Is(err, ErrScriptFailed), ShouldBeFalse)
+			So(conn.Stats(eval), ShouldEqual, 3)
+		})
+
+		Convey("Script errors are not retried", func() {
+			eval.ExpectError(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+			_, err := pass()
+			So(errors.Is(err, ErrScriptFailed), ShouldBeTrue)
+			So(conn.Stats(eval), ShouldEqual, 1)
+		})
+
+		Convey("Retries stop once the context is done", func() {
+			eval.ExpectError(redis.Error("LOADING Redis is loading the dataset in memory"))
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				for conn.Stats(eval) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				cancel()
+			}()
+			_, err := stopper.PassContext(ctx, "foo")
+			So(err, ShouldEqual, context.Canceled)
+		})
+	})
+}
+
+func TestReadTimeout(t *testing.T) {
+	Convey("Given a stopper on a redis which never replies", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer func() { _ = l.Close() }()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer func() { _ = c.Close() }()
+			}
+		}()
+		stopper, err := DialStopper(l.Addr().String(), "hung", 5*time.Second, 5)
+		So(err, ShouldBeNil)
+		defer func() { _ = stopper.Close(context.Background()) }()
+		stopper.ReadTimeout = 20 * time.Millisecond
+
+		Convey("Pass gives up after the ReadTimeout with a transient error", func() {
+			start := time.Now()
+			_, err := stopper.Pass("foo")
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(errors.Is(err, ErrConnUnavailable), ShouldBeTrue)
+			So(isTransient(err), ShouldBeTrue)
+
+			Convey("And FailOpen lets the action through", func() {
+				stopper.FailOpen = true
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,47 @@
+package flowstopper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Factory creates Stoppers sharing a connection pool, and keeps track of them
+// to report aggregate Stats.
+type Factory struct {
+	// The pool the created Stoppers take redis connections from.
+	ConnPool *redis.Pool
+
+	mu       sync.Mutex
+	stoppers []*Stopper
+}
+
+// New returns a Stopper for namespace using the Factory's pool, validated
+// like NewStopper.
+func (f *Factory) New(namespace string, interval time.Duration, limit int64) (*Stopper, error) {
+	s, err := NewStopper(f.ConnPool, namespace, interval, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stoppers = append(f.stoppers, s)
+	return s, nil
+}
+
+// AggregateStats returns the sum of the Stats of every Stopper created by
+// the Factory.
+func (f *Factory) AggregateStats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var total Stats
+	for _, s := range f.stoppers {
+		stats := s.Stats()
+		total.Allowed += stats.Allowed
+		total.Blocked += stats.Blocked
+	}
+	return total
+}
@@ -0,0 +1,45 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFactory(t *testing.T) {
+	Convey("Given a factory", t, func() {
+		flushRealRedis(t)
+		factory := Factory{ConnPool: &connPool}
+
+		Convey("Namespaces are validated", func() {
+			_, err := factory.New("app:v2", 5*time.Second, 3)
+			So(err, ShouldEqual, ErrInvalidNamespace)
+		})
+
+		Convey("When several stoppers see traffic", func() {
+			login, err := factory.New("login", 5*time.Second, 2)
+			So(err, ShouldBeNil)
+			api, err := factory.New("api", 5*time.Second, 3)
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 4; i++ {
+				if _, err := login.Pass("foo"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := api.Pass("foo"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			Convey("Each stopper counts its own decisions", func() {
+				So(login.Stats(), ShouldResemble, Stats{Allowed: 2, Blocked: 2})
+				So(api.Stats(), ShouldResemble, Stats{Allowed: 3, Blocked: 1})
+			})
+
+			Convey("The aggregate stats sum them", func() {
+				So(factory.AggregateStats(), ShouldResemble, Stats{Allowed: 5, Blocked: 3})
+			})
+		})
+	})
+}
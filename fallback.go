@@ -0,0 +1,22 @@
+package flowstopper
+
+// defaultFallbackItems is the LocalFallbackItems of a Stopper leaving it
+// unset.
+const defaultFallbackItems = 10000
+
+// fallbackPass decides on an action for item by the LocalFallback.
+func (s *Stopper) fallbackPass(item string) PassResult {
+	s.fallbackOnce.Do(func() {
+		maxItems := s.LocalFallbackItems
+		if maxItems <= 0 {
+			maxItems = defaultFallbackItems
+		}
+		s.fallback = &MemoryLimiter{Interval: s.Interval, Limit: s.Limit, MaxItems: maxItems, c: s.c}
+	})
+	allowed, _ := s.fallback.Pass(item)
+	count, _ := s.fallback.Peek(item)
+	if !allowed {
+		count++
+	}
+	return PassResult{Allowed: allowed, Limit: s.Limit, Count: count, Remaining: remaining(s.Limit, count)}
+}
@@ -0,0 +1,74 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocalFallback(t *testing.T) {
+	Convey("Given a stopper falling back to local limits", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		stopper.Limit = 2
+		stopper.LocalFallback = true
+		stopper.FailOpen = true
+		var failures []error
+		stopper.OnError = func(item string, err error) {
+			failures = append(failures, err)
+		}
+		eval := conn.GenericCommand("EVALSHA")
+		pass := func(item string) bool {
+			passed, err := stopper.Pass(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("When redis fails", func() {
+			eval.ExpectError(errors.New("connection reset"))
+
+			Convey("Actions are limited in memory rather than let through", func() {
+				So([]bool{pass("foo"), pass("foo"), pass("foo")}, ShouldResemble, []bool{true, true, false})
+				So(pass("bar"), ShouldBeTrue)
+				So(failures, ShouldHaveLength, 4)
+
+				Convey("And the local windows slide like redis' would", func() {
+					stopper.c.(*clock.MockClock).AddTime(stopper.Interval)
+					So(pass("foo"), ShouldBeTrue)
+				})
+			})
+
+			Convey("Errors of the caller are still returned", func() {
+				_, err := stopper.Pass("")
+				So(err, ShouldEqual, ErrEmptyItem)
+			})
+		})
+
+		Convey("While redis works the local limits are left alone", func() {
+			eval.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			for i := 0; i < 3; i++ {
+				So(pass("foo"), ShouldBeTrue)
+			}
+			So(stopper.fallback, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a memory limiter bounded in items", t, func() {
+		limiter := &MemoryLimiter{Interval: time.Minute, Limit: 1, MaxItems: 2, c: clock.NewMockClock(now)}
+		for _, item := range []string{"foo", "bar", "baz"} {
+			passed, _ := limiter.Pass(item)
+			So(passed, ShouldBeTrue)
+		}
+
+		Convey("Windows are forgotten to make room for new items", func() {
+			So(limiter.windows, ShouldHaveLength, 2)
+			So(limiter.windows, ShouldContainKey, "baz")
+		})
+	})
+}
@@ -0,0 +1,186 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// FixedWindow is a rate limiter counting the actions for each item in fixed
+// windows of Interval, starting at multiples of Interval since the Unix
+// epoch. Each window takes a single counter in redis, which makes it the
+// cheapest limiter for coarse limits.
+//
+// The windows are aligned to the wall clock rather than to the first action
+// of an item, so that every item's windows reset at the same, predictable
+// times, such as for rate-limit headers. With an Interval dividing a day,
+// such as a minute or an hour, they start on the boundaries of UTC: each
+// minute at :00 and each hour on the hour. Without a Location they are
+// independent of time zones, so daylight saving time never shifts them, but
+// neither do they follow local time: daily windows start at midnight UTC,
+// and hourly ones on the half hour in zones offset by a half hour. Intervals
+// not dividing a day, such as 7 minutes, start at multiples since the epoch,
+// and so at other times of day from one day to the next.
+//
+// With a Location, the windows follow its wall clock instead, so that daily
+// ones start at local midnight. As the clock is turned forward, the window
+// it is in ends early, and as it is turned back, the window of the repeated
+// time spans both, although its count expires in between should the
+// Interval pass without an action. Sliding windows, such as a Stopper's,
+// have no boundaries to align, and remain independent of time zones.
+//
+// The price is precision at the window edges: as the count starts afresh
+// with every window, up to twice the Limit may pass in quick succession
+// around the start of a window, when the end of the previous one saw Limit
+// actions as well.
+type FixedWindow struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain the
+	// Separator.
+	Namespace string
+
+	// The separator placed between the Namespace, the item and the start of
+	// the window in keys, ":" by default.
+	Separator string
+
+	// The length of the windows.
+	Interval time.Duration
+
+	// The maximum amount of actions allowed during a window.
+	Limit int64
+
+	// When set, the location whose wall clock the windows are aligned to,
+	// such as for "1000 per calendar day in America/New_York". When nil,
+	// they are aligned to UTC.
+	Location *time.Location
+
+	// When set, items are replaced by a hash of themselves in errors, like
+	// with the RedactItems of a Stopper.
+	RedactItems bool
+
+	c clock.Clock
+}
+
+// NewFixedWindow returns a FixedWindow allowing limit actions per item in
+// each window of interval, keeping its counters under namespace in redis.
+// It is validated like NewStopper, and of opts, those setting the pool, the
+// clock, the Separator and RedactItems apply to it.
+func NewFixedWindow(pool *redis.Pool, namespace string, interval time.Duration, limit int64, opts ...Option) (*FixedWindow, error) {
+	s, err := NewStopper(pool, namespace, interval, limit, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &FixedWindow{ConnPool: s.ConnPool, Pool: s.Pool, Namespace: namespace, Separator: s.Separator, Interval: interval, Limit: limit, RedactItems: s.RedactItems, c: s.c}, nil
+}
+
+// Pass sends an item through the FixedWindow, returning false should the
+// rate-limit for this item be exceeded in the current window. Rejected
+// actions are counted as well. It fails with ErrInvalidConfig should the
+// Interval or the Limit not be positive.
+func (w *FixedWindow) Pass(item string) (bool, error) {
+	base, key, err := w.key(item)
+	if err != nil {
+		return false, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), base)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	var tx transaction
+	tx.add("INCR", key)
+	tx.add("PEXPIRE", key, durationMillis(w.Interval))
+	values, err := tx.execAll(c)
+	if err != nil {
+		return false, fmt.Errorf("flowstopper: %q: %w", redactItem(item, w.RedactItems), err)
+	}
+	var count, expire int64
+	if _, err := redis.Scan(values, &count, &expire); err != nil {
+		return false, fmt.Errorf("flowstopper: %q: %w", redactItem(item, w.RedactItems), err)
+	}
+	return count <= w.Limit, nil
+}
+
+// Peek returns the number of actions counted for item in the current window,
+// rejected ones included, without counting one.
+func (w *FixedWindow) Peek(item string) (int64, error) {
+	base, key, err := w.key(item)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := getConn(context.Background(), poolOf(w.Pool, w.ConnPool), base)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	count, err := redis.Int64(c.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		return 0, fmt.Errorf("flowstopper: %q: %w", redactItem(item, w.RedactItems), err)
+	}
+	return count, nil
+}
+
+// key returns the key under which the windows of item are kept, and that of
+// the counter of the current window.
+func (w *FixedWindow) key(item string) (string, string, error) {
+	if err := checkWindow(w.Interval, w.Limit); err != nil {
+		return "", "", err
+	}
+	base, err := joinKey(w.Namespace, w.Separator, item)
+	if err != nil {
+		return "", "", err
+	}
+	start, _ := windowStart(w.now(), w.Interval, w.Location)
+	return base, base + separatorOr(w.Separator) + strconv.FormatInt(start, 10), nil
+}
+
+// windowStart returns the start of the fixed window of interval in which now
+// falls, along with the time elapsed since, on the wall clock of loc, or of
+// UTC when loc is nil. The start is told in nanoseconds since the epoch of
+// that wall clock rather than as an instant, so that a window keeps its
+// start as the clock is turned forward or back in the middle of it.
+func windowStart(now time.Time, interval time.Duration, loc *time.Location) (start, elapsed int64) {
+	wall := now.UnixNano()
+	if loc != nil {
+		_, offset := now.In(loc).Zone()
+		wall += int64(offset) * int64(time.Second)
+	}
+	elapsed = wall % int64(interval)
+	if elapsed < 0 {
+		elapsed += int64(interval)
+	}
+	return wall - elapsed, elapsed
+}
+
+func (w *FixedWindow) now() time.Time {
+	if w.c == nil {
+		return Now()
+	}
+	return w.c.Now()
+}
+
+// checkWindow rejects an interval or a limit which is not positive, as the
+// window limiters cannot count actions in them.
+func checkWindow(interval time.Duration, limit int64) error {
+	switch {
+	case interval <= 0:
+		return fmt.Errorf("%w: interval %s is not positive", ErrInvalidConfig, interval)
+	case limit <= 0:
+		return fmt.Errorf("%w: limit %d is not positive", ErrInvalidConfig, limit)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFixedWindow(t *testing.T) {
+	Convey("Given a fixed window limiter", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		window := &FixedWindow{
+			Namespace: "fixedwindow",
+			Interval:  time.Minute,
+			Limit:     3,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := window.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Actions up to the limit pass within a window", func() {
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+
+			Convey("And the count starts afresh with the next one", func() {
+				clock.AddTime(time.Minute)
+				So(pass(), ShouldBeTrue)
+			})
+		})
+
+		Convey("Windows start on the minute rather than with the first action", func() {
+			clock.AddTime(30 * time.Second)
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+			clock.AddTime(30 * time.Second)
+			So(pass(), ShouldBeTrue)
+		})
+
+		Convey("The count of the current window can be peeked at", func() {
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+			count, err := window.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 4)
+			clock.AddTime(time.Minute)
+			count, err = window.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("Up to twice the limit passes around a window's start", func() {
+			// now falls on the start of a minute.
+			clock.AddTime(time.Minute - time.Millisecond)
+			So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true})
+			clock.AddTime(time.Millisecond)
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+		})
+	})
+}
+
+func TestFixedWindowLocation(t *testing.T) {
+	Convey("Given a daily window in New York", t, func() {
+		flushRealRedis(t)
+		newYork, err := time.LoadLocation("America/New_York")
+		So(err, ShouldBeNil)
+		// Half an hour before midnight in New York, but early morning in UTC.
+		clock := clock.NewMockClock(time.Date(2009, 11, 10, 23, 30, 0, 0, newYork))
+		window := &FixedWindow{
+			Namespace: "fixedwindow",
+			Interval:  24 * time.Hour,
+			Limit:     2,
+			Location:  newYork,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := window.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("The count starts afresh at local midnight", func() {
+			So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, false})
+			clock.AddTime(time.Hour)
+			So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, false})
+
+			Convey("And not at midnight UTC", func() {
+				clock.AddTime(22 * time.Hour)
+				So(pass(), ShouldBeFalse)
+			})
+		})
+
+		Convey("A day keeps its window as the clocks are turned forward", func() {
+			clock.SetTime(time.Date(2010, 3, 14, 1, 30, 0, 0, newYork))
+			So([]bool{pass(), pass()}, ShouldResemble, []bool{true, true})
+			clock.AddTime(time.Hour)
+			So(clock.Now().In(newYork).Hour(), ShouldEqual, 3)
+			So(pass(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestWindowConfig(t *testing.T) {
+	Convey("Given the window limiters", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		fixed, err := NewFixedWindow(&connPool, "windows", time.Minute, 1, WithClock(clock), func(s *Stopper) { s.Separator = "/" })
+		So(err, ShouldBeNil)
+		approx, err := NewApproxWindow(&connPool, "windows", time.Minute, 1, WithClock(clock))
+		So(err, ShouldBeNil)
+		bucket, err := NewBucketWindow(&connPool, "windows", time.Minute, 1, WithClock(clock))
+		So(err, ShouldBeNil)
+		limiters := []Limiter{fixed, approx, bucket}
+
+		Convey("They are validated like a Stopper on construction", func() {
+			_, err := NewFixedWindow(&connPool, "windows", 0, 1)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			_, err = NewApproxWindow(&connPool, "windows", time.Minute, 0)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			_, err = NewBucketWindow(&connPool, "win:dows", time.Minute, 1)
+			So(err, ShouldEqual, ErrInvalidNamespace)
+		})
+
+		Convey("They tell time by the clock they are given", func() {
+			for _, l := range limiters {
+				passed, err := l.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+				passed, err = l.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeFalse)
+			}
+			clock.AddTime(2 * time.Minute)
+			for _, l := range limiters {
+				passed, err := l.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+		})
+
+		Convey("Keys are joined by the Separator", func() {
+			_, err := fixed.Pass("foo")
+			So(err, ShouldBeNil)
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			keys, err := redis.Strings(conn.Do("KEYS", "windows/foo/*"))
+			So(err, ShouldBeNil)
+			So(keys, ShouldHaveLength, 1)
+		})
+
+		Convey("Empty items are rejected", func() {
+			for _, l := range limiters {
+				_, err := l.Pass("")
+				So(err, ShouldEqual, ErrEmptyItem)
+			}
+		})
+
+		Convey("An Interval or Limit which is not positive fails rather than panics", func() {
+			fixed.Interval, approx.Interval, bucket.Interval = 0, 0, 0
+			for _, l := range limiters {
+				_, err := l.Pass("foo")
+				So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			}
+			fixed.Interval, approx.Interval = time.Minute, time.Minute
+			fixed.Limit, approx.Limit = 0, -1
+			for _, l := range limiters[:2] {
+				_, err := l.Pass("foo")
+				So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			}
+		})
+
+		Convey("Intervals too short for the default buckets still count", func() {
+			bucket.Interval = 5 * time.Nanosecond
+			passed, err := bucket.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		})
+	})
+}
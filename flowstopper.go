@@ -1,80 +1,2056 @@
 package flowstopper
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/WatchBeam/clock"
 	"github.com/garyburd/redigo/redis"
 )
 
-// Stopper is an instance of a rate limiter.
+// defaultSeparator is placed between the Namespace and the item to form
+// redis keys, unless a Stopper's Separator says otherwise.
+const defaultSeparator = ":"
+
+// defaultFreeAllowanceTTL is the FreeAllowanceTTL of a Stopper not setting
+// one.
+const defaultFreeAllowanceTTL = 24 * time.Hour
+
+// ErrClosed is returned by operations on a Stopper which has been closed.
+var ErrClosed = errors.New("flowstopper: stopper closed")
+
+// ErrInvalidNamespace is returned when the Namespace contains the separator,
+// which would allow keys from different namespaces to collide (namespace
+// "app:v2" with item "x" and namespace "app" with item "v2:x" would otherwise
+// share the key "app:v2:x").
+var ErrInvalidNamespace = errors.New("flowstopper: namespace must not contain the separator")
+
+// ErrEmptyItem is returned when asked to act on the empty item, which is
+// most likely the result of an unset variable, and would otherwise lump the
+// actions of everyone it stands for into a single window.
+var ErrEmptyItem = errors.New("flowstopper: empty item")
+
+// ErrInvalidConfig is returned by NewStopper when asked for a Stopper which
+// could not work. The errors returned wrap it with the reason.
+var ErrInvalidConfig = errors.New("flowstopper: invalid configuration")
+
+// ErrConnUnavailable is wrapped by the errors returned when redis could not
+// be reached, because no connection could be taken from the pool or the
+// connection failed during a command. These are the errors a caller may
+// want to fail open on.
+var ErrConnUnavailable = errors.New("flowstopper: redis unavailable")
+
+// ErrScriptFailed is wrapped by the errors returned when redis reported an
+// error evaluating one of the Lua scripts, for example because a key holds
+// a value of the wrong type.
+var ErrScriptFailed = errors.New("flowstopper: script failed")
+
+// Stopper is an instance of a rate limiter. It is best created with
+// NewStopper, which validates its configuration; a Stopper assembled by hand
+// only fails once it is used.
 type Stopper struct {
-	// The pool to take redis connections from.
+	// Decision counters, kept first so they are aligned for atomic access.
+	stats counters
+
+	// The redigo pool to take redis connections from, unless Pool is set.
 	ConnPool *redis.Pool
 
-	// The key prefix to use for the name in redis.
+	// The pool to take redis connections from when using a client other
+	// than redigo, or a single connection through SingleConn. When set,
+	// ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain the
+	// Separator.
 	Namespace string
 
+	// The separator placed between the Namespace and the item in keys, ":"
+	// by default. It must not contain a backslash, which escapes it within
+	// the parts of PassKey.
+	Separator string
+
 	// The duration for which actions are tracked.
+	//
+	// Changing the Interval of a Stopper whose windows hold actions, such as
+	// from one deployment to the next, reinterprets them: actions already
+	// trimmed under a shorter Interval are missing from a longer one until a
+	// whole longer Interval has passed, letting more actions through in the
+	// meantime. With IntervalKeys, the new Interval starts from empty
+	// windows under keys of its own, while the old ones expire on their own
+	// after the old Interval. The same happens once when IntervalKeys is
+	// turned on, which can be done together with changing the Interval.
 	Interval time.Duration
 
-	// The maximum amount of actions allowed during the Interval.
+	// The maximum amount of actions allowed during the Interval. Exactly
+	// Limit actions pass within any Interval, and the one after is the
+	// first rejected: the count an action is checked against includes the
+	// action itself, as rejected actions are not recorded.
+	//
+	// A Limit of zero or less closes the gate: Pass, like every other
+	// method deciding on actions, then rejects every action without asking
+	// redis, and without a RetryAfter, as no action could ever pass.
+	// NewStopper refuses such a limit, so it takes setting the field, such
+	// as to shut an item's Stopper down for maintenance.
 	Limit int64
 
+	// When set, Pass, like every other method deciding on actions, lets
+	// every action through without asking redis or recording it, whatever
+	// the Limit, such as to switch limiting off for a deployment without
+	// taking the Stopper out. Windows are left as they are.
+	Unlimited bool
+
+	// The maximum amount of actions allowed during the Interval across all
+	// items under the Namespace, as checked by PassGlobal.
+	GlobalLimit int64
+
+	// When positive, the most actions stored in the window of an item, the
+	// oldest being dropped beyond it, so that the memory taken by a single
+	// item stays bounded even while grace periods let it exceed the limit.
+	// It is raised to the limit of a check, so that it never changes the
+	// decisions for items staying within it.
+	MaxStored int64
+
+	// The most actions returned by Dump, the oldest ones, defaulting to
+	// 1000.
+	DumpLimit int64
+
+	// The number of actions which always pass for an item never seen before,
+	// without being recorded against its window. The count of free actions
+	// used is kept per item until it has been idle for the
+	// FreeAllowanceTTL, after which the item counts as never seen and has
+	// its allowance again. It is not restored by Reset or ResetWithGrace.
+	FreeAllowance int64
+
+	// How long an item is remembered to have used its FreeAllowance after
+	// its last action, on the clock of redis, defaulting to 24 hours.
+	FreeAllowanceTTL time.Duration
+
+	// When non-zero, actions beyond SoftLimit are rejected at random with a
+	// probability rising as the count approaches Limit, shedding load
+	// gradually rather than at a hard cutoff. See DropProbability.
+	SoftLimit int64
+
+	// The source of randomness for SoftLimit, returning values in [0.0,
+	// 1.0). It must be safe for concurrent use. Defaults to rand.Float64
+	// from math/rand, so decisions are not reproducible unless replaced.
+	Rand func() float64
+
+	// When set, items exceeding the limit repeatedly are locked out for
+	// escalating periods, during which Pass rejects them.
+	Penalty *Penalty
+
+	// How long the slot taken by Probe is held for a Commit, defaulting to
+	// 30 seconds.
+	ProbeTTL time.Duration
+
+	// When set, every action the limit rejects is announced on the redis
+	// channel "namespace:blocked" by the script deciding on it, so that
+	// other processes can react to items being limited without polling.
+	// See BlockedEvent for the messages.
+	PublishBlocked bool
+
+	// When set, called with every decision made for an item, along with the
+	// number of actions counted for it, before the decision is returned.
+	// It is not called when the decision could not be made.
+	OnDecision func(item string, allowed bool, count int64)
+
+	// Which decisions are reported to OnDecision, every one by default.
+	DecisionSampling DecisionSampling
+
+	// When set, called with the number of expired members removed from an
+	// item's window each time it is trimmed, so abnormal churn per key can
+	// be monitored.
+	OnTrim func(item string, trimmed int64)
+
+	// When set, called with the time the redis operations behind each
+	// decision of Pass and its variants, or each count of Peek and its
+	// variants, took, under op "pass" or "peek", such as to build a
+	// histogram of the overhead of the limiter. Decisions taken without
+	// asking redis are not reported, while failed attempts and retries are,
+	// each on its own. The time is measured on the monotonic clock,
+	// regardless of the clock of the Stopper and of Now.
+	OnLatency func(op string, d time.Duration)
+
+	// When set, Pass, PassN, TryPassN and PassBatch take the time from the
+	// redis server within the script deciding on an action, rather than from
+	// the local clock, so that app servers whose clocks drift apart still
+	// agree on the windows. The mock clock of tests is ignored then.
+	UseServerTime bool
+
+	// When set, the flag passed to the ZADD recording actions in Pass,
+	// PassN, TryPassN and PassBatch, for deployments opting into its
+	// semantics. It is unset by default, which works with every version of
+	// redis.
+	ZAddFlag ZAddFlag
+
+	// What Pass, PassN, TryPassN and PassBatch do when the clock went back
+	// since the newest action of an item's window was recorded, such as
+	// after an NTP correction. By default the action is recorded at the
+	// earlier time regardless, as PassAt relies on for backfilling.
+	ClockRewind RewindPolicy
+
+	// When set, builds the redis key for an item in place of the default
+	// "namespace:item", for example to follow an existing naming
+	// convention. It is called once per operation, and the other keys kept
+	// for the item are derived from its result. It must return distinct
+	// keys for distinct items. Namespace and HashTag are left to it.
+	KeyFunc func(namespace, item string) string
+
+	// When set, items are wrapped in a hash tag within keys, as in
+	// "namespace:{item}", so that on a Redis Cluster every key kept for an
+	// item maps to the same slot. Without it, the transactions and scripts
+	// touching several keys of an item fail with CROSSSLOT errors. Batches
+	// of several items, and PassGlobal, remain unsupported.
+	HashTag bool
+
+	// When set, the interval of the window is suffixed to every key kept
+	// for an item, as in "namespace:item@1m0s", so that windows of
+	// different lengths are never mixed under one key. PassWith then checks
+	// an item against an interval of its own in a window of its own, rather
+	// than in the shared window of the longest, and the other methods act
+	// on the window of the Interval. See Interval for changing it.
+	IntervalKeys bool
+
+	// When set, Pass and the other methods deciding on a single action let
+	// it through should redis fail, for example because it is unreachable,
+	// rather than returning the error, and so does Middleware with
+	// requests. Errors of the caller, such as a done context, a closed
+	// Stopper or an empty item, are returned regardless.
+	FailOpen bool
+
+	// When non-zero, how long to wait for the reply to each command to
+	// redis before giving up on it. Giving up fails the operation with an
+	// error wrapping ErrConnUnavailable, which MaxRetries and FailOpen
+	// apply to. It takes effect on redigo connections, and on any other
+	// whose client implements redis.ConnWithTimeout.
+	ReadTimeout time.Duration
+
+	// When non-zero, how long to wait for each command to be written to
+	// redis. Redigo only supports it when dialing, so it takes effect on
+	// the connections of DialStopper only; pools of the caller are best
+	// configured with redis.DialWriteTimeout instead.
+	WriteTimeout time.Duration
+
+	// When set, Pass and the other methods deciding on a single action
+	// decide by a MemoryLimiter of the Stopper's Interval and Limit should
+	// redis fail, rather than failing open or returning the error. While
+	// redis is unavailable, every process thus enforces the limit on its
+	// own, so the limit applies per process rather than globally, and each
+	// action counts as one regardless of its cost or the limit it is
+	// checked against. It takes precedence over FailOpen.
+	LocalFallback bool
+
+	// The most items the LocalFallback keeps windows for, as the
+	// MaxItems of its MemoryLimiter. Defaults to 10000.
+	LocalFallbackItems int
+
+	// When non-zero, the time clients are told to wait before trying again
+	// when an error of redis forces the rejection of their request, such as
+	// by Middleware unless FailOpen is set, so that they back off rather
+	// than hammer a struggling backend. When zero, no retry hint is given.
+	ErrorRetryAfter time.Duration
+
+	// When set, called with the errors FailOpen or LocalFallback decide
+	// actions despite, so that redis outages don't go unnoticed.
+	OnError func(item string, err error)
+
+	// The number of times Pass, PeekContext and the methods built on them
+	// retry after a transient failure, such as a dropped connection or redis
+	// still loading its dataset, before giving up. Errors of the scripts or
+	// the caller are never retried.
+	MaxRetries int
+
+	// How long to wait before the first retry, doubling with each further
+	// one.
+	RetryBackoff time.Duration
+
+	// When set, diagnostics are written to it: redis errors, retries, script
+	// reloads and the actions let through by FailOpen. Nothing is logged
+	// otherwise.
+	Logger Logger
+
+	// When set, Pass, PeekContext and the methods built on them open a span
+	// with it around their calls to redis.
+	Tracer Tracer
+
+	// When set, items are replaced by a hash of themselves in errors, so
+	// that items carrying personal data such as email or IP addresses don't
+	// end up in logs. Setting it by an Option of NewLimiter carries it over
+	// to the FixedWindow or ApproxWindow built, which have a RedactItems of
+	// their own, while the other limiters show items as given.
+	RedactItems bool
+
 	c clock.Clock
+
+	// The pool created by DialStopper, which Close closes.
+	ownedPool *redis.Pool
+
+	// The limiter of the LocalFallback, created on first use.
+	fallbackOnce sync.Once
+	fallback     *MemoryLimiter
+
+	// The number of calls to Wait blocked on each item, which WaitEstimate
+	// counts as ahead of its caller. It is guarded by mu.
+	waiting map[string]int
+
+	mu       sync.Mutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// Option configures a Stopper created by NewStopper.
+type Option func(*Stopper)
+
+// WithClock makes the Stopper tell time by c rather than the system clock,
+// so that tests can control the passing of time with clock.NewMockClock.
+func WithClock(c clock.Clock) Option {
+	return func(s *Stopper) {
+		s.c = c
+	}
+}
+
+// WithPool makes the Stopper take its connections from p rather than the
+// redigo pool passed to NewStopper, which may then be nil.
+func WithPool(p Pool) Option {
+	return func(s *Stopper) {
+		s.Pool = p
+	}
+}
+
+// WithConn makes the Stopper use the single redigo connection c, through
+// SingleConn, in place of a pool. Operations of the Stopper take turns on c,
+// so it may be shared by goroutines. Close leaves c open, and a broken c is
+// not replaced; see DialSingleConn for that.
+func WithConn(c redis.Conn) Option {
+	return WithPool(SingleConn(c))
+}
+
+// NewStopper returns a Stopper allowing limit actions per item during
+// interval, keeping its windows under namespace in redis, configured further
+// by opts. It fails with ErrInvalidConfig for a missing pool, an empty
+// namespace, a non-positive interval or limit or a Penalty out of range, and
+// with ErrInvalidNamespace for a namespace containing the Separator.
+func NewStopper(pool *redis.Pool, namespace string, interval time.Duration, limit int64, opts ...Option) (*Stopper, error) {
+	s := &Stopper{
+		ConnPool:  pool,
+		Namespace: namespace,
+		Interval:  interval,
+		Limit:     limit,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	switch {
+	case s.ConnPool == nil && s.Pool == nil:
+		return nil, fmt.Errorf("%w: no connection pool", ErrInvalidConfig)
+	case namespace == "":
+		return nil, fmt.Errorf("%w: empty namespace", ErrInvalidConfig)
+	case !s.ZAddFlag.valid():
+		return nil, fmt.Errorf("%w: unknown ZADD flag %q", ErrInvalidConfig, s.ZAddFlag)
+	case s.ClockRewind < RewindIgnore || s.ClockRewind > RewindReject:
+		return nil, fmt.Errorf("%w: unknown clock rewind policy %d", ErrInvalidConfig, s.ClockRewind)
+	case strings.Contains(s.Separator, `\`):
+		return nil, fmt.Errorf("%w: separator %q contains a backslash", ErrInvalidConfig, s.Separator)
+	case strings.Contains(namespace, s.separator()):
+		return nil, ErrInvalidNamespace
+	case interval <= 0:
+		return nil, fmt.Errorf("%w: interval %s is not positive", ErrInvalidConfig, interval)
+	case limit <= 0:
+		return nil, fmt.Errorf("%w: limit %d is not positive", ErrInvalidConfig, limit)
+	}
+	if s.Penalty != nil {
+		if err := s.Penalty.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// DialStopper returns a Stopper like NewStopper, but with a pool of its own
+// dialing the redis server at address, with the ReadTimeout and WriteTimeout
+// of the Stopper. Unlike a pool passed in by the caller, this one belongs to
+// the Stopper and is closed by Close.
+func DialStopper(address, namespace string, interval time.Duration, limit int64, opts ...Option) (*Stopper, error) {
+	var s *Stopper
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address, redis.DialReadTimeout(s.ReadTimeout), redis.DialWriteTimeout(s.WriteTimeout))
+		},
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+	}
+	s, err := NewStopper(pool, namespace, interval, limit, opts...)
+	if err != nil {
+		_ = pool.Close()
+		return nil, err
+	}
+	s.ownedPool = pool
+	return s, nil
+}
+
+// NewRateStopper returns a Stopper like NewStopper, but configured by a rate
+// of actions per second and a burst size like golang.org/x/time/rate, which
+// may be easier to express in configuration. The burst becomes the Limit
+// and the Interval the time the rate takes to make up for it, burst/rate
+// seconds, so that 50 actions per second with a burst of 100 allow 100
+// actions per 2 seconds.
+//
+// As the Stopper keeps a sliding log, the whole burst may pass at once, and
+// the slot of each action is only freed once it is an Interval old, rather
+// than tokens trickling back at the rate as with a TokenBucket, whose Rate
+// and Capacity map onto rate and burst directly. The long-term rate is the
+// same either way. It fails with ErrInvalidConfig for a rate which is not
+// positive and finite, or a burst which is not positive.
+func NewRateStopper(pool *redis.Pool, namespace string, rate float64, burst int64, opts ...Option) (*Stopper, error) {
+	if !(rate > 0) || math.IsInf(rate, 1) {
+		return nil, fmt.Errorf("%w: rate %v is not positive and finite", ErrInvalidConfig, rate)
+	}
+	if burst <= 0 {
+		return nil, fmt.Errorf("%w: burst %d is not positive", ErrInvalidConfig, burst)
+	}
+	return NewStopper(pool, namespace, rateInterval(rate, burst), burst, opts...)
+}
+
+// rateInterval returns the interval in which burst actions pass at rate
+// actions per second, at least a nanosecond.
+func rateInterval(rate float64, burst int64) time.Duration {
+	interval := time.Duration(math.Round(float64(burst) / rate * float64(time.Second)))
+	if interval < 1 {
+		return 1
+	}
+	return interval
+}
+
+// Stats holds the number of decisions made by a Stopper.
+type Stats struct {
+	// The number of actions which passed.
+	Allowed uint64
+
+	// The number of actions which were rejected.
+	Blocked uint64
+}
+
+// counters accumulates Stats atomically.
+type counters struct {
+	allowed uint64
+	blocked uint64
+}
+
+func (c *counters) record(allowed bool) {
+	if allowed {
+		atomic.AddUint64(&c.allowed, 1)
+	} else {
+		atomic.AddUint64(&c.blocked, 1)
+	}
+}
+
+// Stats returns the number of decisions made by the Stopper so far. Failed
+// calls are not counted.
+func (s *Stopper) Stats() Stats {
+	return Stats{
+		Allowed: atomic.LoadUint64(&s.stats.allowed),
+		Blocked: atomic.LoadUint64(&s.stats.blocked),
+	}
 }
 
 // Pass sends an item through the Stopper, returning false should the
-// rate-limit for this item be exceeded.
+// rate-limit for this item be exceeded. The window is trimmed, counted and,
+// unless the limit is exceeded, the action recorded by a single script
+// evaluated atomically in redis, so blocked attempts take up no room.
 func (s *Stopper) Pass(item string) (bool, error) {
-	var now time.Time
-	if s.c == nil {
-		now = time.Now().UTC()
+	return s.PassContext(context.Background(), item)
+}
+
+// PassKey sends the item made of several parts, such as a user, endpoint
+// and method, through the Stopper like Pass. The parts are joined with the
+// separator, escaped with a backslash within them, so that distinct lists of
+// parts never share an item: ["a:b", "c"] and ["a", "b:c"] are limited
+// independently. A single part free of separators and backslashes is the
+// same item as for Pass.
+func (s *Stopper) PassKey(parts ...string) (bool, error) {
+	return s.Pass(joinParts(s.separator(), parts))
+}
+
+// joinParts joins the parts of an item for PassKey with sep, escaping it and
+// the escape character itself within them.
+func joinParts(sep string, parts []string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, sep, `\`+sep)
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = escaper.Replace(p)
+	}
+	return strings.Join(escaped, sep)
+}
+
+// PassContext sends an item through the Stopper like Pass. It fails with
+// ctx's error once ctx is done before redis replied, though a command
+// already sent may still be carried out by redis.
+func (s *Stopper) PassContext(ctx context.Context, item string) (bool, error) {
+	r, err := s.pass(ctx, CheckRequest{Item: item}, nil)
+	return r.Allowed, err
+}
+
+// PassN sends an item accounting for n actions at once through the Stopper,
+// returning false should they exceed the rate-limit for this item. Either
+// all n actions are recorded or none are, so asking for more than Limit is
+// always rejected, even during a grace period, without writing to redis or
+// counting as the first rejection reported by JustBlocked. Recording n
+// actions adds a single member to the window standing for all of them, so
+// that a large n costs redis no more memory or writes than one action does.
+// Undo and Grant take them back one at a time. An n below one accounts for
+// a single action.
+func (s *Stopper) PassN(item string, n int64) (bool, error) {
+	r, err := s.pass(context.Background(), CheckRequest{Item: item, Cost: n}, nil)
+	return r.Allowed, err
+}
+
+// PassResult describes the decision for an action in detail.
+type PassResult struct {
+	// Whether the action passed.
+	Allowed bool
+
+	// The limit the action was checked against.
+	Limit int64
+
+	// Whether the action was the first rejected by the limit since actions
+	// for the item last passed, such as to log a single event when it gets
+	// throttled. The marker telling so is kept in redis and set by the same
+	// script deciding on the action, so that among concurrent callers only
+	// one sees it, on whichever instance it runs. It expires after an
+	// Interval of rejections, after which the next one reports it anew.
+	JustBlocked bool
+
+	// Whether the action was the first to pass since one for the item was
+	// rejected by the limit, told by the same marker as JustBlocked, so
+	// that passes after its expiry are not reported.
+	JustUnblocked bool
+
+	// The number of actions recorded during the current interval, counting
+	// the attempted ones whether recorded or not.
+	Count int64
+
+	// How many more actions the limit allows during the current interval,
+	// never less than zero.
+	Remaining int64
+
+	// How long until the window has room for another action, which is zero
+	// while it has room already.
+	RetryAfter time.Duration
+
+	// The time the action was recorded at in the window, by which Undo
+	// hands its slot back, or the zero time if it was not recorded.
+	At time.Time
+}
+
+// PassResult sends an item through the Stopper like Pass, returning the
+// decision along with the state of the window after it, all computed by the
+// same script.
+func (s *Stopper) PassResult(item string) (PassResult, error) {
+	return s.pass(context.Background(), CheckRequest{Item: item}, nil)
+}
+
+// PassAndRemaining sends an item through the Stopper like Pass, additionally
+// returning how many more actions the limit allows during the current
+// interval, as computed by the same script.
+func (s *Stopper) PassAndRemaining(item string) (bool, int64, error) {
+	r, err := s.pass(context.Background(), CheckRequest{Item: item}, nil)
+	return r.Allowed, r.Remaining, err
+}
+
+// PassAt sends an item through the Stopper like Pass, but as if at were the
+// current time, for example to replay a stream of historical events. The
+// window is trimmed relative to at and the action recorded at it, which
+// also takes precedence over UseServerTime. Windows are only correct if the
+// times given for an item never go backwards, as actions recorded at later
+// times count against earlier ones, while those trimmed for a later time are
+// missing for earlier ones.
+func (s *Stopper) PassAt(item string, at time.Time) (bool, error) {
+	r, err := s.pass(context.Background(), CheckRequest{Item: item, at: at}, nil)
+	return r.Allowed, err
+}
+
+// PassNS sends an item through the Stopper like Pass, but under namespace
+// rather than the Namespace for this call only, so that one Stopper can keep
+// apart limits which only differ by their prefix, such as "login" and "api".
+// The window is stored at the key Key would build with namespace, which is
+// validated the same way. Any other configuration is shared.
+func (s *Stopper) PassNS(namespace, item string) (bool, error) {
+	if namespace == "" {
+		return false, fmt.Errorf("%w: empty namespace", ErrInvalidConfig)
+	}
+	r, err := s.pass(context.Background(), CheckRequest{Item: item, namespace: namespace}, nil)
+	return r.Allowed, err
+}
+
+// PassWith sends an item through the Stopper like Pass, but checks it
+// against limit actions per interval for this call only, so that quotas can
+// be looked up per item at call time. A zero limit or interval falls back to
+// the Stopper's Limit or Interval. Items checked against different intervals
+// keep the window of the longest in redis, unless IntervalKeys keeps a
+// window per interval.
+func (s *Stopper) PassWith(item string, limit int64, interval time.Duration) (bool, error) {
+	r, err := s.pass(context.Background(), CheckRequest{Item: item, Limit: limit, Interval: interval}, nil)
+	return r.Allowed, err
+}
+
+// pass implements PassN and PassWith, returning the decision for the action
+// described by req in detail. Actions passed for free are not recorded, and
+// report a count of zero.
+//
+// When tr is non-nil, each stage evaluated along the way is recorded in it.
+func (s *Stopper) pass(ctx context.Context, req CheckRequest, tr *DecisionTrace) (PassResult, error) {
+	ctx, span := s.startSpan(ctx, "flowstopper.Pass", req.Item)
+	_, limit, _ := s.checkParams(req)
+	var r PassResult
+	err := s.retry(ctx, func() error {
+		var err error
+		r, err = s.decide(ctx, req, tr)
+		return err
+	})
+	if span != nil {
+		span.SetAllowed(r.Allowed)
+		span.End(err)
+	}
+	if err != nil {
+		if !s.degrades(ctx, err) {
+			s.logError(err)
+			return PassResult{}, err
+		}
+		if s.OnError != nil {
+			s.OnError(req.Item, err)
+		}
+		if s.LocalFallback {
+			s.logf("%v, falling back to local limits", err)
+			r := s.fallbackPass(req.Item)
+			s.decided(req.Item, r.Allowed, r.Count, true)
+			return r, nil
+		}
+		s.logf("%v, failing open", err)
+		return PassResult{Allowed: true, Limit: limit, Remaining: limit}, nil
+	}
+	s.decided(req.Item, r.Allowed, r.Count, r.JustBlocked || r.JustUnblocked)
+	if r.Limit == 0 {
+		r.Limit = limit
+	}
+	return r, nil
+}
+
+// useFree counts n actions against the FreeAllowance tracked at key,
+// returning the number used so far, and keeps the count for another
+// FreeAllowanceTTL.
+func (s *Stopper) useFree(c Conn, key string, n int64) (int64, error) {
+	ttl := s.FreeAllowanceTTL
+	if ttl <= 0 {
+		ttl = defaultFreeAllowanceTTL
+	}
+	var tx transaction
+	tx.add("INCRBY", key, n)
+	tx.add("PEXPIRE", key, durationMillis(ttl))
+	values, err := tx.execAll(c)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(values[0], nil)
+}
+
+// retry calls op until it succeeds, fails for good or MaxRetries retries
+// have been made, backing off between attempts on the Stopper's clock. It
+// returns op's last error, or ctx's once ctx is done while backing off.
+func (s *Stopper) retry(ctx context.Context, op func() error) error {
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= s.MaxRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		s.logf("%v, retrying in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.after(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// degrades reports whether err, returned while deciding on an action under
+// ctx, leaves the decision to FailOpen or LocalFallback.
+func (s *Stopper) degrades(ctx context.Context, err error) bool {
+	if !s.FailOpen && !s.LocalFallback || ctx.Err() != nil {
+		return false
+	}
+	var rerr *ClockRewindError
+	return !errors.Is(err, ErrClosed) && !errors.Is(err, ErrInvalidNamespace) && !errors.Is(err, ErrEmptyItem) && !errors.As(err, &rerr)
+}
+
+// decided records a decision in the Stats and reports it to OnDecision,
+// unless the DecisionSampling leaves it out. Whether the decision changed
+// from the item's previous one is told by changed.
+func (s *Stopper) decided(item string, allowed bool, count int64, changed bool) {
+	s.stats.record(allowed)
+	if s.OnDecision == nil || (s.DecisionSampling == TransitionsOnly && !changed) {
+		return
+	}
+	s.OnDecision(item, allowed, count)
+}
+
+// observe reports the time since start, taken by the redis operations of
+// op, to OnLatency.
+func (s *Stopper) observe(op string, start time.Time) {
+	if s.OnLatency != nil {
+		s.OnLatency(op, time.Since(start))
+	}
+}
+
+// decide makes the decision for pass.
+func (s *Stopper) decide(ctx context.Context, req CheckRequest, tr *DecisionTrace) (PassResult, error) {
+	item := req.Item
+	interval, limit, n := s.checkParams(req)
+	now, serverTime := req.at, false
+	if now.IsZero() {
+		now, serverTime = s.now(), s.UseServerTime
+	}
+	namespace := req.namespace
+	if namespace == "" {
+		namespace = s.Namespace
+	}
+	key, err := s.validKeyIn(namespace, item)
+	if err != nil {
+		return PassResult{}, err
+	}
+	limitKey := auxKey(key, "limit")
+	key = s.windowKey(key, interval)
+	switch {
+	case s.Unlimited:
+		tr.add(StageLimit, OutcomeAllowed, "unlimited")
+		return PassResult{Allowed: true, Limit: limit}, nil
+	case limit <= 0:
+		tr.add(StageLimit, OutcomeBlocked, "limit %d closes the gate", limit)
+		return PassResult{Limit: limit}, nil
+	}
+	defer s.observe("pass", time.Now())
+
+	c, err := s.connContext(ctx, key)
+	if err != nil {
+		return PassResult{}, err
+	}
+	defer func() { _ = c.Close() }()
+
+	if s.FreeAllowance > 0 {
+		used, err := s.useFree(c, auxKey(key, "free"), n)
+		if err != nil {
+			return PassResult{}, s.itemError(item, err)
+		}
+		if used <= s.FreeAllowance {
+			tr.add(StageFreeAllowance, OutcomeAllowed, "used %d of %d free actions", used, s.FreeAllowance)
+			return PassResult{Allowed: true, Remaining: remaining(limit, 0)}, nil
+		}
+		tr.add(StageFreeAllowance, OutcomeContinue, "all %d free actions used", s.FreeAllowance)
+	} else {
+		tr.add(StageFreeAllowance, OutcomeSkipped, "no free allowance")
+	}
+
+	if s.Penalty != nil {
+		until, err := s.lockedUntil(c, key, now)
+		if err != nil {
+			return PassResult{}, s.itemError(item, err)
+		}
+		if !until.IsZero() {
+			tr.add(StagePenalty, OutcomeBlocked, "locked out for another %s", until.Sub(now))
+			return PassResult{RetryAfter: until.Sub(now)}, nil
+		}
+		tr.add(StagePenalty, OutcomeContinue, "not locked out")
+	} else {
+		tr.add(StagePenalty, OutcomeSkipped, "no penalty")
+	}
+
+	args := append(recordArgs(key, limitKey, now, interval, n, 0, limit, serverTime), s.optionArgs(item, limit)...)
+	reply, err := scanRecord(passScript.run(c, args...))
+	if err != nil {
+		return PassResult{}, s.itemError(item, err)
+	}
+	s.trimmed(item, reply.trimmed)
+	if reply.limit > 0 {
+		limit = reply.limit
+	}
+	result := func(allowed bool) PassResult {
+		r := PassResult{
+			Allowed:       allowed,
+			Limit:         limit,
+			JustBlocked:   !allowed && reply.tripped,
+			JustUnblocked: allowed && reply.cleared,
+			Count:         reply.count,
+			Remaining:     remaining(limit, reply.count),
+			RetryAfter:    reply.retryAfter(),
+		}
+		if allowed {
+			r.At = time.Unix(0, reply.now).UTC()
+		}
+		return r
+	}
+
+	if reply.inGrace && n <= limit {
+		tr.add(StageGrace, OutcomeAllowed, "in grace period for another %s", time.Duration(reply.graceUntil-reply.now))
+		return result(true), nil
+	}
+	tr.add(StageGrace, OutcomeContinue, "not in a grace period")
+
+	if reply.count > limit {
+		tr.add(StageLimit, OutcomeBlocked, "%d actions exceed the limit of %d", reply.count, limit)
+		r := result(false)
+		if s.Penalty != nil {
+			until, err := s.offend(c, key, now)
+			if err != nil {
+				return PassResult{}, s.itemError(item, err)
+			}
+			if wait := until.Sub(now); wait > r.RetryAfter {
+				r.RetryAfter = wait
+			}
+		}
+		return r, nil
+	}
+	tr.add(StageLimit, OutcomeContinue, "%d actions within the limit of %d", reply.count, limit)
+
+	if p := s.dropProbability(reply.count, limit); p > 0 {
+		if s.random() < p {
+			// The script has recorded the actions already, so take them
+			// back to keep dropped actions from taking up room as well.
+			// Several actions are recorded as one member, which is among
+			// the weights as well.
+			var err error
+			if n > 1 {
+				m := reply.member + "*" + strconv.FormatInt(n, 10)
+				var tx transaction
+				tx.add("ZREM", key, m)
+				tx.add("ZREM", auxKey(key, "weights"), m)
+				_, err = tx.execAll(c)
+			} else {
+				_, err = c.Do("ZREM", key, reply.member)
+			}
+			if err != nil {
+				return PassResult{}, s.itemError(item, err)
+			}
+			tr.add(StageSoftLimit, OutcomeBlocked, "dropped with probability %.2f", p)
+			return result(false), nil
+		}
+		tr.add(StageSoftLimit, OutcomeAllowed, "kept despite drop probability %.2f", p)
 	} else {
-		now = s.c.Now().UTC()
+		tr.add(StageSoftLimit, OutcomeAllowed, "%d actions within the soft limit of %d", reply.count, s.SoftLimit)
+	}
+	return result(true), nil
+}
+
+// passScript trims the window stored at KEYS[1] of members scored at or before
+// ARGV[1] and records ARGV[4] actions scored ARGV[2] as member ARGV[3],
+// numbered ARGV[5] as by member unless that is zero. Several actions are
+// recorded as a single member standing for all of them, which is added to the
+// weights at KEYS[5] as by luaWeights, so that recording them costs no more
+// than recording one. They are only recorded if the window then holds no more
+// than ARGV[6] actions, or the grace period stored at KEYS[2] has not passed
+// yet and there are no more than ARGV[6] of them, so that rejected attempts
+// take up no room. Recording them sets the window to expire no sooner than
+// ARGV[7] milliseconds, the length of the interval, so that windows of items
+// which go idle don't linger in redis while those checked against several
+// intervals keep the longest. When ARGV[9] is 1, the times are instead derived
+// from the redis server's clock and the interval of ARGV[8] nanoseconds, and
+// ARGV[3] is appended to the member of the timestamp to keep actions of
+// different clients in the same microsecond apart. Either way, members already
+// taken are made unique as by luaUnique. When ARGV[10] is given, rejected
+// actions are published on that channel as the time they were attempted at
+// followed by a space and ARGV[11], unless it is empty. When ARGV[12] is
+// positive, recording actions drops the oldest members beyond that many, and a
+// non-empty ARGV[13] is passed to ZADD as a flag. When ARGV[14] is "clamp",
+// actions attempted before the newest one in the window are recorded at its
+// time instead, and when it is "reject", they fail with a CLOCKREWIND error
+// telling both times. The first rejection since actions were last recorded
+// sets the marker at KEYS[3], for up to ARGV[7] milliseconds, which recording
+// clears. A limit stored at KEYS[4] by SetLimit takes the place of ARGV[6].
+// Attempts of more than that many actions, which never fit, are rejected
+// without writing anything, neither trimming the window nor setting the
+// marker, so that the rejections of a huge ARGV[4] cost no more than those of
+// any other. When ARGV[15] is given, the actions are scored that many
+// nanoseconds after the start of the window rather than at the time they were
+// attempted at, so that they are trimmed once that long has passed, as for the
+// slots of ReserveWithTTL.
+//
+// It returns the number of members trimmed, including those dropped, the
+// number of actions in the window including the attempted ones whether
+// recorded or not, whether the item is in a grace period and until when,
+// and, once the window holds ARGV[6] actions or more, the score of the one
+// whose expiry makes room for another, followed by the start of the window,
+// the time the actions were attempted at, the member of the first, whether
+// the rejection set the marker, whether recording cleared it and the limit
+// the actions were checked against. Lua compares the times as doubles,
+// which may put the end of a grace period off by a fraction of a
+// microsecond.
+var passScript = newScript(5, luaUnique+luaWeights+`
+local start, now, member = ARGV[1], ARGV[2], ARGV[3]
+if ARGV[9] == "1" then
+	redis.replicate_commands()
+	local t = redis.call("TIME")
+	now = t[1] .. string.format("%06d", tonumber(t[2])) .. "000"
+	member = now .. ":" .. member
+	start = string.format("%.0f", tonumber(now) - tonumber(ARGV[8]))
+end
+if ARGV[14] and ARGV[14] ~= "" then
+	local newest = redis.call("ZREVRANGE", KEYS[1], 0, 0, "WITHSCORES")[2]
+	if newest and tonumber(now) < tonumber(newest) then
+		newest = string.format("%.0f", tonumber(newest))
+		if ARGV[14] == "reject" then
+			return redis.error_reply("CLOCKREWIND " .. now .. " " .. newest)
+		end
+		now = newest
+	end
+end
+local cost = tonumber(ARGV[4])
+local limit = tonumber(redis.call("GET", KEYS[4]) or ARGV[6])
+local score = now
+if ARGV[15] and ARGV[15] ~= "" then
+	score = string.format("%.0f", tonumber(start) + tonumber(ARGV[15]))
+end
+local trimmed = 0
+if cost <= limit then
+	trimmed = trim(KEYS[1], KEYS[5], start)
+end
+local count = counted(KEYS[1], KEYS[5], start)
+local grace = redis.call("GET", KEYS[2])
+local ingrace = grace and tonumber(now) < tonumber(grace)
+local tripped, cleared = 0, 0
+if cost <= limit and (ingrace or count + cost <= limit) then
+	local suffix = ""
+	if cost > 1 then
+		suffix = "*" .. cost
+	end
+	local seq = tonumber(ARGV[5])
+	member = unique(KEYS[1], member, seq, 1, suffix)
+	local m = member
+	if seq > 0 then
+		m = m .. "-" .. seq
+	end
+	m = m .. suffix
+	if ARGV[13] and ARGV[13] ~= "" then
+		redis.call("ZADD", KEYS[1], ARGV[13], score, m)
+	else
+		redis.call("ZADD", KEYS[1], score, m)
+	end
+	if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[7]) then
+		redis.call("PEXPIRE", KEYS[1], ARGV[7])
+	end
+	if cost > 1 then
+		redis.call("ZADD", KEYS[5], score, m)
+		if redis.call("PTTL", KEYS[5]) < tonumber(ARGV[7]) then
+			redis.call("PEXPIRE", KEYS[5], ARGV[7])
+		end
+	end
+	local cap = tonumber(ARGV[12] or 0)
+	if cap > 0 and cap < limit then
+		cap = limit
+	end
+	if cap > 0 then
+		if redis.call("EXISTS", KEYS[5]) == 1 then
+			for _, d in ipairs(redis.call("ZRANGE", KEYS[1], 0, -cap - 1)) do
+				redis.call("ZREM", KEYS[5], d)
+			end
+		end
+		trimmed = trimmed + redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -cap - 1)
+	end
+	cleared = redis.call("DEL", KEYS[3])
+	count = count + cost
+	cost = 0
+elseif cost <= limit then
+	if redis.call("SET", KEYS[3], now, "NX", "PX", ARGV[7]) then
+		tripped = 1
+	end
+	if ARGV[10] and ARGV[10] ~= "" then
+		redis.call("PUBLISH", ARGV[10], now .. " " .. ARGV[11])
+	end
+end
+local full = false
+if limit >= 1 and count >= limit then
+	full = roomAt(KEYS[1], KEYS[5], start, limit)
+end
+return {trimmed, count + cost, ingrace and 1 or 0, grace, full, start, now, member, tripped, cleared, limit}
+`)
+
+// DecisionSampling selects the decisions a Stopper reports to OnDecision.
+type DecisionSampling int
+
+const (
+	// EveryDecision reports every decision.
+	EveryDecision DecisionSampling = iota
+
+	// TransitionsOnly reports only the decisions which differ from the
+	// previous one for the item, the first rejection after actions passed
+	// and the first pass after actions were rejected, as told by the
+	// JustBlocked and JustUnblocked of PassResult, which cuts the calls on
+	// busy items to the moments worth noting. Decisions of PassGlobal,
+	// PassUnique, TryPass and the LocalFallback, which don't keep track of
+	// the previous one, are reported regardless.
+	TransitionsOnly
+)
+
+// RewindPolicy selects what a Stopper does with actions attempted before the
+// newest one recorded in the window, because the clock went back.
+type RewindPolicy int
+
+const (
+	// RewindIgnore records the actions at the earlier time, out of order.
+	RewindIgnore RewindPolicy = iota
+
+	// RewindClamp records the actions at the time of the newest one
+	// instead, so that the window stays in order and the time it takes to
+	// make room is never underestimated.
+	RewindClamp
+
+	// RewindReject decides on no action, failing with a *ClockRewindError
+	// until the clock caught up, which FailOpen and LocalFallback leave
+	// alone.
+	RewindReject
+)
+
+// arg returns the policy as passed to passScript.
+func (p RewindPolicy) arg() string {
+	switch p {
+	case RewindClamp:
+		return "clamp"
+	case RewindReject:
+		return "reject"
+	}
+	return ""
+}
+
+// ZAddFlag is a flag of the ZADD command recording actions.
+type ZAddFlag string
+
+const (
+	// ZAddNX only adds new members, never updating the score of one
+	// already in the window. It requires redis 3.0.2 or later.
+	ZAddNX ZAddFlag = "NX"
+
+	// ZAddGT only updates the score of a member already in the window if
+	// it is moved later, so that windows are only ever extended. It
+	// requires redis 6.2 or later.
+	ZAddGT ZAddFlag = "GT"
+
+	// ZAddLT only updates the score of a member already in the window if
+	// it is moved earlier. It requires redis 6.2 or later.
+	ZAddLT ZAddFlag = "LT"
+)
+
+// valid reports whether f is unset or one of the known flags.
+func (f ZAddFlag) valid() bool {
+	switch f {
+	case "", ZAddNX, ZAddGT, ZAddLT:
+		return true
+	}
+	return false
+}
+
+// optionArgs returns the optional arguments of passScript for an action on
+// item checked against limit: those making it publish the rejection when
+// PublishBlocked is set, the cap on the members stored when MaxStored is,
+// and the ZAddFlag. They are none unless any is.
+func (s *Stopper) optionArgs(item string, limit int64) []interface{} {
+	if !s.PublishBlocked && s.MaxStored <= 0 && s.ZAddFlag == "" && s.ClockRewind == RewindIgnore {
+		return nil
+	}
+	channel := ""
+	if s.PublishBlocked {
+		channel = s.BlockedChannel()
+	}
+	maxStored := s.MaxStored
+	if maxStored > 0 && maxStored < limit {
+		maxStored = limit
 	}
-	nanonow := now.UnixNano()
-	key := fmt.Sprintf("%s:%s", s.Namespace, item)
+	return []interface{}{channel, item, maxStored, string(s.ZAddFlag), s.ClockRewind.arg()}
+}
+
+// recordArgs returns the keys and arguments for passScript recording cost
+// actions at now in the window of the given interval stored at key, unless
+// that exceeds limit or the override of it stored at limitKey. Members are
+// numbered from seq onwards, which must be unique among the actions recorded
+// at now. With serverTime, now is replaced by the time of the redis server.
+func recordArgs(key, limitKey string, now time.Time, interval time.Duration, cost int64, seq int, limit int64, serverTime bool) []interface{} {
+	// Each value boxed in an interface is allocated on its own, so the time
+	// is boxed once and the auxiliary keys are cut from a single string
+	// rather than built one by one, recordArgs being on the hot path of
+	// every pass.
+	var nanonow interface{} = now.UnixNano()
+	useServerTime := 0
+	if serverTime {
+		useServerTime = 1
+	}
+	aux := auxKey(key, "grace") + auxKey(key, "blocked") + auxKey(key, "weights")
+	grace, blocked := len(key)+len("#grace"), 2*len(key)+len("#grace#blocked")
+	return []interface{}{key, aux[:grace], aux[grace:blocked], limitKey, aux[blocked:], now.Add(interval * -1).UnixNano(), nanonow, nanonow, cost, seq, limit, durationMillis(interval), interval.Nanoseconds(), useServerTime}
+}
+
+// recordReply holds the reply to passScript.
+type recordReply struct {
+	// The number of expired members trimmed from the window.
+	trimmed int64
+
+	// The number of members in the window including the attempted ones,
+	// whether recorded or not.
+	count int64
+
+	// Whether the item is in a grace period as set by ResetWithGrace.
+	inGrace bool
+
+	// The time until which the item is in a grace period, or zero.
+	graceUntil int64
+
+	// The score of the action whose expiry makes room for another in a full
+	// window, or zero if it has room already.
+	roomAt int64
+
+	// The start of the window, the time at which the actions were attempted
+	// and the member of the first, which are only known after the fact with
+	// UseServerTime.
+	windowStart, now int64
+	member           string
+
+	// Whether the attempted actions were the first rejected since actions
+	// were last recorded, or the first recorded since actions were last
+	// rejected.
+	tripped, cleared bool
+
+	// The limit the actions were checked against, which is zero unless
+	// replied.
+	limit int64
+}
+
+// retryAfter returns how long until the window has room for another action.
+func (r recordReply) retryAfter() time.Duration {
+	if wait := time.Duration(r.roomAt - r.windowStart); r.roomAt != 0 && wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// recordScan holds the targets scanRecord scans the reply to passScript
+// into, which are pooled along with the slice pointing at them, as building
+// it escapes them to the heap on every pass otherwise.
+type recordScan struct {
+	r                recordReply
+	graceUntil, full []byte
+	dest             []interface{}
+}
+
+var recordScans = sync.Pool{New: func() interface{} {
+	sc := &recordScan{}
+	sc.dest = []interface{}{&sc.r.trimmed, &sc.r.count, &sc.r.inGrace, &sc.graceUntil, &sc.full, &sc.r.windowStart, &sc.r.now, &sc.r.member}
+	return sc
+}}
 
-	c := s.ConnPool.Get()
+// scanRecord scans the reply to passScript.
+func scanRecord(reply interface{}, err error) (recordReply, error) {
+	var r recordReply
+	if rerr := rewindError(reply, err); rerr != nil {
+		return r, rerr
+	}
+	if e, ok := reply.(error); ok && err == nil {
+		err = scriptError(e)
+	}
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return r, err
+	}
+	sc := recordScans.Get().(*recordScan)
+	_, err = redis.Scan(values, sc.dest...)
+	r, graceUntil, full := sc.r, sc.graceUntil, sc.full
+	// Scan leaves the targets of nil values alone, so they are cleared for
+	// the next reply.
+	sc.r, sc.graceUntil, sc.full = recordReply{}, nil, nil
+	recordScans.Put(sc)
+	if err != nil {
+		return recordReply{}, err
+	}
+	if len(values) > 8 {
+		if r.tripped, err = redis.Bool(values[8], nil); err != nil {
+			return r, err
+		}
+	}
+	if len(values) > 9 {
+		if r.cleared, err = redis.Bool(values[9], nil); err != nil {
+			return r, err
+		}
+	}
+	if len(values) > 10 {
+		if r.limit, err = redis.Int64(values[10], nil); err != nil {
+			return r, err
+		}
+	}
+	if graceUntil != nil {
+		if r.graceUntil, err = strconv.ParseInt(string(graceUntil), 10, 64); err != nil {
+			return r, err
+		}
+	}
+	if full != nil {
+		score, err := strconv.ParseFloat(string(full), 64)
+		if err != nil {
+			return r, err
+		}
+		r.roomAt = int64(score)
+	}
+	return r, nil
+}
+
+// member returns the sorted set member for the seq-th action recorded at
+// nanonow. The first is the bare timestamp.
+func member(nanonow int64, seq int) interface{} {
+	if seq == 0 {
+		return nanonow
+	}
+	return strconv.FormatInt(nanonow, 10) + "-" + strconv.Itoa(seq)
+}
+
+// trimmed reports the number of members trimmed from item's window to OnTrim.
+func (s *Stopper) trimmed(item string, remcount int64) {
+	if s.OnTrim != nil {
+		s.OnTrim(item, remcount)
+	}
+}
+
+// DropProbability returns the probability with which an action is rejected
+// when count actions, including itself, have been recorded during the
+// current interval. It is 0 up to and including SoftLimit and rises linearly
+// from there to reach 1 at Limit+1, where the hard limit takes over.
+func (s *Stopper) DropProbability(count int64) float64 {
+	return s.dropProbability(count, s.Limit)
+}
+
+// dropProbability implements DropProbability against the hard limit given.
+func (s *Stopper) dropProbability(count, limit int64) float64 {
+	if count > limit {
+		return 1
+	}
+	if s.SoftLimit <= 0 || count <= s.SoftLimit {
+		return 0
+	}
+	return float64(count-s.SoftLimit) / float64(limit+1-s.SoftLimit)
+}
+
+// random returns a random number in [0.0, 1.0) for SoftLimit decisions.
+func (s *Stopper) random() float64 {
+	if s.Rand == nil {
+		return rand.Float64()
+	}
+	return s.Rand()
+}
+
+// CheckOrError sends an item through the Stopper like Pass, but returns a
+// *RateLimitError rather than false should the rate-limit for this item be
+// exceeded. The error carries the limit the action was checked against and
+// how long until the window has room again, as told by the PassResult.
+func (s *Stopper) CheckOrError(ctx context.Context, item string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r, err := s.pass(ctx, CheckRequest{Item: item}, nil)
+	if err != nil {
+		return err
+	}
+	if !r.Allowed {
+		return &RateLimitError{Item: s.displayItem(item), Limit: r.Limit, RetryAfter: r.RetryAfter}
+	}
+	return nil
+}
+
+// Reset clears the window for item, so that its next action is counted
+// against an empty window. Resetting an item without any actions does
+// nothing.
+func (s *Stopper) Reset(item string) error {
+	return s.ResetWithGrace(item, 0)
+}
+
+// ResetWithGrace clears the window for item, along with the lockouts and
+// offenses of the Penalty, and lets every action for it pass until grace has
+// elapsed. Actions passed during the grace period are still recorded, so
+// once it ends they count against the limit as usual. A grace period still
+// running from an earlier reset is ended, or replaced by the new one.
+func (s *Stopper) ResetWithGrace(item string, grace time.Duration) error {
+	key, err := s.key(item)
+	if err != nil {
+		return err
+	}
+	until := s.now().Add(grace).UnixNano()
+
+	c, err := s.conn(key)
+	if err != nil {
+		return err
+	}
 	defer func() { _ = c.Close() }()
 
-	if err := c.Send("MULTI"); err != nil {
-		return false, err
+	var tx transaction
+	tx.add("DEL", key, auxKey(key, "blocked"), auxKey(key, "grace"), auxKey(key, "weights"))
+	if s.Penalty != nil {
+		tx.add("DEL", auxKey(key, "offenses"), auxKey(key, "lockouts"), auxKey(key, "penalty"))
 	}
-	if err := c.Send("ZREMRANGEBYSCORE", key, "-inf", now.Add(s.Interval*-1).UnixNano()); err != nil {
-		return false, err
+	if grace > 0 {
+		// The expiry only serves to clean up the marker, the grace period
+		// itself is judged by the Stopper's clock against the stored time.
+		tx.add("SET", auxKey(key, "grace"), until, "PX", durationMillis(grace))
 	}
-	if err := c.Send("ZADD", key, nanonow, nanonow); err != nil {
-		return false, err
+	if _, err := tx.execAll(c); err != nil {
+		return s.itemError(item, err)
 	}
-	if err := c.Send("ZCARD", key); err != nil {
-		return false, err
+	return nil
+}
+
+// Grant frees n slots in the window for item at once by removing its n
+// oldest actions, for example to make good for an incident without
+// resetting the whole window. Expired actions are trimmed first, so that
+// each slot granted is one the limit would otherwise have held back.
+// Granting more than the window holds empties it, and granting less than
+// one does nothing.
+func (s *Stopper) Grant(item string, n int64) error {
+	if n < 1 {
+		return nil
+	}
+	key, err := s.key(item)
+	if err != nil {
+		return err
+	}
+	windowStart := s.now().Add(s.Interval * -1).UnixNano()
+
+	c, err := s.conn(key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	trimmed, err := redis.Int64(grantScript.run(c, key, auxKey(key, "weights"), windowStart, n))
+	if err != nil {
+		return s.itemError(item, err)
+	}
+	s.trimmed(item, trimmed)
+	return nil
+}
+
+// grantScript trims the window stored at KEYS[1] of members scored at or
+// before ARGV[1] and removes its ARGV[2] oldest actions, counted with the
+// weights at KEYS[2] as by luaWeights. Of a member standing for more actions
+// than are left to remove, it takes away that many, leaving the others
+// recorded. It returns the number of members trimmed.
+var grantScript = newScript(2, luaUnique+luaWeights+`
+local trimmed = trim(KEYS[1], KEYS[2], ARGV[1])
+local left = tonumber(ARGV[2])
+local members = redis.call("ZRANGE", KEYS[1], 0, left - 1, "WITHSCORES")
+for i = 1, #members, 2 do
+	local n = weight(KEYS[2], members[i])
+	if n > left then
+		reweigh(KEYS[1], KEYS[2], members[i], members[i + 1], n - left)
+		break
+	end
+	redis.call("ZREM", KEYS[1], members[i])
+	redis.call("ZREM", KEYS[2], members[i])
+	left = left - n
+	if left == 0 then
+		break
+	end
+end
+return trimmed
+`)
+
+// Peek returns the number of items passed during the current interval. The
+// window is trimmed first, so that expired actions are not counted.
+func (s *Stopper) Peek(item string) (int64, error) {
+	return s.PeekContext(context.Background(), item)
+}
+
+// PeekContext returns the number of items passed during the current interval
+// like Peek, failing with ctx's error once ctx is done before redis replied.
+func (s *Stopper) PeekContext(ctx context.Context, item string) (int64, error) {
+	ctx, span := s.startSpan(ctx, "flowstopper.Peek", item)
+	var count int64
+	err := s.retry(ctx, func() error {
+		var err error
+		count, err = s.count(ctx, item)
+		return err
+	})
+	if span != nil {
+		span.End(err)
+	}
+	if err != nil {
+		s.logError(err)
+	}
+	return count, err
+}
+
+// PeekLive returns the number of items passed during the current interval
+// like Peek, but counts only the live actions with a read-only ZCOUNT
+// rather than trimming the expired ones first. The window is left
+// untouched, so that observers such as dashboards add no writes to redis,
+// and may count against read replicas through a Pool of their own.
+func (s *Stopper) PeekLive(item string) (int64, error) {
+	windowStart := s.now().Add(s.Interval * -1).UnixNano()
+	key, err := s.key(item)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	count, err := redis.Int64(c.Do("ZCOUNT", key, exclusive(windowStart), "+inf"))
+	if err != nil {
+		return 0, s.itemError(item, s.typeError(item, err))
+	}
+	w, err := weightsOf(c, key, windowStart)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	return count + w.extra(), nil
+}
+
+// PeekResult describes the window of an item in detail, as seen between
+// actions.
+type PeekResult struct {
+	// The number of actions passed during the current interval.
+	Count int64
+
+	// The limit the window is checked against, which is the one set by
+	// SetLimit for the item if any.
+	Limit int64
+
+	// How many more actions the limit allows during the current interval,
+	// never less than zero.
+	Remaining int64
+
+	// Whether the window is at or over the limit, so that the next action
+	// would be rejected, like told by IsBlocked.
+	Blocked bool
+
+	// When the oldest action in the window expires, making room for
+	// another, or the zero time for an empty window.
+	Reset time.Time
+}
+
+// PeekResult returns the state of item's window like Peek, along with what
+// Remaining, IsBlocked and WindowStart would tell about it, all in a single
+// round trip to redis, such as for dashboards and health endpoints. The
+// window is trimmed first, so that expired actions are not counted.
+func (s *Stopper) PeekResult(item string) (PeekResult, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return PeekResult{}, err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return PeekResult{}, err
+	}
+	defer func() { _ = c.Close() }()
+
+	limitKey, err := s.limitKey(item)
+	if err != nil {
+		return PeekResult{}, err
+	}
+	windowStart := now.Add(s.Interval * -1).UnixNano()
+	var tx transaction
+	tx.add("ZREMRANGEBYSCORE", key, "-inf", windowStart)
+	tx.add("ZCARD", key)
+	tx.add("ZRANGE", key, 0, 0, "WITHSCORES")
+	tx.add("GET", limitKey)
+	tx.add("ZRANGEBYSCORE", weightsArgs(key, windowStart)...)
+	values, err := tx.execAll(c)
+	if err != nil {
+		return PeekResult{}, s.itemError(item, s.typeError(item, err))
+	}
+	var trimmed, count int64
+	var oldest, weighted []string
+	if _, err := redis.Scan(values, &trimmed, &count, &oldest, nil, &weighted); err != nil {
+		return PeekResult{}, s.itemError(item, err)
 	}
+	s.trimmed(item, trimmed)
+	count += parseWeights(weighted).extra()
+	limit, err := s.effectiveLimit(values[3])
+	if err != nil {
+		return PeekResult{}, s.itemError(item, err)
+	}
+
+	r := PeekResult{
+		Count:     count,
+		Limit:     limit,
+		Remaining: remaining(limit, count),
+		Blocked:   !admits(count, 1, limit),
+	}
+	if len(oldest) == 2 {
+		score, err := strconv.ParseFloat(oldest[1], 64)
+		if err != nil {
+			return PeekResult{}, s.itemError(item, err)
+		}
+		r.Reset = time.Unix(0, int64(score)).Add(s.Interval).UTC()
+	}
+	return r, nil
+}
 
-	values, err := redis.Values(c.Do("EXEC"))
+// ResetTime returns when item's window has room again once it is blocked,
+// which is when its oldest action expires, or the current time while it is
+// under the limit and has room already, such as for the epoch of a
+// RateLimit-Reset header. It counts the window like PeekResult, of whose
+// Reset it is the time.
+func (s *Stopper) ResetTime(item string) (time.Time, error) {
+	r, err := s.PeekResult(item)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !r.Blocked || r.Reset.IsZero() {
+		return s.now(), nil
+	}
+	return r.Reset, nil
+}
+
+// Remaining returns how many more actions for item the limit allows during
+// the current interval, never less than zero. It counts the window like
+// Peek, against the limit set by SetLimit for item if any.
+func (s *Stopper) Remaining(item string) (int64, error) {
+	count, limit, err := s.countLimit(context.Background(), item)
+	if err != nil {
+		return 0, err
+	}
+	return remaining(limit, count), nil
+}
+
+// Usage returns the share of the limit used by item during the current
+// interval, from 0 to 1, for example to draw a progress bar. It counts the
+// window like Peek, against the limit set by SetLimit for item if any. It is
+// 0 for a Stopper whose Limit is not positive.
+func (s *Stopper) Usage(item string) (float64, error) {
+	count, limit, err := s.countLimit(context.Background(), item)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, nil
+	}
+	return math.Min(float64(count)/float64(limit), 1), nil
+}
+
+// Check returns whether an action for item would pass the limit right now,
+// without recording it, for example to tell users whether they may go
+// ahead. It counts the window like Peek, so repeated checks leave the window
+// as they found it. Like Pass, it compares the count to the limit set by
+// SetLimit for item if any. Unlike Pass, it disregards grace periods, free
+// allowances and the soft limit.
+func (s *Stopper) Check(item string) (bool, error) {
+	count, limit, err := s.countLimit(context.Background(), item)
 	if err != nil {
 		return false, err
 	}
+	return admits(count, 1, limit), nil
+}
 
-	var remcount, addcount, setsize int64
-	_, err = redis.Scan(values, &remcount, &addcount, &setsize)
+// IsBlocked returns whether item is at or over its limit, so that its next
+// action would be rejected, trimming the window first like Peek. It is the
+// opposite of Check, making the same comparison as Pass rather than leaving
+// callers to compare the count of Peek to the Limit themselves.
+func (s *Stopper) IsBlocked(item string) (bool, error) {
+	allowed, err := s.Check(item)
 	if err != nil {
 		return false, err
 	}
+	return !allowed, nil
+}
 
-	if setsize > s.Limit {
-		return false, nil
+// admits reports whether a window holding count actions has room for cost
+// more under limit, as decided by passScript.
+func admits(count, cost, limit int64) bool {
+	return cost <= limit && count+cost <= limit
+}
+
+// count returns the number of actions in item's window, trimming it first
+// so that expired actions are not counted.
+func (s *Stopper) count(ctx context.Context, item string) (int64, error) {
+	count, _, err := s.countAgainst(ctx, item, false)
+	return count, err
+}
+
+// countLimit returns the number of actions in item's window like count,
+// along with the limit they are checked against, as told by limitFor.
+func (s *Stopper) countLimit(ctx context.Context, item string) (count, limit int64, err error) {
+	return s.countAgainst(ctx, item, true)
+}
+
+// countAgainst implements count, reading the limit as well when limited.
+func (s *Stopper) countAgainst(ctx context.Context, item string, limited bool) (int64, int64, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.observe("peek", time.Now())
+
+	c, err := s.connContext(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	windowStart := now.Add(s.Interval * -1).UnixNano()
+	trimmed, err := redis.Int64(c.Do("ZREMRANGEBYSCORE", key, "-inf", windowStart))
+	if err != nil && err != redis.ErrNil {
+		return 0, 0, s.itemError(item, s.typeError(item, err))
+	}
+	s.trimmed(item, trimmed)
+
+	count, err := redis.Int64(c.Do("ZCARD", key))
+	if err != nil && err != redis.ErrNil {
+		return 0, 0, s.itemError(item, s.typeError(item, err))
+	}
+	w, err := weightsOf(c, key, windowStart)
+	if err != nil {
+		return 0, 0, s.itemError(item, err)
+	}
+	count += w.extra()
+	if !limited {
+		return count, 0, nil
+	}
+	limit, err := s.limitFor(c, item)
+	if err != nil {
+		return 0, 0, err
 	}
-	return true, nil
+	return count, limit, nil
 }
 
-// Peek returns the number of items passed during the current interval.
-func (s *Stopper) Peek(item string) (int64, error) {
-	c := s.ConnPool.Get()
+// typeError returns err, replied to a command on the window of item, as a
+// WrongTypeError if redis rejected it for the type of the key.
+func (s *Stopper) typeError(item string, err error) error {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "WRONGTYPE") {
+		return err
+	}
+	return &WrongTypeError{Key: s.Key(s.displayItem(item)), Err: err}
+}
+
+// RetryAfter returns how long it takes until the next action for item would
+// pass, which is zero while it is under the limit, the one set by SetLimit
+// for item if any. It is meant for surfacing in a Retry-After header once
+// Pass returned false.
+func (s *Stopper) RetryAfter(item string) (time.Duration, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return 0, err
+	}
 	defer func() { _ = c.Close() }()
 
-	key := fmt.Sprintf("%s:%s", s.Namespace, item)
-	return redis.Int64(c.Do("ZCARD", key))
+	// Room is made once the limit-th newest action in the window expires.
+	limit, err := s.limitFor(c, item)
+	if err != nil {
+		return 0, err
+	}
+	windowStart := now.Add(s.Interval * -1).UnixNano()
+	w, err := weightsOf(c, key, windowStart)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	// Members standing for several actions are only known by walking the
+	// newest ones, which a window without any can skip.
+	offset, n := limit-1, int64(1)
+	if len(w) > 0 {
+		offset, n = 0, limit
+	}
+	values, err := redis.Strings(c.Do("ZREVRANGEBYSCORE", key, "+inf", exclusive(windowStart), "WITHSCORES", "LIMIT", offset, n))
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	found, ok := nthAction(values, w, limit-1-offset)
+	if !ok {
+		return 0, nil
+	}
+	score, err := strconv.ParseFloat(found, 64)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	wait := time.Duration(int64(score) - windowStart)
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// WindowStart returns the time of the oldest action for item during the
+// current interval, or the zero time if there is none, for example to work
+// out when the window resets. Expired actions which have not been trimmed
+// yet are skipped. The time is in UTC.
+func (s *Stopper) WindowStart(item string) (time.Time, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { _ = c.Close() }()
+
+	windowStart := now.Add(s.Interval * -1).UnixNano()
+	values, err := redis.Strings(c.Do("ZRANGEBYSCORE", key, exclusive(windowStart), "+inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return time.Time{}, s.itemError(item, err)
+	}
+	if len(values) < 2 {
+		return time.Time{}, nil
+	}
+	score, err := strconv.ParseFloat(values[1], 64)
+	if err != nil {
+		return time.Time{}, s.itemError(item, err)
+	}
+	return time.Unix(0, int64(score)).UTC(), nil
+}
+
+// Close shuts the Stopper down gracefully. It first stops accepting new
+// operations, which fail with ErrClosed from then on, and then waits for
+// those already in flight to finish, or for ctx to be done, whichever comes
+// first.
+//
+// Only the resources the Stopper owns are released: the pool created by
+// DialStopper is closed, while a ConnPool or Pool passed in by the caller is
+// left open, as it may be shared with other Stoppers.
+func (s *Stopper) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if s.ownedPool != nil {
+		// Connections still in use are closed as they are returned.
+		if cerr := s.ownedPool.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Ping checks that redis is reachable by sending it a PING, for use in
+// health checks. Unlike Pass, it leaves every window alone. It gives up once
+// ctx is done, so that a hung redis doesn't hang the check. With a
+// ShardedPool, every shard is pinged.
+func (s *Stopper) Ping(ctx context.Context) error {
+	for _, p := range shardsOf(s.pool()) {
+		if err := s.ping(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Preload loads the Lua scripts of the Stopper into redis ahead of time, so
+// that the first action on each server doesn't pay for a NOSCRIPT reply and
+// a SCRIPT LOAD, such as at startup after Ping. With a ShardedPool, every
+// shard is loaded. It is optional, as scripts redis does not know yet are
+// loaded on first use either way, and so are those lost by a restart of
+// redis after Preload. The digests scripts are evaluated by are computed
+// up front, and it fails should redis compute another. It gives up once
+// ctx is done.
+func (s *Stopper) Preload(ctx context.Context) error {
+	for _, p := range shardsOf(s.pool()) {
+		if err := s.preload(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preload loads the scripts of the Stopper into the redis behind p.
+func (s *Stopper) preload(ctx context.Context, p Pool) error {
+	c, err := s.connTo(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	for _, sc := range stopperScripts {
+		sha, err := redis.String(c.Do("SCRIPT", "LOAD", sc.source))
+		if err != nil {
+			if isConnError(err) {
+				return fmt.Errorf("flowstopper: loading script %s: %w: %w", sc.Hash(), ErrConnUnavailable, err)
+			}
+			return fmt.Errorf("flowstopper: loading script %s: %w", sc.Hash(), err)
+		}
+		if sha != sc.Hash() {
+			return fmt.Errorf("flowstopper: redis loaded script %s as %s", sc.Hash(), sha)
+		}
+	}
+	return nil
+}
+
+// ping sends a PING to the redis behind p.
+func (s *Stopper) ping(ctx context.Context, p Pool) error {
+	c, err := s.connTo(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if _, err := c.Do("PING"); err != nil {
+		if isConnError(err) {
+			return fmt.Errorf("%w: %w", ErrConnUnavailable, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// conn takes a connection from the pool for a single operation on the item
+// stored at key, which lasts until the connection is closed. It fails with
+// ErrClosed once the Stopper has been closed.
+func (s *Stopper) conn(key string) (*operationConn, error) {
+	return s.connContext(context.Background(), key)
+}
+
+// connContext is like conn, but gets the connection from the pool and
+// issues commands on it within ctx.
+func (s *Stopper) connContext(ctx context.Context, key string) (*operationConn, error) {
+	return s.connTo(ctx, s.pool(), key)
+}
+
+// pool returns the pool the Stopper takes its connections from.
+func (s *Stopper) pool() Pool {
+	return poolOf(s.Pool, s.ConnPool)
+}
+
+// connTo is like connContext, but takes the connection from p.
+func (s *Stopper) connTo(ctx context.Context, p Pool, key string) (*operationConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	s.inflight.Add(1)
+	s.mu.Unlock()
+
+	c, err := getConn(ctx, p, key)
+	if err != nil {
+		s.inflight.Done()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrConnUnavailable, err)
+	}
+	return &operationConn{Conn: c, ctx: ctx, inflight: &s.inflight, logger: s.Logger, timeout: s.ReadTimeout}, nil
+}
+
+// operationConn is a connection used for a single operation, signalling its
+// end to inflight when closed.
+type operationConn struct {
+	Conn
+	ctx      context.Context
+	inflight *sync.WaitGroup
+	logger   Logger
+	timeout  time.Duration
+}
+
+// Do issues a command like Conn, giving up on its reply once the
+// operation's context is done or the ReadTimeout has elapsed. Redigo cannot
+// interrupt a command without a deadline, so a context which is merely
+// cancelled is only checked before the command is sent, as it is for
+// clients not supporting timeouts.
+func (c *operationConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	timeout := c.timeout
+	if deadline, ok := c.ctx.Deadline(); ok && (timeout == 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+	}
+	cwt, canTimeout := c.Conn.(redis.ConnWithTimeout)
+	if timeout == 0 || !canTimeout {
+		return c.Conn.Do(cmd, args...)
+	}
+	reply, err := cwt.DoWithTimeout(timeout, cmd, args...)
+	if err != nil && c.ctx.Err() != nil {
+		return nil, c.ctx.Err()
+	}
+	return reply, err
+}
+
+func (c *operationConn) Close() error {
+	err := c.Conn.Close()
+	c.inflight.Done()
+	return err
+}
+
+// Now is the time source of every limiter in the package without a clock of
+// its own, which tests may swap out to control time for all of them at once.
+var Now = func() time.Time { return time.Now().UTC() }
+
+// now returns the current time according to the Stopper's clock, or Now
+// without one.
+func (s *Stopper) now() time.Time {
+	if s.c == nil {
+		return Now().UTC()
+	}
+	return s.c.Now().UTC()
+}
+
+// Key returns the redis key under which the window for item is stored, for
+// integration with other tooling. It does not talk to redis.
+func (s *Stopper) Key(item string) string {
+	return s.windowKey(s.keyIn(s.Namespace, item), s.Interval)
+}
+
+// keyIn is Key for item under namespace rather than the Namespace.
+func (s *Stopper) keyIn(namespace, item string) string {
+	if s.KeyFunc != nil {
+		return s.KeyFunc(namespace, item)
+	}
+	if s.HashTag {
+		return namespace + s.separator() + "{" + item + "}"
+	}
+	return namespace + s.separator() + item
+}
+
+// separator returns the Separator, defaulting to ":".
+func (s *Stopper) separator() string {
+	return separatorOr(s.Separator)
+}
+
+// separatorOr returns separator, or the default one when it is empty.
+func separatorOr(separator string) string {
+	if separator == "" {
+		return defaultSeparator
+	}
+	return separator
+}
+
+// key returns the redis key used to track item, rejecting the empty item and
+// validating the Namespace unless it is left to KeyFunc.
+func (s *Stopper) key(item string) (string, error) {
+	key, err := s.validKeyIn(s.Namespace, item)
+	if err != nil {
+		return "", err
+	}
+	return s.windowKey(key, s.Interval), nil
+}
+
+// windowKey returns key for the window of interval, suffixing the interval
+// with IntervalKeys.
+func (s *Stopper) windowKey(key string, interval time.Duration) string {
+	if !s.IntervalKeys {
+		return key
+	}
+	return key + "@" + interval.String()
+}
+
+// validKeyIn is key for item under namespace rather than the Namespace.
+func (s *Stopper) validKeyIn(namespace, item string) (string, error) {
+	switch {
+	case item == "":
+		return "", ErrEmptyItem
+	case s.KeyFunc != nil:
+		return s.KeyFunc(namespace, item), nil
+	case s.HashTag:
+		item = "{" + item + "}"
+	}
+	return joinKey(namespace, s.Separator, item)
+}
+
+// joinKey returns the key of item under namespace, joined by separator or
+// by ":" when it is empty, as the limiters of the package form their keys.
+// It rejects the empty item, and a namespace containing the separator.
+func joinKey(namespace, separator, item string) (string, error) {
+	separator = separatorOr(separator)
+	if item == "" {
+		return "", ErrEmptyItem
+	}
+	if strings.Contains(namespace, separator) {
+		return "", ErrInvalidNamespace
+	}
+	return namespace + separator + item, nil
+}
+
+// displayItem returns item as it may be shown in errors, honoring
+// RedactItems.
+func (s *Stopper) displayItem(item string) string {
+	return redactItem(item, s.RedactItems)
+}
+
+// redactItem returns item as shown in errors by the limiters with a
+// RedactItems field, replaced by a hash of itself when redact is set.
+func redactItem(item string, redact bool) string {
+	if !redact {
+		return item
+	}
+	sum := sha256.Sum256([]byte(item))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// itemError annotates err, encountered while handling item, with the item,
+// marking connection failures with ErrConnUnavailable.
+func (s *Stopper) itemError(item string, err error) error {
+	if isConnError(err) {
+		return fmt.Errorf("flowstopper: %q: %w: %w", s.displayItem(item), ErrConnUnavailable, err)
+	}
+	return fmt.Errorf("flowstopper: %q: %w", s.displayItem(item), err)
+}
+
+// remaining returns how many more actions limit allows when count have been
+// recorded, never less than zero.
+func remaining(limit, count int64) int64 {
+	if count >= limit {
+		return 0
+	}
+	return limit - count
+}
+
+// auxKey returns the key holding auxiliary state of the given kind alongside
+// the window stored at key. Items ending in "#" followed by one of these
+// kinds should therefore be avoided.
+func auxKey(key, kind string) string {
+	return key + "#" + kind
+}
+
+// durationMillis returns d in whole milliseconds, rounded up, for use with
+// PX and PEXPIRE.
+func durationMillis(d time.Duration) int64 {
+	ms := d / time.Millisecond
+	if d%time.Millisecond > 0 {
+		ms++
+	}
+	return int64(ms)
+}
+
+// exclusive formats score as an exclusive bound for ZCOUNT and friends.
+func exclusive(score int64) string {
+	return "(" + strconv.FormatInt(score, 10)
 }
@@ -2,8 +2,14 @@ package flowstopper
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"os"
 	"os/exec"
+	"strconv"
 	"testing"
 	"time"
 
@@ -11,11 +17,64 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
 	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/goleak"
 )
 
 var now = time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
 var redisServerPort = 58789
 
+// connPool hands out connections to the redis-server started by TestMain.
+var connPool = redis.Pool{
+	Dial: func() (redis.Conn, error) {
+		return redis.Dial("tcp", fmt.Sprintf("localhost:%d", redisServerPort))
+	},
+}
+
+func TestMain(m *testing.M) {
+	redisServer := runRedisServer()
+	if redisServer == nil {
+		fmt.Println("redis-server didn't start")
+		os.Exit(1)
+	}
+	code := m.Run()
+	_ = redisServer.Process.Kill()
+	os.Exit(code)
+}
+
+// flushRealRedis removes all keys from the redis-server started by TestMain.
+func flushRealRedis(t *testing.T) {
+	conn := connPool.Get()
+	defer func() { _ = conn.Close() }()
+	_, err := conn.Do("FLUSHALL")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMockStopper returns a stopper like the one in TestWithMockRedis, backed by
+// conn and a mock clock set to now.
+func newMockStopper(conn *redigomock.Conn) *Stopper {
+	return &Stopper{
+		Namespace: "fakestopper",
+		Interval:  5 * time.Second,
+		Limit:     int64(5),
+		ConnPool: &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		},
+		c: clock.NewMockClock(now),
+	}
+}
+
+// expectPass registers the script Pass evaluates for item on conn, returning
+// its command.
+func expectPass(conn *redigomock.Conn, stopper *Stopper, item string) *redigomock.Cmd {
+	key := stopper.Namespace + ":" + item
+	return conn.Command("EVALSHA", passScript.Hash(), 5, key, key+"#grace", key+"#blocked", key+"#limit", key+"#weights",
+		now.Add(stopper.Interval*-1).UnixNano(), now.UnixNano(), now.UnixNano(), int64(1), 0, stopper.Limit, durationMillis(stopper.Interval), stopper.Interval.Nanoseconds(), 0)
+}
+
 func TestWithMockRedis(t *testing.T) {
 	Convey("Given a stopper", t, func() {
 		conn := redigomock.NewConn()
@@ -32,32 +91,169 @@ func TestWithMockRedis(t *testing.T) {
 			c: clock.NewMockClock(now),
 		}
 
-		multi := conn.Command("MULTI")
-		exec := conn.Command("EXEC")
-		zremrangebyscore := conn.Command("ZREMRANGEBYSCORE", "fakestopper:foo", "-inf", now.Add(stopper.Interval*-1).UnixNano()).Expect("QUEUED")
-		zadd := conn.Command("ZADD", "fakestopper:foo", now.UnixNano(), now.UnixNano()).Expect("QUEUED")
-		conn.Command("ZCARD", "fakestopper:foo").Expect("QUEUED")
+		exec := expectPass(conn, &stopper, "foo")
+		conn.GenericCommand("ZREMRANGEBYSCORE").Expect(int64(0))
+		conn.Command("GET", "fakestopper:foo#limit").Expect(nil)
+		conn.GenericCommand("ZRANGEBYSCORE").Expect([]interface{}{})
 
 		Convey("When I perform an action", func() {
-			exec.Expect([]interface{}{int64(0), int64(1), int64(1)})
+			exec.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
 			passed, err := stopper.Pass("foo")
 
-			Convey("Commands should be executed in a single transaction", func() {
-				So(conn.Stats(multi), ShouldEqual, 1)
+			Convey("It is decided by a single script evaluation", func() {
 				So(conn.Stats(exec), ShouldEqual, 1)
 			})
 
-			Convey("Elements beyond the interval should be removed from the set", func() {
-				So(conn.Stats(zremrangebyscore), ShouldEqual, 1)
+			Convey("The action should pass", func() {
+				So(err, ShouldEqual, nil)
+				So(passed, ShouldEqual, true)
 			})
+		})
+
+		Convey("When redis does not know the script yet", func() {
+			exec.ExpectError(redis.Error("NOSCRIPT No matching script. Please use EVAL.")).
+				Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			load := conn.Command("SCRIPT", "LOAD", passScript.source).Expect(passScript.Hash())
+			passed, err := stopper.Pass("foo")
 
-			Convey("The current nanotime is added to the set", func() {
-				So(conn.Stats(zadd), ShouldEqual, 1)
+			Convey("It is loaded and evaluated again", func() {
+				So(err, ShouldEqual, nil)
+				So(passed, ShouldEqual, true)
+				So(conn.Stats(load), ShouldEqual, 1)
+				So(conn.Stats(exec), ShouldEqual, 2)
 			})
+		})
 
-			Convey("The action should pass", func() {
+		Convey("The key used by Pass is exposed", func() {
+			So(stopper.Key("foo"), ShouldEqual, "fakestopper:foo")
+			windowStart := now.Add(stopper.Interval * -1).UnixNano()
+			eval := conn.Command("EVALSHA", passScript.Hash(), 5, stopper.Key("foo"), stopper.Key("foo")+"#grace", stopper.Key("foo")+"#blocked", stopper.Key("foo")+"#limit", stopper.Key("foo")+"#weights",
+				windowStart, now.UnixNano(), now.UnixNano(), int64(1), 0, stopper.Limit, durationMillis(stopper.Interval), stopper.Interval.Nanoseconds(), 0).
+				Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			_, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(conn.Stats(eval), ShouldEqual, 1)
+		})
+
+		Convey("When items are hash tagged", func() {
+			stopper.HashTag = true
+			key := "fakestopper:{foo}"
+			eval := conn.Command("EVALSHA", passScript.Hash(), 5, key, key+"#grace", key+"#blocked", key+"#limit", key+"#weights",
+				now.Add(stopper.Interval*-1).UnixNano(), now.UnixNano(), now.UnixNano(), int64(1), 0, stopper.Limit, durationMillis(stopper.Interval), stopper.Interval.Nanoseconds(), 0).
+				Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			_, err := stopper.Pass("foo")
+
+			Convey("Every key of the item shares its hash tag", func() {
+				So(stopper.Key("foo"), ShouldEqual, key)
+				So(err, ShouldBeNil)
+				So(conn.Stats(eval), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When keys are built by a custom function", func() {
+			calls := 0
+			stopper.KeyFunc = func(namespace, item string) string {
+				calls++
+				return "prod/" + namespace + "/" + item
+			}
+			key := "prod/fakestopper/foo"
+			eval := conn.Command("EVALSHA", passScript.Hash(), 5, key, key+"#grace", key+"#blocked", key+"#limit", key+"#weights",
+				now.Add(stopper.Interval*-1).UnixNano(), now.UnixNano(), now.UnixNano(), int64(1), 0, stopper.Limit, durationMillis(stopper.Interval), stopper.Interval.Nanoseconds(), 0).
+				Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			_, err := stopper.Pass("foo")
+
+			Convey("Every key of the item derives from it", func() {
+				So(err, ShouldBeNil)
+				So(conn.Stats(eval), ShouldEqual, 1)
+				So(calls, ShouldEqual, 1)
+				So(stopper.Key("foo"), ShouldEqual, key)
+			})
+		})
+
+		Convey("When decisions are observed", func() {
+			type decision struct {
+				item    string
+				allowed bool
+				count   int64
+			}
+			var decisions []decision
+			stopper.OnDecision = func(item string, allowed bool, count int64) {
+				decisions = append(decisions, decision{item, allowed, count})
+			}
+
+			Convey("Each is reported", func() {
+				exec.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+				_, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				exec.Expect([]interface{}{int64(0), int64(6), int64(0), nil, nil, nil, nil, nil})
+				_, err = stopper.PassN("foo", 1)
+				So(err, ShouldBeNil)
+				So(decisions, ShouldResemble, []decision{{"foo", true, 1}, {"foo", false, 6}})
+			})
+
+			Convey("Failures are not", func() {
+				exec.ExpectError(errors.New("connection reset"))
+				_, err := stopper.Pass("foo")
+				So(err, ShouldNotBeNil)
+				So(decisions, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When redis fails to evaluate the script", func() {
+			failure := errors.New("connection reset")
+			exec.ExpectError(failure)
+
+			Convey("The error is returned by default", func() {
+				passed, err := stopper.Pass("foo")
+				So(errors.Is(err, failure), ShouldBeTrue)
+				So(passed, ShouldBeFalse)
+			})
+
+			Convey("When failing open", func() {
+				stopper.FailOpen = true
+				var reported []error
+				stopper.OnError = func(item string, err error) {
+					So(item, ShouldEqual, "foo")
+					reported = append(reported, err)
+				}
+				passed, err := stopper.Pass("foo")
+
+				Convey("The action passes and the error goes to the hook", func() {
+					So(err, ShouldBeNil)
+					So(passed, ShouldBeTrue)
+					So(reported, ShouldHaveLength, 1)
+					So(errors.Is(reported[0], failure), ShouldBeTrue)
+				})
+
+				Convey("A done context still fails", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					_, err := stopper.PassContext(ctx, "foo")
+					So(err, ShouldEqual, context.Canceled)
+				})
+			})
+		})
+
+		Convey("When I perform an action and ask for the remaining quota", func() {
+			exec.Expect([]interface{}{int64(0), int64(2), int64(0), nil, nil, nil, nil, nil})
+			passed, remaining, err := stopper.PassAndRemaining("foo")
+
+			Convey("Both come from a single script evaluation", func() {
 				So(err, ShouldEqual, nil)
 				So(passed, ShouldEqual, true)
+				So(remaining, ShouldEqual, 3)
+				So(conn.Stats(exec), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I exceed the rate and ask for the remaining quota", func() {
+			exec.Expect([]interface{}{int64(0), int64(6), int64(0), nil, nil, nil, nil, nil})
+			passed, remaining, err := stopper.PassAndRemaining("foo")
+
+			Convey("None should remain", func() {
+				So(err, ShouldEqual, nil)
+				So(passed, ShouldEqual, false)
+				So(remaining, ShouldEqual, 0)
 			})
 		})
 
@@ -71,8 +267,93 @@ func TestWithMockRedis(t *testing.T) {
 			})
 		})
 
+		Convey("When my context is already cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			Convey("Pass returns its error without talking to redis", func() {
+				passed, err := stopper.PassContext(ctx, "foo")
+				So(err, ShouldEqual, context.Canceled)
+				So(passed, ShouldEqual, false)
+				So(conn.Stats(exec), ShouldEqual, 0)
+			})
+
+			Convey("So does Peek", func() {
+				zcard := conn.Command("ZCARD", "fakestopper:foo").Expect(int64(0))
+				_, err := stopper.PeekContext(ctx, "foo")
+				So(err, ShouldEqual, context.Canceled)
+				So(conn.Stats(zcard), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I peek and redis replies nil", func() {
+			conn.Command("ZCARD", "fakestopper:foo").Expect(nil)
+			count, err := stopper.Peek("foo")
+
+			Convey("Count should be zero", func() {
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I ask for the remaining quota", func() {
+			conn.Command("ZCARD", "fakestopper:foo").Expect(int64(2))
+			remaining, err := stopper.Remaining("foo")
+
+			Convey("It is what the limit leaves of the count", func() {
+				So(err, ShouldEqual, nil)
+				So(remaining, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When I ask for the share of the limit used", func() {
+			conn.Command("ZCARD", "fakestopper:foo").Expect(int64(2))
+
+			Convey("It is the count over the limit", func() {
+				usage, err := stopper.Usage("foo")
+				So(err, ShouldBeNil)
+				So(usage, ShouldEqual, 0.4)
+			})
+
+			Convey("It never exceeds 1", func() {
+				conn.Command("ZCARD", "fakestopper:foo").Expect(int64(7))
+				usage, err := stopper.Usage("foo")
+				So(err, ShouldBeNil)
+				So(usage, ShouldEqual, 1)
+			})
+
+			Convey("It is 0 without a positive limit", func() {
+				stopper.Limit = 0
+				usage, err := stopper.Usage("foo")
+				So(err, ShouldBeNil)
+				So(usage, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the namespace contains the separator", func() {
+			other := newMockStopper(conn)
+			other.Namespace = "fakestopper:foo"
+			collider := newMockStopper(conn)
+
+			Convey("Its keys could collide with those of another namespace", func() {
+				So(other.Namespace+":bar", ShouldEqual, collider.Namespace+":foo:bar")
+			})
+
+			Convey("Pass should reject it without talking to redis", func() {
+				passed, err := other.Pass("bar")
+				So(err, ShouldEqual, ErrInvalidNamespace)
+				So(passed, ShouldEqual, false)
+				So(conn.Stats(exec), ShouldEqual, 0)
+			})
+
+			Convey("Peek should reject it", func() {
+				_, err := other.Peek("bar")
+				So(err, ShouldEqual, ErrInvalidNamespace)
+			})
+		})
+
 		Convey("When the rate is exceeded", func() {
-			exec.Expect([]interface{}{int64(0), int64(1), int64(6)})
+			exec.Expect([]interface{}{int64(0), int64(6), int64(0), nil, nil, nil, nil, nil})
 			passed, err := stopper.Pass("foo")
 
 			Convey("The action should not pass", func() {
@@ -88,32 +369,146 @@ func TestWithMockRedis(t *testing.T) {
 					So(count, ShouldEqual, 6)
 				})
 			})
+
+			Convey("None should remain", func() {
+				conn.Command("ZCARD", "fakestopper:foo").Expect(int64(6))
+				remaining, err := stopper.Remaining("foo")
+				So(err, ShouldEqual, nil)
+				So(remaining, ShouldEqual, 0)
+			})
 		})
 	})
 }
 
-func TestWithRealRedis(t *testing.T) {
+func TestNewStopper(t *testing.T) {
+	Convey("Given a connection pool", t, func() {
+		Convey("A valid configuration yields a ready stopper", func() {
+			stopper, err := NewStopper(&connPool, "constructed", 5*time.Second, 3)
+			So(err, ShouldBeNil)
+			So(stopper.Namespace, ShouldEqual, "constructed")
+			So(stopper.Interval, ShouldEqual, 5*time.Second)
+			So(stopper.Limit, ShouldEqual, 3)
+		})
 
-	redisServer := runRedisServer()
-	if redisServer == nil {
-		t.Fatal("redis-server didn't start")
-	}
-	defer func() { _ = redisServer.Process.Kill() }()
+		Convey("Invalid configurations are rejected", func() {
+			for _, tc := range []struct {
+				pool      *redis.Pool
+				namespace string
+				interval  time.Duration
+				limit     int64
+			}{
+				{nil, "constructed", 5 * time.Second, 3},
+				{&connPool, "", 5 * time.Second, 3},
+				{&connPool, "constructed", 0, 3},
+				{&connPool, "constructed", -time.Second, 3},
+				{&connPool, "constructed", 5 * time.Second, 0},
+				{&connPool, "constructed", 5 * time.Second, -1},
+			} {
+				_, err := NewStopper(tc.pool, tc.namespace, tc.interval, tc.limit)
+				So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			}
+		})
 
-	connPool := redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", fmt.Sprintf("localhost:%d", redisServerPort))
-		},
-	}
+		Convey("Namespaces containing the separator are rejected", func() {
+			_, err := NewStopper(&connPool, "app:v2", 5*time.Second, 3)
+			So(err, ShouldEqual, ErrInvalidNamespace)
+		})
 
-	flushall := func() {
-		conn := connPool.Get()
-		defer func() { _ = conn.Close() }()
-		_, err := conn.Do("FLUSHALL")
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
+		Convey("Unknown ZADD flags are rejected", func() {
+			_, err := NewStopper(&connPool, "constructed", 5*time.Second, 3, func(s *Stopper) { s.ZAddFlag = "XX" })
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Unknown clock rewind policies are rejected", func() {
+			_, err := NewStopper(&connPool, "constructed", 5*time.Second, 3, func(s *Stopper) { s.ClockRewind = RewindReject + 1 })
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Penalties out of range are rejected", func() {
+			for _, p := range []Penalty{
+				{Offenses: 0, Window: time.Minute, Base: time.Minute},
+				{Offenses: 2, Window: 0, Base: time.Minute},
+				{Offenses: 2, Window: time.Minute, Base: 0},
+				{Offenses: 2, Window: time.Minute, Base: time.Minute, Max: -time.Minute},
+			} {
+				p := p
+				_, err := NewStopper(&connPool, "constructed", 5*time.Second, 3, func(s *Stopper) { s.Penalty = &p })
+				So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			}
+			_, err := NewStopper(&connPool, "constructed", 5*time.Second, 3, func(s *Stopper) {
+				s.Penalty = &Penalty{Offenses: 2, Window: time.Minute, Base: time.Minute}
+			})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Separators containing a backslash are rejected", func() {
+			_, err := NewStopper(&connPool, "constructed", 5*time.Second, 3, func(s *Stopper) { s.Separator = `\` })
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Stoppers can be configured by a rate and a burst", func() {
+			s, err := NewRateStopper(&connPool, "constructed", 50, 100)
+			So(err, ShouldBeNil)
+			So(s.Limit, ShouldEqual, 100)
+			So(s.Interval, ShouldEqual, 2*time.Second)
+
+			s, err = NewRateStopper(&connPool, "constructed", 0.5, 1)
+			So(err, ShouldBeNil)
+			So(s.Interval, ShouldEqual, 2*time.Second)
+
+			for _, rate := range []float64{0, -1, math.Inf(1), math.NaN()} {
+				_, err := NewRateStopper(&connPool, "constructed", rate, 100)
+				So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			}
+			_, err = NewRateStopper(&connPool, "constructed", 50, 0)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Empty namespaces are rejected", func() {
+			_, err := NewStopper(&connPool, "", 5*time.Second, 3)
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "empty namespace")
+		})
+
+		Convey("Empty items are rejected without talking to redis", func() {
+			conn := redigomock.NewConn()
+			stopper := newMockStopper(conn)
+			stopper.FailOpen = true
+			eval := conn.GenericCommand("EVALSHA")
+			trim := conn.GenericCommand("ZREMRANGEBYSCORE")
+			_, err := stopper.Pass("")
+			So(err, ShouldEqual, ErrEmptyItem)
+			_, err = stopper.PassN("", 2)
+			So(err, ShouldEqual, ErrEmptyItem)
+			_, err = stopper.Peek("")
+			So(err, ShouldEqual, ErrEmptyItem)
+			So(conn.Stats(eval), ShouldEqual, 0)
+			So(conn.Stats(trim), ShouldEqual, 0)
+		})
+
+		Convey("A mock clock can be injected", func() {
+			flushRealRedis(t)
+			clock := clock.NewMockClock(now)
+			stopper, err := NewStopper(&connPool, "constructed", 5*time.Second, 1, WithClock(clock))
+			So(err, ShouldBeNil)
+
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			passed, err = stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+
+			clock.AddTime(stopper.Interval)
+			passed, err = stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		})
+	})
+}
+
+func TestWithRealRedis(t *testing.T) {
+	flushall := func() { flushRealRedis(t) }
 
 	Convey("Given a stopper", t, func() {
 		clock := clock.NewMockClock(now)
@@ -163,6 +558,68 @@ func TestWithRealRedis(t *testing.T) {
 				})
 			})
 
+			Convey("When I peek after the interval", func() {
+				clock.AddTime(stopper.Interval)
+				count, err := stopper.Peek("foo")
+
+				Convey("Expired actions are not counted", func() {
+					So(err, ShouldEqual, nil)
+					So(count, ShouldEqual, 0)
+				})
+			})
+
+			Convey("When I peek at the live actions", func() {
+				count, err := stopper.PeekLive("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+
+				Convey("Expired actions are not counted, but left in place", func() {
+					clock.AddTime(stopper.Interval)
+					count, err := stopper.PeekLive("foo")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 0)
+
+					conn := connPool.Get()
+					defer func() { _ = conn.Close() }()
+					stored, err := redis.Int64(conn.Do("ZCARD", stopper.Key("foo")))
+					So(err, ShouldBeNil)
+					So(stored, ShouldEqual, 3)
+				})
+			})
+
+			Convey("When I peek at the whole window", func() {
+				start := clock.Now()
+				clock.AddTime(time.Second)
+				r, err := stopper.PeekResult("foo")
+				So(err, ShouldBeNil)
+				So(r.Count, ShouldEqual, 3)
+				So(r.Limit, ShouldEqual, 3)
+				So(r.Remaining, ShouldEqual, 0)
+				So(r.Blocked, ShouldBeTrue)
+				reset := start.Add(stopper.Interval)
+				So(float64(r.Reset.Sub(reset)), ShouldAlmostEqual, 0, float64(time.Microsecond))
+
+				Convey("It is empty after the interval", func() {
+					clock.AddTime(stopper.Interval)
+					r, err := stopper.PeekResult("foo")
+					So(err, ShouldBeNil)
+					So(r, ShouldResemble, PeekResult{Limit: 3, Remaining: 3})
+				})
+
+				Convey("The window resets once its oldest action expires", func() {
+					at, err := stopper.ResetTime("foo")
+					So(err, ShouldBeNil)
+					So(float64(at.Sub(reset)), ShouldAlmostEqual, 0, float64(time.Microsecond))
+
+					Convey("And has room now once it is under the limit", func() {
+						clock.AddTime(stopper.Interval)
+						at, err := stopper.ResetTime("foo")
+						So(err, ShouldBeNil)
+						So(at, ShouldResemble, clock.Now().UTC())
+					})
+				})
+			})
+
 			Convey("The fourth action should fail", func() {
 				So(pass("foo"), ShouldEqual, false)
 
@@ -171,66 +628,889 @@ func TestWithRealRedis(t *testing.T) {
 					So(pass("foo"), ShouldEqual, true)
 				})
 			})
+
+			Convey("Hammering it past the limit does not keep the window full", func() {
+				for i := 0; i < 100; i++ {
+					clock.AddTime(time.Millisecond)
+					So(pass("foo"), ShouldEqual, false)
+				}
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+
+				clock.AddTime(stopper.Interval)
+				So(pass("foo"), ShouldEqual, true)
+			})
 		})
 
-		Convey("When my actions are blocked", func() {
+		Convey("When I perform actions at the same instant", func() {
 			flushall()
-			var results [4]bool
-			for i := 0; i < 4; i++ {
-				results[i] = pass("foo")
-			}
-			So(results, ShouldResemble, [4]bool{true, true, true, false})
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			passed, err = stopper.PassN("foo", 2)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
 
-			Convey("Other actions should still pass", func() {
-				var results [3]bool
-				for i := 0; i < 3; i++ {
-					results[i] = pass("bar")
+			Convey("Each is counted", func() {
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When the set contains members from before the interval", func() {
+			flushall()
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			windowStart := now.Add(stopper.Interval * -1).UnixNano()
+			for _, score := range []int64{windowStart - int64(time.Millisecond), windowStart, windowStart + int64(time.Millisecond)} {
+				if _, err := conn.Do("ZADD", "realstopper:foo", score, score); err != nil {
+					t.Fatal(err)
 				}
-				So(results, ShouldResemble, [3]bool{true, true, true})
+			}
+
+			Convey("The stale members are not counted", func() {
+				count, err := redis.Int64(conn.Do("ZCOUNT", "realstopper:foo", exclusive(windowStart), "+inf"))
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 1)
 			})
 		})
-	})
 
-	Convey("Given a stopper without an explicit clock", t, func() {
-		stopper := Stopper{
-			Namespace: "realstopperwithclock",
-			Interval:  5 * time.Second,
-			Limit:     int64(3),
-			ConnPool:  &connPool,
-		}
+		Convey("When stale members are trimmed", func() {
+			flushall()
+			var trimmed []int64
+			stopper.OnTrim = func(item string, n int64) {
+				So(item, ShouldEqual, "foo")
+				trimmed = append(trimmed, n)
+			}
+			pass("foo")
+			pass("foo")
+			clock.AddTime(stopper.Interval)
+			pass("foo")
 
-		Convey("It still works", func() {
+			Convey("The trimmed counts are reported", func() {
+				So(trimmed, ShouldResemble, []int64{0, 0, 2})
+			})
+		})
+
+		Convey("When the latency of redis is measured", func() {
+			flushall()
+			var ops []string
+			var total time.Duration
+			stopper.OnLatency = func(op string, d time.Duration) {
+				ops = append(ops, op)
+				total += d
+			}
+			pass("foo")
+			_, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+
+			Convey("Each operation is reported on the monotonic clock", func() {
+				So(ops, ShouldResemble, []string{"pass", "peek"})
+				So(total, ShouldBeGreaterThan, 0)
+			})
+		})
+
+		Convey("When I perform an action the window expires once idle", func() {
+			flushall()
+			So(pass("foo"), ShouldEqual, true)
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			ttl, err := redis.Int64(conn.Do("PTTL", "realstopper:foo"))
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeGreaterThan, int64(stopper.Interval/time.Millisecond)-1000)
+			So(ttl, ShouldBeLessThanOrEqualTo, int64(stopper.Interval/time.Millisecond))
+		})
+
+		Convey("When my blocked actions are reset", func() {
 			flushall()
-			var results [4]bool
 			for i := 0; i < 4; i++ {
-				passed, err := stopper.Pass("foo")
-				if err != nil {
-					t.Fatal(err)
-				}
-				results[i] = passed
+				pass("foo")
 			}
-			So(results, ShouldResemble, [4]bool{true, true, true, false})
+			So(stopper.Reset("foo"), ShouldBeNil)
+
+			Convey("The window starts afresh", func() {
+				var results [4]bool
+				for i := 0; i < 4; i++ {
+					results[i] = pass("foo")
+				}
+				So(results, ShouldResemble, [4]bool{true, true, true, false})
+			})
+
+			Convey("Resetting again does nothing", func() {
+				So(stopper.Reset("foo"), ShouldBeNil)
+				So(stopper.Reset("unknown"), ShouldBeNil)
+			})
 		})
-	})
 
-}
+		Convey("When my actions are reset with a grace period", func() {
+			flushall()
+			for i := 0; i < 4; i++ {
+				pass("foo")
+			}
+			if err := stopper.ResetWithGrace("foo", time.Second); err != nil {
+				t.Fatal(err)
+			}
 
-func runRedisServer() *exec.Cmd {
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	redisServer := exec.Command("redis-server", "--port", fmt.Sprintf("%d", redisServerPort))
-	redisServer.Stdout = &stdout
-	redisServer.Stderr = &stderr
+			Convey("All actions pass during the grace period", func() {
+				for i := 0; i < 10; i++ {
+					So(pass("foo"), ShouldEqual, true)
+				}
 
-	err := redisServer.Start()
-	if err != nil {
-		fmt.Println(err)
-		return nil
-	}
-	go func() {
-		err := redisServer.Wait()
-		if err != nil {
-			fmt.Printf("STDOUT: %s\n\nSTDERR: %s\n", stdout.String(), stderr.String())
+				Convey("And are limited again once it ends", func() {
+					clock.AddTime(time.Second)
+					So(pass("foo"), ShouldEqual, false)
+				})
+			})
+
+			Convey("Resetting again ends the grace period", func() {
+				So(stopper.Reset("foo"), ShouldBeNil)
+				for i := int64(0); i < stopper.Limit; i++ {
+					So(pass("foo"), ShouldEqual, true)
+				}
+				So(pass("foo"), ShouldEqual, false)
+			})
+
+			Convey("The window is bounded by MaxStored", func() {
+				stopper.MaxStored = stopper.Limit + 2
+				for i := 0; i < 10; i++ {
+					So(pass("foo"), ShouldEqual, true)
+				}
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, stopper.Limit+2)
+			})
+		})
+
+		Convey("Actions are recorded with the ZAddFlag", func() {
+			flushall()
+			stopper.ZAddFlag = ZAddNX
+			for i := int64(0); i < stopper.Limit; i++ {
+				So(pass("foo"), ShouldEqual, true)
+			}
+			So(pass("foo"), ShouldEqual, false)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, stopper.Limit)
+		})
+
+		Convey("A MaxStored below the limit doesn't change decisions", func() {
+			flushall()
+			stopper.MaxStored = 1
+			for i := int64(0); i < stopper.Limit; i++ {
+				So(pass("foo"), ShouldEqual, true)
+			}
+			So(pass("foo"), ShouldEqual, false)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, stopper.Limit)
+		})
+
+		Convey("When the stopper has a free allowance", func() {
+			flushall()
+			stopper.FreeAllowance = 2
+
+			Convey("The first actions are free", func() {
+				So(pass("foo"), ShouldEqual, true)
+				So(pass("foo"), ShouldEqual, true)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldEqual, nil)
+				So(count, ShouldEqual, 0)
+
+				Convey("And subsequent ones are limited normally", func() {
+					var results [4]bool
+					for i := 0; i < 4; i++ {
+						results[i] = pass("foo")
+					}
+					So(results, ShouldResemble, [4]bool{true, true, true, false})
+				})
+			})
+
+			Convey("The used allowance is forgotten once the item is idle", func() {
+				stopper.FreeAllowanceTTL = time.Minute
+				pass("foo")
+				conn := connPool.Get()
+				defer func() { _ = conn.Close() }()
+				ttl, err := redis.Int64(conn.Do("PTTL", "realstopper:foo#free"))
+				So(err, ShouldBeNil)
+				So(ttl, ShouldBeGreaterThan, 0)
+				So(ttl, ShouldBeLessThanOrEqualTo, time.Minute.Milliseconds())
+			})
+		})
+
+		Convey("When my actions are blocked", func() {
+			flushall()
+			var results [4]bool
+			for i := 0; i < 4; i++ {
+				results[i] = pass("foo")
+			}
+			So(results, ShouldResemble, [4]bool{true, true, true, false})
+
+			Convey("Other actions should still pass", func() {
+				var results [3]bool
+				for i := 0; i < 3; i++ {
+					results[i] = pass("bar")
+				}
+				So(results, ShouldResemble, [3]bool{true, true, true})
+			})
+		})
+
+		Convey("When I ask how long until the next action passes", func() {
+			flushall()
+			retryAfter := func() time.Duration {
+				wait, err := stopper.RetryAfter("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return wait
+			}
+
+			Convey("It is zero for an empty window", func() {
+				So(retryAfter(), ShouldEqual, 0)
+			})
+
+			Convey("It is zero while under the limit", func() {
+				So(pass("foo"), ShouldEqual, true)
+				So(retryAfter(), ShouldEqual, 0)
+			})
+
+			Convey("It is the time until the oldest action expires once the limit is reached", func() {
+				for i := 0; i < 3; i++ {
+					clock.AddTime(time.Millisecond)
+					So(pass("foo"), ShouldEqual, true)
+				}
+				clock.AddTime(time.Millisecond)
+				So(float64(retryAfter()), ShouldAlmostEqual, float64(stopper.Interval-3*time.Millisecond), float64(time.Microsecond))
+
+				Convey("And zero once the window has expired", func() {
+					clock.AddTime(stopper.Interval)
+					So(retryAfter(), ShouldEqual, 0)
+					So(pass("foo"), ShouldEqual, true)
+				})
+			})
+		})
+
+		Convey("When I grant extra quota", func() {
+			flushall()
+			for i := 0; i < 3; i++ {
+				So(pass("foo"), ShouldEqual, true)
+			}
+			So(pass("foo"), ShouldEqual, false)
+
+			Convey("The oldest actions make room", func() {
+				So(stopper.Grant("foo", 2), ShouldBeNil)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+				So(pass("foo"), ShouldEqual, true)
+				So(pass("foo"), ShouldEqual, true)
+				So(pass("foo"), ShouldEqual, false)
+			})
+
+			Convey("Granting more than the window holds empties it", func() {
+				So(stopper.Grant("foo", 10), ShouldBeNil)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			})
+
+			Convey("Granting nothing leaves the window alone", func() {
+				So(stopper.Grant("foo", 0), ShouldBeNil)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When I ask when the window started", func() {
+			flushall()
+			windowStart := func() time.Time {
+				start, err := stopper.WindowStart("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return start
+			}
+
+			Convey("It is the zero time for an empty window", func() {
+				So(windowStart().IsZero(), ShouldBeTrue)
+			})
+
+			Convey("It is the time of the oldest live action", func() {
+				So(pass("foo"), ShouldEqual, true)
+				first := clock.Now()
+				clock.AddTime(time.Second)
+				So(pass("foo"), ShouldEqual, true)
+				second := clock.Now()
+				So(float64(windowStart().Sub(first)), ShouldAlmostEqual, 0, float64(time.Microsecond))
+				So(windowStart().Location(), ShouldEqual, time.UTC)
+
+				Convey("Skipping expired actions", func() {
+					clock.AddTime(stopper.Interval - time.Second)
+					So(float64(windowStart().Sub(second)), ShouldAlmostEqual, 0, float64(time.Microsecond))
+				})
+			})
+		})
+
+		Convey("When I ask for the detailed result", func() {
+			flushall()
+			passResult := func() PassResult {
+				clock.AddTime(time.Millisecond)
+				r, err := stopper.PassResult("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return r
+			}
+
+			Convey("It describes the window after each decision", func() {
+				So(passResult(), ShouldResemble, PassResult{Allowed: true, Limit: 3, Count: 1, Remaining: 2, At: clock.Now().UTC()})
+				So(passResult(), ShouldResemble, PassResult{Allowed: true, Limit: 3, Count: 2, Remaining: 1, At: clock.Now().UTC()})
+
+				r := passResult()
+				So(r.Allowed, ShouldBeTrue)
+				So(r.Remaining, ShouldEqual, 0)
+				So(float64(r.RetryAfter), ShouldAlmostEqual, float64(stopper.Interval-2*time.Millisecond), float64(time.Microsecond))
+
+				r = passResult()
+				So(r.Allowed, ShouldBeFalse)
+				So(r.Count, ShouldEqual, 4)
+				wait, err := stopper.RetryAfter("foo")
+				So(err, ShouldBeNil)
+				So(float64(r.RetryAfter), ShouldAlmostEqual, float64(wait), float64(time.Microsecond))
+			})
+
+			Convey("Only the first rejection tells it tripped the limit", func() {
+				for i := 0; i < 3; i++ {
+					So(passResult().JustBlocked, ShouldBeFalse)
+				}
+				r := passResult()
+				So(r.Allowed, ShouldBeFalse)
+				So(r.JustBlocked, ShouldBeTrue)
+				So(passResult().JustBlocked, ShouldBeFalse)
+
+				Convey("Until actions pass again", func() {
+					clock.AddTime(stopper.Interval)
+					r := passResult()
+					So(r.Allowed, ShouldBeTrue)
+					So(r.JustUnblocked, ShouldBeTrue)
+					So(passResult().JustUnblocked, ShouldBeFalse)
+					So(passResult().Allowed, ShouldBeTrue)
+					So(passResult().JustBlocked, ShouldBeTrue)
+				})
+			})
+
+			Convey("Only transitions are reported when asked to", func() {
+				type decision struct {
+					allowed bool
+					count   int64
+				}
+				var decisions []decision
+				stopper.OnDecision = func(item string, allowed bool, count int64) {
+					decisions = append(decisions, decision{allowed, count})
+				}
+				stopper.DecisionSampling = TransitionsOnly
+				Reset(func() {
+					stopper.OnDecision = nil
+					stopper.DecisionSampling = EveryDecision
+				})
+
+				for i := 0; i < 5; i++ {
+					passResult()
+				}
+				clock.AddTime(stopper.Interval)
+				passResult()
+				passResult()
+				So(decisions, ShouldResemble, []decision{{false, 4}, {true, 1}})
+				So(stopper.Stats(), ShouldResemble, Stats{Allowed: 5, Blocked: 2})
+			})
+		})
+
+		Convey("When I pass weighted actions", func() {
+			flushall()
+			passN := func(item string, n int64) bool {
+				clock.AddTime(time.Millisecond)
+				passed, err := stopper.PassN(item, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return passed
+			}
+
+			Convey("Each accounts for its weight", func() {
+				So(passN("foo", 2), ShouldEqual, true)
+				So(passN("foo", 2), ShouldEqual, false)
+				So(passN("foo", 1), ShouldEqual, true)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+			})
+
+			Convey("Units sharing a timestamp do not collide", func() {
+				So(passN("foo", 3), ShouldEqual, true)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 3)
+			})
+
+			Convey("Asking for more than the limit is rejected without filling the window", func() {
+				So(passN("foo", 4), ShouldEqual, false)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+
+				Convey("Or writing anything, however much is asked for", func() {
+					flushall()
+					r, err := stopper.pass(context.Background(), CheckRequest{Item: "foo", Cost: 1 << 40}, nil)
+					So(err, ShouldBeNil)
+					So(r.Allowed, ShouldBeFalse)
+					So(r.JustBlocked, ShouldBeFalse)
+					So(r.Count, ShouldEqual, 1<<40)
+					conn := connPool.Get()
+					defer func() { _ = conn.Close() }()
+					keys, err := redis.Strings(conn.Do("KEYS", "*"))
+					So(err, ShouldBeNil)
+					So(keys, ShouldBeEmpty)
+				})
+
+				Convey("Even during a grace period", func() {
+					So(stopper.ResetWithGrace("foo", time.Second), ShouldBeNil)
+					So(passN("foo", 4), ShouldEqual, false)
+					So(passN("foo", 3), ShouldEqual, true)
+				})
+			})
+		})
+	})
+
+	Convey("Given a stopper passing items with their own quotas", t, func() {
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "realstopperquotas",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		passWith := func(item string, limit int64, interval time.Duration) bool {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.PassWith(item, limit, interval)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("The limit given is enforced", func() {
+			flushall()
+			So(passWith("foo", 1, 0), ShouldEqual, true)
+			So(passWith("foo", 1, 0), ShouldEqual, false)
+			So(passWith("foo", 0, 0), ShouldEqual, true)
+		})
+
+		Convey("The interval given bounds the window", func() {
+			flushall()
+			So(passWith("foo", 1, time.Second), ShouldEqual, true)
+			So(passWith("foo", 1, time.Second), ShouldEqual, false)
+			clock.AddTime(time.Second)
+			So(passWith("foo", 1, time.Second), ShouldEqual, true)
+		})
+
+		Convey("With a key per interval", func() {
+			flushall()
+			stopper.IntervalKeys = true
+			So(stopper.Key("foo"), ShouldEqual, "realstopperquotas:foo@5s")
+
+			Convey("Windows of different intervals are kept apart", func() {
+				So(passWith("foo", 1, time.Second), ShouldEqual, true)
+				So(passWith("foo", 1, time.Second), ShouldEqual, false)
+				So(passWith("foo", 1, 0), ShouldEqual, true)
+				So(passWith("foo", 1, 0), ShouldEqual, false)
+
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+				items, err := stopper.ActiveItems()
+				So(err, ShouldBeNil)
+				So(items, ShouldResemble, []string{"foo"})
+			})
+
+			Convey("Changing the Interval starts from empty windows", func() {
+				for i := 0; i < 3; i++ {
+					So(passWith("foo", 0, 0), ShouldEqual, true)
+				}
+				So(passWith("foo", 0, 0), ShouldEqual, false)
+				stopper.Interval = 10 * time.Second
+				So(passWith("foo", 0, 0), ShouldEqual, true)
+			})
+		})
+	})
+
+	Convey("Given a stopper checked without recording", t, func() {
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "realstoppercheck",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		check := func() bool {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.Check("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Checks never change the window", func() {
+			flushall()
+			for i := 0; i < 5; i++ {
+				So(check(), ShouldEqual, true)
+			}
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+
+			Convey("But tell whether an action would pass", func() {
+				for i := 0; i < 2; i++ {
+					passed, err := stopper.Pass("foo")
+					So(err, ShouldBeNil)
+					So(passed, ShouldEqual, true)
+					clock.AddTime(time.Millisecond)
+				}
+				So(check(), ShouldEqual, false)
+				So(check(), ShouldEqual, false)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+			})
+		})
+
+		Convey("An item is blocked exactly once its count equals the limit", func() {
+			flushall()
+			blocked := func() bool {
+				b, err := stopper.IsBlocked("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+			So(blocked(), ShouldBeFalse)
+			_, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(blocked(), ShouldBeFalse)
+			_, err = stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(blocked(), ShouldBeTrue)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+
+			Convey("And no longer once its actions expire", func() {
+				clock.AddTime(stopper.Interval)
+				So(blocked(), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given a stopper replaying events", t, func() {
+		stopper := Stopper{
+			Namespace: "realstopperreplay",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock.NewMockClock(now),
+		}
+		passAt := func(at time.Time) bool {
+			passed, err := stopper.PassAt("foo", at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Each is decided at the time given rather than the clock's", func() {
+			flushall()
+			past := now.Add(-time.Hour)
+			So(passAt(past), ShouldEqual, true)
+			So(passAt(past.Add(time.Second)), ShouldEqual, true)
+			So(passAt(past.Add(2*time.Second)), ShouldEqual, false)
+			So(passAt(past.Add(5*time.Second)), ShouldEqual, true)
+
+			remaining, err := stopper.Remaining("foo")
+			So(err, ShouldBeNil)
+			So(remaining, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given a stopper limiting items of several parts", t, func() {
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "realstopperparts",
+			Interval:  5 * time.Second,
+			Limit:     int64(1),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		passKey := func(parts ...string) bool {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.PassKey(parts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Parts containing the separator don't collide", func() {
+			flushall()
+			So(passKey("a:b", "c"), ShouldEqual, true)
+			So(passKey("a", "b:c"), ShouldEqual, true)
+			So(passKey("a:b", "c"), ShouldEqual, false)
+			So(joinParts(":", []string{"a:b", "c"}), ShouldEqual, `a\:b:c`)
+			So(joinParts(":", []string{`a\`, "b"}), ShouldNotEqual, joinParts(":", []string{"a", `\b`}))
+			So(joinParts("/", []string{"a/b", "c:d"}), ShouldEqual, `a\/b/c:d`)
+		})
+
+		Convey("A single part is the same item as for Pass", func() {
+			flushall()
+			So(passKey("foo"), ShouldEqual, true)
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldEqual, false)
+		})
+	})
+
+	Convey("Given a stopper without an explicit clock", t, func() {
+		stopper := Stopper{
+			Namespace: "realstopperwithclock",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+		}
+
+		Convey("It still works", func() {
+			flushall()
+			var results [4]bool
+			for i := 0; i < 4; i++ {
+				passed, err := stopper.Pass("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				results[i] = passed
+			}
+			So(results, ShouldResemble, [4]bool{true, true, true, false})
+		})
+
+		Convey("It follows the package's Now", func() {
+			flushall()
+			mock := clock.NewMockClock(now)
+			defaultNow := Now
+			Now = mock.Now
+			Reset(func() { Now = defaultNow })
+
+			for i := 0; i < 3; i++ {
+				mock.AddTime(time.Millisecond)
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+
+			mock.AddTime(stopper.Interval)
+			passed, err = stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+
+			Convey("Unless a clock of its own is injected", func() {
+				own := Stopper{
+					Namespace: "realstopperwithclock",
+					Interval:  5 * time.Second,
+					Limit:     int64(3),
+					ConnPool:  &connPool,
+					c:         clock.NewMockClock(now.Add(time.Hour)),
+				}
+				count, err := own.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given a stopper shared by several namespaces", t, func() {
+		flushall()
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "realstopperns",
+			Interval:  5 * time.Second,
+			Limit:     int64(1),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+
+		Convey("Each namespace keeps windows of its own", func() {
+			for _, ns := range []string{"login", "api"} {
+				passed, err := stopper.PassNS(ns, "foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+			passed, err := stopper.PassNS("login", "foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+			passed, err = stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			count, err := redis.Int64(conn.Do("ZCARD", "login:foo"))
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("Namespaces are validated", func() {
+			_, err := stopper.PassNS("app:v2", "foo")
+			So(err, ShouldEqual, ErrInvalidNamespace)
+			_, err = stopper.PassNS("", "foo")
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a stopper whose clock goes back", t, func() {
+		flushall()
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "realstopperrewind",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		clock.AddTime(time.Second)
+		first, err := stopper.PassResult("foo")
+		So(err, ShouldBeNil)
+		clock.AddTime(-500 * time.Millisecond)
+
+		Convey("By default the action is recorded at the earlier time", func() {
+			r, err := stopper.PassResult("foo")
+			So(err, ShouldBeNil)
+			So(r.At, ShouldEqual, clock.Now().UTC())
+		})
+
+		Convey("Clamping records it at the time of the newest one", func() {
+			stopper.ClockRewind = RewindClamp
+			r, err := stopper.PassResult("foo")
+			So(err, ShouldBeNil)
+			So(r.Allowed, ShouldBeTrue)
+			So(r.At, ShouldEqual, first.At)
+
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			scores, err := redis.Strings(conn.Do("ZRANGE", stopper.Key("foo"), 0, -1, "WITHSCORES"))
+			So(err, ShouldBeNil)
+			So(scores[1], ShouldEqual, scores[3])
+		})
+
+		Convey("Rejecting fails with a typed error until the clock caught up", func() {
+			stopper.ClockRewind = RewindReject
+			stopper.FailOpen = true
+			_, err := stopper.PassResult("foo")
+			var rerr *ClockRewindError
+			So(errors.As(err, &rerr), ShouldBeTrue)
+			So(rerr.At, ShouldEqual, clock.Now().UTC())
+			So(rerr.Newest, ShouldEqual, first.At)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			clock.AddTime(time.Second)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given stoppers of various limits", t, func() {
+		for _, limit := range []int64{1, 2, 5} {
+			flushall()
+			clock := clock.NewMockClock(now)
+			stopper := Stopper{
+				Namespace: "realstopperboundary",
+				Interval:  5 * time.Second,
+				Limit:     limit,
+				ConnPool:  &connPool,
+				c:         clock,
+			}
+
+			var admitted int64
+			for i := int64(0); i <= limit; i++ {
+				clock.AddTime(time.Millisecond)
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				if passed {
+					admitted++
+				}
+			}
+			So(admitted, ShouldEqual, limit)
+		}
+	})
+
+	Convey("Given a stopper using the redis server's time", t, func() {
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace:     "realstopperservertime",
+			Interval:      5 * time.Second,
+			Limit:         int64(3),
+			ConnPool:      &connPool,
+			UseServerTime: true,
+			c:             clock,
+		}
+
+		Convey("It ignores the local clock", func() {
+			flushall()
+			var results [4]bool
+			for i := 0; i < 4; i++ {
+				clock.AddTime(time.Millisecond)
+				passed, err := stopper.Pass("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				results[i] = passed
+			}
+			So(results, ShouldResemble, [4]bool{true, true, true, false})
+
+			conn := connPool.Get()
+			defer conn.Close()
+			values, err := redis.Strings(conn.Do("ZRANGE", "realstopperservertime:foo", 0, 0, "WITHSCORES"))
+			So(err, ShouldBeNil)
+			score, err := strconv.ParseFloat(values[1], 64)
+			So(err, ShouldBeNil)
+			So(time.Since(time.Unix(0, int64(score))), ShouldBeLessThan, time.Minute)
+		})
+	})
+
+}
+
+func runRedisServer() *exec.Cmd {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	redisServer := exec.Command("redis-server", "--port", fmt.Sprintf("%d", redisServerPort))
+	redisServer.Stdout = &stdout
+	redisServer.Stderr = &stderr
+
+	err := redisServer.Start()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	go func() {
+		err := redisServer.Wait()
+		if err != nil {
+			fmt.Printf("STDOUT: %s\n\nSTDERR: %s\n", stdout.String(), stderr.String())
 		}
 	}()
 	attempt := 0
@@ -252,3 +1532,310 @@ func runRedisServer() *exec.Cmd {
 	}
 	return redisServer
 }
+
+func TestSoftLimit(t *testing.T) {
+	Convey("Given a stopper with a soft limit", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		stopper.Limit = 10
+		stopper.SoftLimit = 4
+		stopper.Rand = rand.New(rand.NewSource(1)).Float64
+		exec := expectPass(conn, stopper, "foo")
+		zrem := conn.Command("ZREM", "fakestopper:foo", strconv.FormatInt(now.UnixNano(), 10)).Expect(int64(1))
+
+		Convey("The drop probability rises from the soft to the hard limit", func() {
+			So(stopper.DropProbability(4), ShouldEqual, 0)
+			So(stopper.DropProbability(5), ShouldAlmostEqual, 1.0/7)
+			So(stopper.DropProbability(10), ShouldAlmostEqual, 6.0/7)
+			So(stopper.DropProbability(11), ShouldEqual, 1)
+		})
+
+		Convey("Actions up to the soft limit always pass", func() {
+			exec.Expect([]interface{}{int64(0), int64(4), int64(0), nil, nil, nil, now.UnixNano(), strconv.FormatInt(now.UnixNano(), 10)})
+			for i := 0; i < 1000; i++ {
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+		})
+
+		Convey("Actions beyond the soft limit are dropped at the expected rate", func() {
+			exec.Expect([]interface{}{int64(0), int64(7), int64(0), nil, nil, nil, now.UnixNano(), strconv.FormatInt(now.UnixNano(), 10)})
+			const calls = 10000
+			dropped := 0
+			for i := 0; i < calls; i++ {
+				passed, err := stopper.Pass("foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !passed {
+					dropped++
+				}
+			}
+			So(float64(dropped)/calls, ShouldAlmostEqual, stopper.DropProbability(7), 0.02)
+
+			Convey("And dropped actions are taken back from the window", func() {
+				So(conn.Stats(zrem), ShouldEqual, dropped)
+			})
+		})
+	})
+}
+
+// blockingConn is a connection which blocks EVALSHA until released.
+type blockingConn struct {
+	redis.Conn
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "EVALSHA" {
+		close(c.entered)
+		<-c.release
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+func TestLimitBounds(t *testing.T) {
+	Convey("Given a stopper which can't reach redis", t, func() {
+		stopper := newMockStopper(nil)
+		stopper.ConnPool = &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return nil, errors.New("redis was asked")
+			},
+		}
+
+		Convey("A limit of zero or less rejects every action", func() {
+			for _, limit := range []int64{0, -1} {
+				stopper.Limit = limit
+				r, err := stopper.PassResult("foo")
+				So(err, ShouldBeNil)
+				So(r, ShouldResemble, PassResult{Limit: limit})
+			}
+			So(stopper.Stats(), ShouldResemble, Stats{Blocked: 2})
+		})
+
+		Convey("An unlimited stopper lets every action through", func() {
+			stopper.Unlimited = true
+			for i := 0; i < 10; i++ {
+				r, err := stopper.PassResult("foo")
+				So(err, ShouldBeNil)
+				So(r, ShouldResemble, PassResult{Allowed: true, Limit: 5})
+			}
+
+			Convey("Even with a limit closing the gate", func() {
+				stopper.Limit = 0
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			})
+		})
+
+		Convey("Items are still validated", func() {
+			stopper.Limit = 0
+			_, err := stopper.Pass("")
+			So(err, ShouldEqual, ErrEmptyItem)
+		})
+	})
+}
+
+func TestPing(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+
+		Convey("Ping succeeds while redis answers", func() {
+			ping := conn.Command("PING").Expect("PONG")
+			So(stopper.Ping(context.Background()), ShouldBeNil)
+			So(conn.Stats(ping), ShouldEqual, 1)
+		})
+
+		Convey("Ping fails when redis does not", func() {
+			failure := errors.New("LOADING Redis is loading the dataset in memory")
+			conn.Command("PING").ExpectError(failure)
+			So(errors.Is(stopper.Ping(context.Background()), failure), ShouldBeTrue)
+		})
+
+		Convey("Ping gives up once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(stopper.Ping(ctx), ShouldEqual, context.Canceled)
+		})
+	})
+
+	Convey("Given a stopper on a real redis", t, func() {
+		stopper := &Stopper{Namespace: "ping", Interval: time.Second, Limit: 1, ConnPool: &connPool}
+		So(stopper.Ping(context.Background()), ShouldBeNil)
+	})
+}
+
+func TestPreload(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+
+		Convey("Preload loads every script of the stopper", func() {
+			var loads []*redigomock.Cmd
+			for _, sc := range stopperScripts {
+				loads = append(loads, conn.Command("SCRIPT", "LOAD", sc.source).Expect(sc.Hash()))
+			}
+			So(stopper.Preload(context.Background()), ShouldBeNil)
+			for _, load := range loads {
+				So(conn.Stats(load), ShouldEqual, 1)
+			}
+		})
+
+		Convey("Preload fails should redis disagree on a digest", func() {
+			conn.GenericCommand("SCRIPT").Expect("0000")
+			So(stopper.Preload(context.Background()), ShouldNotBeNil)
+		})
+
+		Convey("Preload gives up once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(stopper.Preload(ctx), ShouldEqual, context.Canceled)
+		})
+	})
+
+	Convey("Given a stopper on a real redis", t, func() {
+		flushRealRedis(t)
+		stopper := &Stopper{Namespace: "preload", Interval: time.Second, Limit: 1, ConnPool: &connPool}
+		So(stopper.Preload(context.Background()), ShouldBeNil)
+
+		conn := connPool.Get()
+		defer func() { _ = conn.Close() }()
+		exists, err := redis.Ints(conn.Do("SCRIPT", "EXISTS", passScript.Hash()))
+		So(err, ShouldBeNil)
+		So(exists, ShouldResemble, []int{1})
+	})
+}
+
+func TestClose(t *testing.T) {
+	Convey("Given a stopper with an action in flight", t, func() {
+		ignore := goleak.IgnoreCurrent()
+		mock := redigomock.NewConn()
+		conn := &blockingConn{Conn: mock, entered: make(chan struct{}), release: make(chan struct{})}
+		stopper := newMockStopper(mock)
+		stopper.ConnPool = &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		}
+		expectPass(mock, stopper, "foo").Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+
+		result := make(chan bool)
+		go func() {
+			passed, _ := stopper.Pass("foo")
+			result <- passed
+		}()
+		<-conn.entered
+
+		Convey("When I close it", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := stopper.Close(ctx)
+
+			Convey("It waits for the action until the context is done", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+			})
+
+			Convey("New actions are refused", func() {
+				_, err := stopper.Pass("foo")
+				So(err, ShouldEqual, ErrClosed)
+				_, err = stopper.Peek("foo")
+				So(err, ShouldEqual, ErrClosed)
+			})
+
+			Convey("Once the action finishes closing completes without leaking goroutines", func() {
+				close(conn.release)
+				So(<-result, ShouldBeTrue)
+				So(stopper.Close(context.Background()), ShouldBeNil)
+				goleak.VerifyNone(t, ignore)
+			})
+		})
+
+		Reset(func() {
+			select {
+			case <-conn.release:
+			default:
+				close(conn.release)
+				<-result
+			}
+		})
+	})
+
+	Convey("Given a stopper dialing redis itself", t, func() {
+		stopper, err := DialStopper(fmt.Sprintf("localhost:%d", redisServerPort), "dialed", 5*time.Second, 3)
+		So(err, ShouldBeNil)
+		passed, err := stopper.Pass("foo")
+		So(err, ShouldBeNil)
+		So(passed, ShouldBeTrue)
+
+		Convey("Closing it closes its pool", func() {
+			So(stopper.Close(context.Background()), ShouldBeNil)
+			So(stopper.ConnPool.Get().Err(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a stopper using the caller's pool", t, func() {
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", fmt.Sprintf("localhost:%d", redisServerPort))
+			},
+		}
+		defer func() { _ = pool.Close() }()
+		stopper, err := NewStopper(pool, "shared", 5*time.Second, 3)
+		So(err, ShouldBeNil)
+
+		Convey("Closing it leaves the pool open", func() {
+			So(stopper.Close(context.Background()), ShouldBeNil)
+			conn := pool.Get()
+			defer func() { _ = conn.Close() }()
+			So(conn.Err(), ShouldBeNil)
+		})
+	})
+}
+
+// benchmarkPool keeps its connections, so that benchmarks measure the
+// limiter rather than dialing redis.
+var benchmarkPool = redis.Pool{MaxIdle: 64, Dial: connPool.Dial}
+
+func BenchmarkPass(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: int64(b.N + 1), ConnPool: &benchmarkPool}
+	items := benchmarkItems()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stopper.Pass(items[i%len(items)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPassHotKey measures the contention of goroutines passing the
+// same item at once.
+func BenchmarkPassHotKey(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: int64(b.N + 1), ConnPool: &benchmarkPool}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := stopper.Pass("hot"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkPeek(b *testing.B) {
+	stopper := Stopper{Namespace: "bench", Interval: time.Second, Limit: 1, ConnPool: &benchmarkPool}
+	items := benchmarkItems()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stopper.Peek(items[i%len(items)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Package flowstopperecho rate-limits Echo servers with flowstopper. It
+// lives in its own package so that users of flowstopper don't have to depend
+// on Echo.
+package flowstopperecho
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zoni/flowstopper"
+)
+
+// Middleware returns Echo middleware passing each request through s under
+// the item keyFunc derives from it. Every decided request carries the
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers,
+// the latter holding the number of seconds until another request would
+// pass, all taken from a single call to PassResult. Requests exceeding the
+// rate-limit fail with an *echo.HTTPError of 429 Too Many Requests, along
+// with a Retry-After header. Should s fail, requests fail with 503 Service
+// Unavailable unless s.FailOpen is set, with the Retry-After of
+// s.ErrorRetryAfter, like with the Middleware of s.
+func Middleware(s *flowstopper.Stopper, keyFunc func(echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r, err := s.PassResult(keyFunc(c))
+			if err != nil {
+				flowstopper.WriteRetryAfter(c.Response().Header(), s.ErrorRetryAfter)
+				return echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(err)
+			}
+			flowstopper.WriteHeaders(c.Response().Header(), r, flowstopper.LegacyHeaders)
+			if !r.Allowed {
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
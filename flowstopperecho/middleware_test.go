@@ -0,0 +1,81 @@
+package flowstopperecho
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/labstack/echo/v4"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zoni/flowstopper"
+)
+
+func TestMiddleware(t *testing.T) {
+	Convey("Given a handler behind the middleware", t, func() {
+		conn := redigomock.NewConn()
+		stopper := &flowstopper.Stopper{
+			ConnPool: &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return conn, nil
+				},
+			},
+			Namespace: "echo",
+			Interval:  5 * time.Second,
+			Limit:     2,
+		}
+		eval := conn.GenericCommand("EVALSHA")
+		e := echo.New()
+		e.Use(Middleware(stopper, func(c echo.Context) string { return c.RealIP() }))
+		e.GET("/", func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		})
+		serve := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			return w
+		}
+
+		Convey("Requests within the limit are handled with rate limit headers", func() {
+			eval.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			w := serve()
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("X-RateLimit-Limit"), ShouldEqual, "2")
+			So(w.Header().Get("X-RateLimit-Remaining"), ShouldEqual, "1")
+			So(w.Header().Get("X-RateLimit-Reset"), ShouldEqual, "0")
+		})
+
+		Convey("Requests beyond it are answered with 429 and Retry-After", func() {
+			eval.Expect([]interface{}{int64(0), int64(3), int64(0), nil, []byte("3000000000"), nil, nil, nil})
+			w := serve()
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "3")
+			So(w.Header().Get("X-RateLimit-Remaining"), ShouldEqual, "0")
+		})
+
+		Convey("When redis fails", func() {
+			eval.ExpectError(errors.New("connection reset"))
+
+			Convey("Requests are rejected", func() {
+				w := serve()
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "")
+			})
+
+			Convey("With a retry hint when configured", func() {
+				stopper.ErrorRetryAfter = 30 * time.Second
+				w := serve()
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "30")
+			})
+
+			Convey("Unless failing open", func() {
+				stopper.FailOpen = true
+				So(serve().Code, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
@@ -0,0 +1,74 @@
+// Package flowstoppergin rate-limits Gin servers with flowstopper. It lives
+// in its own package so that users of flowstopper don't have to depend on
+// Gin.
+package flowstoppergin
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zoni/flowstopper"
+)
+
+// Option configures the responses of Middleware.
+type Option func(*config)
+
+type config struct {
+	status int
+	body   func(c *gin.Context, r flowstopper.PassResult) interface{}
+}
+
+// WithStatus makes Middleware answer blocked requests with status rather
+// than 429 Too Many Requests.
+func WithStatus(status int) Option {
+	return func(cfg *config) {
+		cfg.status = status
+	}
+}
+
+// WithBody makes Middleware answer blocked requests with the JSON encoding
+// of what body returns for the request and its decision.
+func WithBody(body func(c *gin.Context, r flowstopper.PassResult) interface{}) Option {
+	return func(cfg *config) {
+		cfg.body = body
+	}
+}
+
+// Middleware returns a Gin handler passing each request through s under the
+// item keyFunc derives from it. Every decided request carries the
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers,
+// the latter holding the number of seconds until another request would
+// pass, all taken from a single call to PassResult. Requests exceeding the
+// rate-limit are aborted with 429 Too Many Requests, a Retry-After header
+// and a JSON body, unless configured otherwise. Should s fail, requests are
+// aborted with 503 Service Unavailable unless s.FailOpen is set, with the
+// Retry-After of s.ErrorRetryAfter, like with the Middleware of s.
+func Middleware(s *flowstopper.Stopper, keyFunc func(*gin.Context) string, opts ...Option) gin.HandlerFunc {
+	cfg := config{status: http.StatusTooManyRequests, body: defaultBody}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(c *gin.Context) {
+		r, err := s.PassResult(keyFunc(c))
+		if err != nil {
+			flowstopper.WriteRetryAfter(c.Writer.Header(), s.ErrorRetryAfter)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": http.StatusText(http.StatusServiceUnavailable)})
+			return
+		}
+		flowstopper.WriteHeaders(c.Writer.Header(), r, flowstopper.LegacyHeaders)
+		if !r.Allowed {
+			c.AbortWithStatusJSON(cfg.status, cfg.body(c, r))
+			return
+		}
+		c.Next()
+	}
+}
+
+// defaultBody is the body of blocked requests unless configured otherwise.
+func defaultBody(c *gin.Context, r flowstopper.PassResult) interface{} {
+	return gin.H{
+		"error":       "rate limit exceeded",
+		"retry_after": math.Ceil(r.RetryAfter.Seconds()),
+	}
+}
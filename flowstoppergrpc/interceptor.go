@@ -0,0 +1,109 @@
+// Package flowstoppergrpc rate-limits gRPC servers with flowstopper. It
+// lives in its own package so that users of flowstopper don't have to depend
+// on gRPC.
+package flowstoppergrpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/zoni/flowstopper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns a gRPC interceptor passing each unary call
+// through s under the item keyFunc derives from it. Calls exceeding the
+// rate-limit fail with codes.ResourceExhausted, and carry the number of
+// seconds to wait before trying again in the retry-after header. Should s
+// fail, calls fail with codes.Unavailable unless s.FailOpen is set, with the
+// retry-after of s.ErrorRetryAfter, like with the Middleware of s.
+func UnaryServerInterceptor(s *flowstopper.Stopper, keyFunc func(ctx context.Context, fullMethod string) string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := check(ctx, s, keyFunc(ctx, info.FullMethod), func(md metadata.MD) error {
+			return grpc.SetHeader(ctx, md)
+		}); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor passing each message
+// received on a stream through s under the item keyFunc derives from the
+// stream, so that chatty clients are limited message by message rather than
+// stream by stream. A message exceeding the rate-limit fails RecvMsg with
+// codes.ResourceExhausted, and errors of s are handled like with
+// UnaryServerInterceptor. The stream itself is opened without limit.
+func StreamServerInterceptor(s *flowstopper.Stopper, keyFunc func(ctx context.Context, info *grpc.StreamServerInfo) string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &limitedStream{ServerStream: ss, s: s, item: keyFunc(ss.Context(), info)})
+	}
+}
+
+// limitedStream is a grpc.ServerStream whose received messages are passed
+// through a Stopper.
+type limitedStream struct {
+	grpc.ServerStream
+	s    *flowstopper.Stopper
+	item string
+}
+
+func (ls *limitedStream) RecvMsg(m interface{}) error {
+	if err := ls.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return check(ls.Context(), ls.s, ls.item, ls.SetHeader)
+}
+
+// check passes an action on item through s, returning the status error to
+// fail the call with, if any. The retry-after header of rejected calls is
+// set with setHeader.
+func check(ctx context.Context, s *flowstopper.Stopper, item string, setHeader func(metadata.MD) error) error {
+	err := s.CheckOrError(ctx, item)
+	var rerr *flowstopper.RateLimitError
+	if errors.As(err, &rerr) {
+		_ = setHeader(metadata.Pairs("retry-after", seconds(rerr.RetryAfter)))
+		return status.Error(codes.ResourceExhausted, rerr.Error())
+	}
+	if err != nil && !s.FailOpen {
+		if s.ErrorRetryAfter > 0 {
+			_ = setHeader(metadata.Pairs("retry-after", seconds(s.ErrorRetryAfter)))
+		}
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+// seconds formats d as a number of seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// PeerIP returns the IP address of the peer which made the call, for use as
+// the keyFunc of UnaryServerInterceptor. Calls without a known peer have the
+// empty item, which the Stopper rejects with flowstopper.ErrEmptyItem.
+func PeerIP(ctx context.Context, fullMethod string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// FullMethod returns the name of the called method, for use as the keyFunc
+// of UnaryServerInterceptor to limit each method as a whole.
+func FullMethod(ctx context.Context, fullMethod string) string {
+	return fullMethod
+}
@@ -0,0 +1,170 @@
+package flowstoppergrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zoni/flowstopper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	Convey("Given a handler behind the interceptor", t, func() {
+		conn := redigomock.NewConn()
+		stopper := &flowstopper.Stopper{
+			ConnPool: &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return conn, nil
+				},
+			},
+			Namespace: "grpc",
+			Interval:  5 * time.Second,
+			Limit:     1,
+		}
+		eval := conn.GenericCommand("EVALSHA")
+		interceptor := UnaryServerInterceptor(stopper, FullMethod)
+		info := &grpc.UnaryServerInfo{FullMethod: "/foo.Bar/Baz"}
+		handled := false
+		call := func() error {
+			_, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				handled = true
+				return nil, nil
+			})
+			return err
+		}
+
+		Convey("Calls within the limit are handled", func() {
+			eval.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			So(call(), ShouldBeNil)
+			So(handled, ShouldBeTrue)
+		})
+
+		Convey("Calls beyond it are rejected", func() {
+			eval.Expect([]interface{}{int64(0), int64(2), int64(0), nil, nil, nil, nil, nil})
+			err := call()
+			So(status.Code(err), ShouldEqual, codes.ResourceExhausted)
+			So(handled, ShouldBeFalse)
+		})
+
+		Convey("When redis fails", func() {
+			eval.ExpectError(errors.New("connection reset"))
+
+			Convey("Calls are rejected", func() {
+				So(status.Code(call()), ShouldEqual, codes.Unavailable)
+				So(handled, ShouldBeFalse)
+			})
+
+			Convey("Unless failing open", func() {
+				stopper.FailOpen = true
+				So(call(), ShouldBeNil)
+				So(handled, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+// fakeStream is a grpc.ServerStream receiving an endless supply of messages.
+type fakeStream struct {
+	grpc.ServerStream
+	header metadata.MD
+}
+
+func (fakeStream) Context() context.Context {
+	return context.Background()
+}
+
+func (fakeStream) RecvMsg(m interface{}) error {
+	return nil
+}
+
+func (f *fakeStream) SetHeader(md metadata.MD) error {
+	f.header = metadata.Join(f.header, md)
+	return nil
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	Convey("Given a streaming handler behind the interceptor", t, func() {
+		conn := redigomock.NewConn()
+		stopper := &flowstopper.Stopper{
+			ConnPool: &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return conn, nil
+				},
+			},
+			Namespace: "grpc",
+			Interval:  5 * time.Second,
+			Limit:     1,
+		}
+		eval := conn.GenericCommand("EVALSHA")
+		var item string
+		interceptor := StreamServerInterceptor(stopper, func(ctx context.Context, info *grpc.StreamServerInfo) string {
+			item = info.FullMethod
+			return info.FullMethod
+		})
+		info := &grpc.StreamServerInfo{FullMethod: "/foo.Bar/Stream", IsClientStream: true}
+		stream := &fakeStream{}
+		recv := func(n int) error {
+			return interceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+				for i := 0; i < n; i++ {
+					if err := ss.RecvMsg(nil); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+
+		Convey("The key is derived from the stream info", func() {
+			So(recv(0), ShouldBeNil)
+			So(item, ShouldEqual, "/foo.Bar/Stream")
+			So(conn.Stats(eval), ShouldEqual, 0)
+		})
+
+		Convey("Each message is passed through the stopper", func() {
+			eval.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil}).
+				Expect([]interface{}{int64(0), int64(2), int64(0), nil, []byte("5000000000"), int64(0), nil, nil})
+			err := recv(3)
+			So(status.Code(err), ShouldEqual, codes.ResourceExhausted)
+			So(conn.Stats(eval), ShouldEqual, 2)
+			So(stream.header.Get("retry-after"), ShouldResemble, []string{"5"})
+		})
+
+		Convey("When redis fails", func() {
+			eval.ExpectError(errors.New("connection reset"))
+
+			Convey("Messages are rejected", func() {
+				So(status.Code(recv(1)), ShouldEqual, codes.Unavailable)
+				So(stream.header.Get("retry-after"), ShouldBeEmpty)
+			})
+
+			Convey("With a retry hint when configured", func() {
+				stopper.ErrorRetryAfter = 30 * time.Second
+				So(status.Code(recv(1)), ShouldEqual, codes.Unavailable)
+				So(stream.header.Get("retry-after"), ShouldResemble, []string{"30"})
+			})
+
+			Convey("Unless failing open", func() {
+				stopper.FailOpen = true
+				So(recv(3), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestPeerIP(t *testing.T) {
+	Convey("The peer's address is used without its port", t, func() {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}})
+		So(PeerIP(ctx, "/foo.Bar/Baz"), ShouldEqual, "192.0.2.1")
+		So(PeerIP(context.Background(), "/foo.Bar/Baz"), ShouldEqual, "")
+	})
+}
@@ -0,0 +1,60 @@
+// Package flowstopperotel traces flowstopper rate limiters with
+// OpenTelemetry. It lives in its own package so that users of flowstopper
+// don't have to depend on OpenTelemetry.
+package flowstopperotel
+
+import (
+	"context"
+
+	"github.com/zoni/flowstopper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The attributes recorded on spans.
+const (
+	namespaceKey = attribute.Key("flowstopper.namespace")
+	itemKey      = attribute.Key("flowstopper.item")
+	allowedKey   = attribute.Key("flowstopper.allowed")
+)
+
+// WithTracer returns an option for flowstopper.NewStopper tracing the
+// Stopper's calls to redis with t.
+func WithTracer(t trace.Tracer) flowstopper.Option {
+	return func(s *flowstopper.Stopper) {
+		s.Tracer = NewTracer(t)
+	}
+}
+
+// NewTracer returns a flowstopper.Tracer opening spans with t, for Stoppers
+// not created by flowstopper.NewStopper.
+func NewTracer(t trace.Tracer) flowstopper.Tracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, operation, namespace, item string) (context.Context, flowstopper.Span) {
+	ctx, span := t.t.Start(ctx, operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(namespaceKey.String(namespace), itemKey.String(item)))
+	return ctx, otelSpan{span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAllowed(allowed bool) {
+	s.span.SetAttributes(allowedKey.Bool(allowed))
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
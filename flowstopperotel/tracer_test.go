@@ -0,0 +1,69 @@
+package flowstopperotel
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zoni/flowstopper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	Convey("Given a traced stopper", t, func() {
+		conn := redigomock.NewConn()
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		}
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		stopper, err := flowstopper.NewStopper(pool, "traced", time.Minute, 4, WithTracer(provider.Tracer("test")))
+		So(err, ShouldBeNil)
+		eval := conn.GenericCommand("EVALSHA")
+
+		Convey("Passing an action opens a span recording the decision", func() {
+			eval.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			_, err := stopper.Pass("alice")
+			So(err, ShouldBeNil)
+
+			spans := recorder.Ended()
+			So(spans, ShouldHaveLength, 1)
+			So(spans[0].Name(), ShouldEqual, "flowstopper.Pass")
+			So(spans[0].Attributes(), ShouldContain, namespaceKey.String("traced"))
+			So(spans[0].Attributes(), ShouldContain, itemKey.String("alice"))
+			So(spans[0].Attributes(), ShouldContain, allowedKey.Bool(true))
+			So(spans[0].Status().Code, ShouldEqual, codes.Unset)
+		})
+
+		Convey("Redis errors mark the span failed", func() {
+			eval.ExpectError(errors.New("connection reset"))
+			_, err := stopper.Pass("alice")
+			So(err, ShouldNotBeNil)
+
+			spans := recorder.Ended()
+			So(spans, ShouldHaveLength, 1)
+			So(spans[0].Status().Code, ShouldEqual, codes.Error)
+		})
+
+		Convey("Peeking opens a span as well", func() {
+			conn.GenericCommand("ZREMRANGEBYSCORE").Expect(int64(0))
+			conn.Command("ZCARD", "traced:alice").Expect(int64(2))
+			conn.GenericCommand("ZRANGEBYSCORE").Expect([]interface{}{})
+			_, err := stopper.Peek("alice")
+			So(err, ShouldBeNil)
+
+			spans := recorder.Ended()
+			So(spans, ShouldHaveLength, 1)
+			So(spans[0].Name(), ShouldEqual, "flowstopper.Peek")
+			So(spans[0].Attributes(), ShouldResemble, []attribute.KeyValue{namespaceKey.String("traced"), itemKey.String("alice")})
+		})
+	})
+}
@@ -0,0 +1,130 @@
+// Package flowstopperprom exports the state of flowstopper rate limiters as
+// Prometheus metrics. It lives in its own package so that users of
+// flowstopper don't have to depend on the Prometheus client.
+package flowstopperprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zoni/flowstopper"
+)
+
+var (
+	actionsDesc = prometheus.NewDesc(
+		"flowstopper_window_actions",
+		"Number of actions recorded during the current interval, summed over the monitored items.",
+		[]string{"namespace"}, nil,
+	)
+	utilizationDesc = prometheus.NewDesc(
+		"flowstopper_window_utilization_max",
+		"Highest fraction of the limit used during the current interval among the monitored items.",
+		[]string{"namespace"}, nil,
+	)
+	blockedDesc = prometheus.NewDesc(
+		"flowstopper_window_items_blocked",
+		"Number of monitored items which are currently at or over their limit.",
+		[]string{"namespace"}, nil,
+	)
+	decisionsDesc = prometheus.NewDesc(
+		"flowstopper_decisions_total",
+		"Number of actions decided on since the process started, by decision.",
+		[]string{"namespace", "decision"}, nil,
+	)
+)
+
+// Target is a set of items of a Stopper to monitor.
+type Target struct {
+	// The Stopper the items are limited by.
+	Stopper *flowstopper.Stopper
+
+	// The items to monitor.
+	Items []string
+}
+
+// Collector is a prometheus.Collector which, on each scrape, peeks at the
+// windows of the configured items and reports gauges aggregated per
+// namespace, along with counters of the allowed and blocked decisions from
+// the Stats of each Stopper. Items are never used as labels, so the number of
+// series is bounded by the number of namespaces regardless of how many items
+// are monitored.
+type Collector struct {
+	targets []Target
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a Collector monitoring targets.
+func NewCollector(targets ...Target) *Collector {
+	return &Collector{targets: targets}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- actionsDesc
+	ch <- utilizationDesc
+	ch <- blockedDesc
+	ch <- decisionsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.collectDecisions(ch)
+	for _, t := range c.targets {
+		var actions, blocked int64
+		var utilization float64
+		var err error
+		for _, item := range t.Items {
+			var count int64
+			count, err = t.Stopper.Peek(item)
+			if err != nil {
+				break
+			}
+			actions += count
+			if count >= t.Stopper.Limit {
+				blocked++
+			}
+			if t.Stopper.Limit > 0 {
+				if u := float64(count) / float64(t.Stopper.Limit); u > utilization {
+					utilization = u
+				}
+			}
+		}
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(actionsDesc, err)
+			continue
+		}
+
+		ns := t.Stopper.Namespace
+		ch <- prometheus.MustNewConstMetric(actionsDesc, prometheus.GaugeValue, float64(actions), ns)
+		ch <- prometheus.MustNewConstMetric(utilizationDesc, prometheus.GaugeValue, utilization, ns)
+		ch <- prometheus.MustNewConstMetric(blockedDesc, prometheus.GaugeValue, float64(blocked), ns)
+	}
+}
+
+// collectDecisions reports the decisions of every Stopper monitored, summed
+// per namespace, counting Stoppers listed in several targets once.
+func (c *Collector) collectDecisions(ch chan<- prometheus.Metric) {
+	seen := make(map[*flowstopper.Stopper]bool)
+	var namespaces []string
+	totals := make(map[string]flowstopper.Stats)
+	for _, t := range c.targets {
+		if seen[t.Stopper] {
+			continue
+		}
+		seen[t.Stopper] = true
+
+		ns := t.Stopper.Namespace
+		total, ok := totals[ns]
+		if !ok {
+			namespaces = append(namespaces, ns)
+		}
+		stats := t.Stopper.Stats()
+		total.Allowed += stats.Allowed
+		total.Blocked += stats.Blocked
+		totals[ns] = total
+	}
+
+	for _, ns := range namespaces {
+		ch <- prometheus.MustNewConstMetric(decisionsDesc, prometheus.CounterValue, float64(totals[ns].Allowed), ns, "allowed")
+		ch <- prometheus.MustNewConstMetric(decisionsDesc, prometheus.CounterValue, float64(totals[ns].Blocked), ns, "blocked")
+	}
+}
@@ -0,0 +1,72 @@
+package flowstopperprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zoni/flowstopper"
+)
+
+func TestCollector(t *testing.T) {
+	Convey("Given a collector monitoring two namespaces", t, func() {
+		conn := redigomock.NewConn()
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		}
+		login := &flowstopper.Stopper{ConnPool: pool, Namespace: "login", Interval: time.Minute, Limit: 4}
+		api := &flowstopper.Stopper{ConnPool: pool, Namespace: "api", Interval: time.Minute, Limit: 10}
+		conn.GenericCommand("ZREMRANGEBYSCORE").Expect(int64(0))
+		conn.GenericCommand("ZRANGEBYSCORE").Expect([]interface{}{})
+		conn.Command("ZCARD", "login:alice").Expect(int64(4))
+		conn.Command("ZCARD", "login:bob").Expect(int64(1))
+		conn.Command("ZCARD", "api:alice").Expect(int64(5))
+
+		conn.GenericCommand("EVALSHA").
+			Expect([]interface{}{int64(0), int64(4), int64(0), nil, nil, nil, nil, nil}).
+			Expect([]interface{}{int64(0), int64(5), int64(0), nil, nil, nil, nil, nil})
+		for i := 0; i < 2; i++ {
+			_, err := login.Pass("alice")
+			So(err, ShouldBeNil)
+		}
+
+		collector := NewCollector(
+			Target{Stopper: login, Items: []string{"alice", "bob"}},
+			Target{Stopper: api, Items: []string{"alice"}},
+		)
+
+		Convey("Scraping it reports per-namespace aggregates", func() {
+			expected := `
+# HELP flowstopper_decisions_total Number of actions decided on since the process started, by decision.
+# TYPE flowstopper_decisions_total counter
+flowstopper_decisions_total{decision="allowed",namespace="api"} 0
+flowstopper_decisions_total{decision="allowed",namespace="login"} 1
+flowstopper_decisions_total{decision="blocked",namespace="api"} 0
+flowstopper_decisions_total{decision="blocked",namespace="login"} 1
+# HELP flowstopper_window_actions Number of actions recorded during the current interval, summed over the monitored items.
+# TYPE flowstopper_window_actions gauge
+flowstopper_window_actions{namespace="api"} 5
+flowstopper_window_actions{namespace="login"} 5
+# HELP flowstopper_window_items_blocked Number of monitored items which are currently at or over their limit.
+# TYPE flowstopper_window_items_blocked gauge
+flowstopper_window_items_blocked{namespace="api"} 0
+flowstopper_window_items_blocked{namespace="login"} 1
+# HELP flowstopper_window_utilization_max Highest fraction of the limit used during the current interval among the monitored items.
+# TYPE flowstopper_window_utilization_max gauge
+flowstopper_window_utilization_max{namespace="api"} 0.5
+flowstopper_window_utilization_max{namespace="login"} 1
+`
+			So(testutil.CollectAndCompare(collector, strings.NewReader(expected)), ShouldBeNil)
+		})
+
+		Convey("The number of series doesn't grow with the items", func() {
+			So(testutil.CollectAndCount(collector), ShouldEqual, 10)
+		})
+	})
+}
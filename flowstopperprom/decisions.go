@@ -0,0 +1,61 @@
+package flowstopperprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DecisionCounter is a prometheus.Collector counting the decisions of
+// Stoppers by a label derived from each item, such as the tier of a tenant,
+// hooked up as their OnDecision. Items are never used as labels themselves:
+// the LabelFunc maps them onto a bounded set of labels, so that the number
+// of series stays bounded however many items are seen.
+type DecisionCounter struct {
+	labelFunc func(item string) string
+	decisions *prometheus.CounterVec
+}
+
+var _ prometheus.Collector = (*DecisionCounter)(nil)
+
+// NewDecisionCounter returns a DecisionCounter for the Stoppers of
+// namespace, labelling decisions with the label labelFunc returns for their
+// item. A nil labelFunc produces no per-item labels, counting the decisions
+// of all items together.
+func NewDecisionCounter(namespace string, labelFunc func(item string) string) *DecisionCounter {
+	labels := []string{"decision"}
+	if labelFunc != nil {
+		labels = append(labels, "label")
+	}
+	return &DecisionCounter{
+		labelFunc: labelFunc,
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "flowstopper_item_decisions_total",
+			Help:        "Number of actions decided on since the process started, by decision and item label.",
+			ConstLabels: prometheus.Labels{"namespace": namespace},
+		}, labels),
+	}
+}
+
+// OnDecision counts a decision, for use as the OnDecision of a Stopper. To
+// have a Stopper report its decisions elsewhere too, call it from a function
+// doing both.
+func (d *DecisionCounter) OnDecision(item string, allowed bool, count int64) {
+	decision := "blocked"
+	if allowed {
+		decision = "allowed"
+	}
+	if d.labelFunc == nil {
+		d.decisions.WithLabelValues(decision).Inc()
+		return
+	}
+	d.decisions.WithLabelValues(decision, d.labelFunc(item)).Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (d *DecisionCounter) Describe(ch chan<- *prometheus.Desc) {
+	d.decisions.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (d *DecisionCounter) Collect(ch chan<- prometheus.Metric) {
+	d.decisions.Collect(ch)
+}
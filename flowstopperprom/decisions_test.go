@@ -0,0 +1,69 @@
+package flowstopperprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zoni/flowstopper"
+)
+
+func TestDecisionCounter(t *testing.T) {
+	Convey("Given a stopper reporting its decisions", t, func() {
+		conn := redigomock.NewConn()
+		stopper := &flowstopper.Stopper{
+			ConnPool: &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return conn, nil
+				},
+			},
+			Namespace: "api",
+			Interval:  time.Minute,
+			Limit:     1,
+		}
+		conn.GenericCommand("EVALSHA").
+			Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil}).
+			Expect([]interface{}{int64(0), int64(2), int64(0), nil, nil, nil, nil, nil})
+		pass := func(items ...string) {
+			for _, item := range items {
+				_, err := stopper.Pass(item)
+				So(err, ShouldBeNil)
+			}
+		}
+
+		Convey("Decisions are counted by the label of their item", func() {
+			counter := NewDecisionCounter("api", func(item string) string {
+				if strings.HasPrefix(item, "pro-") {
+					return "pro"
+				}
+				return "free"
+			})
+			stopper.OnDecision = counter.OnDecision
+			pass("pro-1", "free-1", "free-2", "free-3")
+			expected := `
+# HELP flowstopper_item_decisions_total Number of actions decided on since the process started, by decision and item label.
+# TYPE flowstopper_item_decisions_total counter
+flowstopper_item_decisions_total{decision="allowed",label="pro",namespace="api"} 1
+flowstopper_item_decisions_total{decision="blocked",label="free",namespace="api"} 3
+`
+			So(testutil.CollectAndCompare(counter, strings.NewReader(expected)), ShouldBeNil)
+		})
+
+		Convey("Without a LabelFunc no per-item labels are produced", func() {
+			counter := NewDecisionCounter("api", nil)
+			stopper.OnDecision = counter.OnDecision
+			pass("alice", "bob", "carol")
+			expected := `
+# HELP flowstopper_item_decisions_total Number of actions decided on since the process started, by decision and item label.
+# TYPE flowstopper_item_decisions_total counter
+flowstopper_item_decisions_total{decision="allowed",namespace="api"} 1
+flowstopper_item_decisions_total{decision="blocked",namespace="api"} 2
+`
+			So(testutil.CollectAndCompare(counter, strings.NewReader(expected)), ShouldBeNil)
+		})
+	})
+}
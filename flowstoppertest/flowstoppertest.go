@@ -0,0 +1,56 @@
+// Package flowstoppertest provides Stoppers backed by an in-process
+// miniredis, so that code depending on flowstopper can be tested without a
+// redis-server. It lives in its own package so that users of flowstopper
+// don't have to depend on miniredis.
+package flowstoppertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"github.com/zoni/flowstopper"
+)
+
+// NewServer starts a miniredis for the duration of the test t, which covers
+// the commands and Lua scripting the limiters of flowstopper use. It is
+// closed once t and its subtests have finished.
+func NewServer(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("flowstoppertest: starting miniredis: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// NewPool returns a redigo pool connecting to srv, closed along with it once
+// t has finished.
+func NewPool(t testing.TB, srv *miniredis.Miniredis) *redis.Pool {
+	t.Helper()
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", srv.Addr())
+		},
+		MaxIdle: 3,
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+	return pool
+}
+
+// NewStopper returns a Stopper like flowstopper.NewStopper, backed by a
+// miniredis of its own for the duration of t, along with the server, such
+// as to inspect its keys or fail it with SetError. Time is best controlled
+// with flowstopper.WithClock and a mock clock, as miniredis' own clock only
+// affects key expiry, which FastForward moves along.
+func NewStopper(t testing.TB, namespace string, interval time.Duration, limit int64, opts ...flowstopper.Option) (*flowstopper.Stopper, *miniredis.Miniredis) {
+	t.Helper()
+	srv := NewServer(t)
+	s, err := flowstopper.NewStopper(NewPool(t, srv), namespace, interval, limit, opts...)
+	if err != nil {
+		t.Fatalf("flowstoppertest: %v", err)
+	}
+	return s, srv
+}
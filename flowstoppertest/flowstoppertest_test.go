@@ -0,0 +1,59 @@
+package flowstoppertest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zoni/flowstopper"
+)
+
+func TestNewStopper(t *testing.T) {
+	Convey("Given a stopper backed by miniredis", t, func() {
+		c := clock.NewMockClock(time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC))
+		stopper, srv := NewStopper(t, "test", 5*time.Second, 2, flowstopper.WithClock(c))
+		pass := func() bool {
+			c.AddTime(time.Millisecond)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			return passed
+		}
+
+		Convey("It limits like one backed by redis", func() {
+			So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, false})
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+			So(srv.Exists(stopper.Key("foo")), ShouldBeTrue)
+
+			Convey("And lets actions pass again after the interval", func() {
+				c.AddTime(stopper.Interval)
+				So(pass(), ShouldBeTrue)
+			})
+
+			Convey("And tells when the item just got blocked", func() {
+				c.AddTime(time.Millisecond)
+				r, err := stopper.PassResult("foo")
+				So(err, ShouldBeNil)
+				So(r.Allowed, ShouldBeFalse)
+				So(r.JustBlocked, ShouldBeFalse)
+				So(r.RetryAfter, ShouldBeGreaterThan, 0)
+			})
+		})
+
+		Convey("Windows expire with the server's clock", func() {
+			pass()
+			srv.FastForward(stopper.Interval)
+			So(srv.Exists(stopper.Key("foo")), ShouldBeFalse)
+		})
+
+		Convey("Failures of the server surface as errors", func() {
+			srv.SetError("LOADING Redis is loading the dataset in memory")
+			_, err := stopper.Pass("foo")
+			So(err, ShouldNotBeNil)
+			So(errors.Is(err, flowstopper.ErrClosed), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,148 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// globalScript trims the windows stored at KEYS[1] and KEYS[2] of members
+// scored at or before ARGV[1], and records an action scored ARGV[2] in both,
+// as member ARGV[3] made unique in each as by luaUnique, only if the first
+// holds fewer than ARGV[4] actions, or the limit stored at KEYS[3] by
+// SetLimit, and the second fewer than ARGV[5]. The actions in the first are
+// counted with the weights at KEYS[4] as by luaWeights. Recording it sets
+// both windows to expire no sooner than ARGV[6] milliseconds, leaving alone
+// a window set to outlive it.
+//
+// It returns 0 if the action was recorded, or 1 or 2 for the first window
+// whose limit it exceeded, followed by the counts of both before recording.
+var globalScript = newScript(4, luaUnique+luaWeights+`
+local counts = {}
+trim(KEYS[1], KEYS[4], ARGV[1])
+counts[1] = counted(KEYS[1], KEYS[4], ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])
+counts[2] = redis.call("ZCARD", KEYS[2])
+local exceeded = 0
+if counts[1] >= tonumber(redis.call("GET", KEYS[3]) or ARGV[4]) then
+	exceeded = 1
+elseif counts[2] >= tonumber(ARGV[5]) then
+	exceeded = 2
+else
+	for i = 1, 2 do
+		redis.call("ZADD", KEYS[i], ARGV[2], unique(KEYS[i], ARGV[3], 0, 1))
+		if redis.call("PTTL", KEYS[i]) < tonumber(ARGV[6]) then
+			redis.call("PEXPIRE", KEYS[i], ARGV[6])
+		end
+	end
+end
+return {exceeded, counts[1], counts[2]}
+`)
+
+// GlobalResult is the decision of PassGlobal.
+type GlobalResult struct {
+	// Whether the action passed.
+	Allowed bool
+
+	// The limit which rejected the action, if any, ConstraintItem taking
+	// precedence should it exceed both.
+	Constraint Constraint
+
+	// The number of actions for the item during the Interval, counting the
+	// attempted one whether recorded or not.
+	Count int64
+
+	// The number of actions for all items during the Interval, counting the
+	// attempted one whether recorded or not.
+	GlobalCount int64
+}
+
+// GlobalKey returns the redis key of the window shared by all items under
+// the Namespace, which PassGlobal checks against the GlobalLimit.
+func (s *Stopper) GlobalKey() string {
+	return auxKey(s.Namespace+s.separator(), "global")
+}
+
+// PassGlobal sends an item through the Stopper, checking it against both its
+// own limit, the one set by SetLimit if any, and the GlobalLimit shared by
+// all items in a single script, so that concurrent actions overshoot
+// neither. The action is only recorded if it stays within both, and
+// otherwise the result tells which limit rejected it. Grace periods, the
+// FreeAllowance and the SoftLimit don't apply to it. With Unlimited the
+// action passes without being recorded, and with a Limit of zero or less it
+// is rejected by ConstraintItem, in neither case involving redis. While item
+// is locked out by the Penalty, the action is rejected by ConstraintItem
+// too, though rejections of PassGlobal don't count as offenses.
+//
+// The global window is a single key, which must live on the same redis
+// server as the window of the item: with a ShardedPool, it fails with
+// ErrInvalidConfig for items on another shard than the GlobalKey. Redis
+// Cluster is unsupported for the same reason: the HashTag spreads the
+// windows of items over all slots, which the global window cannot share, so
+// PassGlobal fails with ErrInvalidConfig with HashTag set, rather than
+// with CROSSSLOT errors from the cluster. It also fails with
+// ErrInvalidConfig unless the GlobalLimit is positive.
+func (s *Stopper) PassGlobal(item string) (GlobalResult, error) {
+	switch {
+	case s.GlobalLimit <= 0:
+		return GlobalResult{}, fmt.Errorf("%w: global limit %d is not positive", ErrInvalidConfig, s.GlobalLimit)
+	case s.HashTag:
+		return GlobalResult{}, fmt.Errorf("%w: a global limit is unsupported on Redis Cluster", ErrInvalidConfig)
+	}
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return GlobalResult{}, err
+	}
+	limitKey, err := s.limitKey(item)
+	if err != nil {
+		return GlobalResult{}, err
+	}
+	switch {
+	case s.Unlimited:
+		s.decided(item, true, 0, true)
+		return GlobalResult{Allowed: true}, nil
+	case s.Limit <= 0:
+		s.decided(item, false, 0, true)
+		return GlobalResult{Constraint: ConstraintItem}, nil
+	}
+	global := s.GlobalKey()
+
+	c, err := s.batchConn(context.Background(), []string{key, global})
+	if err != nil {
+		return GlobalResult{}, err
+	}
+	defer func() { _ = c.Close() }()
+
+	if s.Penalty != nil {
+		until, err := s.lockedUntil(c, key, now)
+		if err != nil {
+			return GlobalResult{}, s.itemError(item, err)
+		}
+		if !until.IsZero() {
+			s.decided(item, false, 0, true)
+			return GlobalResult{Constraint: ConstraintItem}, nil
+		}
+	}
+
+	nanonow := now.UnixNano()
+	values, err := redis.Values(globalScript.run(c, key, global, limitKey, auxKey(key, "weights"), now.Add(s.Interval*-1).UnixNano(), nanonow, nanonow,
+		s.Limit, s.GlobalLimit, durationMillis(s.Interval)))
+	if err != nil {
+		return GlobalResult{}, s.itemError(item, err)
+	}
+	var exceeded, count, globalCount int64
+	if _, err := redis.Scan(values, &exceeded, &count, &globalCount); err != nil {
+		return GlobalResult{}, s.itemError(item, err)
+	}
+	r := GlobalResult{Allowed: exceeded == 0, Count: count + 1, GlobalCount: globalCount + 1}
+	switch exceeded {
+	case 1:
+		r.Constraint = ConstraintItem
+	case 2:
+		r.Constraint = ConstraintGlobal
+	}
+	s.decided(item, r.Allowed, r.Count, true)
+	return r, nil
+}
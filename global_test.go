@@ -0,0 +1,120 @@
+package flowstopper
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPassGlobal(t *testing.T) {
+	Convey("Given a stopper with a global limit", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace:   "global",
+			Interval:    5 * time.Second,
+			Limit:       int64(2),
+			GlobalLimit: int64(3),
+			ConnPool:    &connPool,
+			c:           clock,
+		}
+		pass := func(item string) GlobalResult {
+			clock.AddTime(time.Millisecond)
+			r, err := stopper.PassGlobal(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		Convey("Each item is limited on its own", func() {
+			So(pass("alice"), ShouldResemble, GlobalResult{Allowed: true, Count: 1, GlobalCount: 1})
+			So(pass("alice").Allowed, ShouldBeTrue)
+			So(pass("alice"), ShouldResemble, GlobalResult{Constraint: ConstraintItem, Count: 3, GlobalCount: 3})
+
+			Convey("And all of them together", func() {
+				So(pass("bob").Allowed, ShouldBeTrue)
+				r := pass("carol")
+				So(r, ShouldResemble, GlobalResult{Constraint: ConstraintGlobal, Count: 1, GlobalCount: 4})
+				So(r.Constraint.String(), ShouldEqual, "global")
+
+				Convey("Rejected actions are recorded nowhere", func() {
+					count, err := stopper.Peek("carol")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 0)
+					items, err := stopper.ActiveItems()
+					So(err, ShouldBeNil)
+					So(items, ShouldResemble, []string{"alice", "bob"})
+				})
+			})
+		})
+
+		Convey("Unlimited lets every action through without recording it", func() {
+			stopper.Unlimited = true
+			for i := 0; i < 4; i++ {
+				So(pass("alice"), ShouldResemble, GlobalResult{Allowed: true})
+			}
+			count, err := stopper.Peek("alice")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("A closed gate rejects every action by the item's limit", func() {
+			stopper.Limit = 0
+			So(pass("alice"), ShouldResemble, GlobalResult{Constraint: ConstraintItem})
+		})
+
+		Convey("Concurrent actions never overshoot the global limit", func() {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(item string) {
+					defer wg.Done()
+					r, err := stopper.PassGlobal(item)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if r.Allowed {
+						mu.Lock()
+						allowed++
+						mu.Unlock()
+					}
+				}(string(rune('a' + i)))
+			}
+			wg.Wait()
+			So(allowed, ShouldEqual, 3)
+		})
+
+		Convey("A global limit must be set", func() {
+			stopper.GlobalLimit = 0
+			_, err := stopper.PassGlobal("alice")
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Hash-tagged keys for a cluster are refused", func() {
+			stopper.HashTag = true
+			_, err := stopper.PassGlobal("alice")
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Recording never shortens the expiry of the global window", func() {
+			pass("alice")
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			_, err := conn.Do("PEXPIRE", stopper.GlobalKey(), time.Hour.Milliseconds())
+			So(err, ShouldBeNil)
+			pass("bob")
+			ttl, err := redis.Int64(conn.Do("PTTL", stopper.GlobalKey()))
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeGreaterThan, stopper.Interval.Milliseconds())
+		})
+	})
+}
@@ -0,0 +1,59 @@
+package flowstopper
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HeaderStyle selects the rate-limit headers written by WriteHeaders. The
+// styles can be combined, such as DraftHeaders|LegacyHeaders while clients
+// move from one to the other.
+type HeaderStyle int
+
+const (
+	// DraftHeaders are the RateLimit-Limit, RateLimit-Remaining and
+	// RateLimit-Reset headers of the IETF draft on rate-limit headers.
+	DraftHeaders HeaderStyle = 1 << iota
+
+	// LegacyHeaders are the X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset headers in wide use before the draft.
+	LegacyHeaders
+)
+
+// WriteHeaders sets the headers describing the decision r in h, in the
+// given style, for handlers which don't fit the provided middleware. The
+// reset headers hold the number of seconds until another action would pass,
+// rounded up, and rejected actions additionally carry a Retry-After header
+// of the same value, unless they have no RetryAfter, such as when rejected
+// by a closed gate.
+func WriteHeaders(h http.Header, r PassResult, style HeaderStyle) {
+	limit := strconv.FormatInt(r.Limit, 10)
+	left := strconv.FormatInt(r.Remaining, 10)
+	reset := strconv.FormatInt(int64(math.Ceil(r.RetryAfter.Seconds())), 10)
+	if style&DraftHeaders != 0 {
+		h.Set("RateLimit-Limit", limit)
+		h.Set("RateLimit-Remaining", left)
+		h.Set("RateLimit-Reset", reset)
+	}
+	if style&LegacyHeaders != 0 {
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", left)
+		h.Set("X-RateLimit-Reset", reset)
+	}
+	if !r.Allowed && r.RetryAfter > 0 {
+		h.Set("Retry-After", reset)
+	}
+}
+
+// WriteRetryAfter sets the Retry-After header in h to d, rounded up to
+// seconds, for requests rejected because of an error rather than a
+// decision, such as with a Stopper's ErrorRetryAfter. Nothing is set for a
+// d of zero.
+func WriteRetryAfter(h http.Header, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	h.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10))
+}
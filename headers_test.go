@@ -0,0 +1,52 @@
+package flowstopper
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteHeaders(t *testing.T) {
+	Convey("Given the result of an action", t, func() {
+		r := PassResult{Allowed: true, Limit: 5, Count: 2, Remaining: 3}
+		h := make(http.Header)
+
+		Convey("The draft headers describe it", func() {
+			WriteHeaders(h, r, DraftHeaders)
+			So(h, ShouldResemble, http.Header{
+				"Ratelimit-Limit":     {"5"},
+				"Ratelimit-Remaining": {"3"},
+				"Ratelimit-Reset":     {"0"},
+			})
+		})
+
+		Convey("The legacy headers describe it", func() {
+			WriteHeaders(h, r, LegacyHeaders)
+			So(h, ShouldResemble, http.Header{
+				"X-Ratelimit-Limit":     {"5"},
+				"X-Ratelimit-Remaining": {"3"},
+				"X-Ratelimit-Reset":     {"0"},
+			})
+		})
+
+		Convey("Both styles can be written at once", func() {
+			WriteHeaders(h, r, DraftHeaders|LegacyHeaders)
+			So(h, ShouldHaveLength, 6)
+		})
+
+		Convey("Rejected actions carry a Retry-After header", func() {
+			r = PassResult{Limit: 5, Count: 6, RetryAfter: 1500 * time.Millisecond}
+			WriteHeaders(h, r, DraftHeaders)
+			So(h.Get("RateLimit-Reset"), ShouldEqual, "2")
+			So(h.Get("Retry-After"), ShouldEqual, "2")
+		})
+
+		Convey("Unless they have no RetryAfter", func() {
+			r = PassResult{Limit: 0, Count: 1}
+			WriteHeaders(h, r, DraftHeaders)
+			So(h.Get("Retry-After"), ShouldEqual, "")
+		})
+	})
+}
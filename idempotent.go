@@ -0,0 +1,90 @@
+package flowstopper
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// passUniqueScript trims the window stored at KEYS[1] of members scored at
+// or before ARGV[1], and records member ARGV[3] scored ARGV[2] if it is not
+// in the window yet and the window holds fewer than ARGV[4] actions, or the
+// limit stored at KEYS[2] by SetLimit, setting it to expire no sooner than
+// ARGV[5] milliseconds. The actions are counted with the weights at KEYS[3]
+// as by luaWeights.
+//
+// It returns the number of members trimmed, whether the member is in the
+// window now, and the number of actions in the window including the
+// attempted one whether recorded or not, unless it was there already.
+var passUniqueScript = newScript(3, luaWeights+`
+local trimmed = trim(KEYS[1], KEYS[3], ARGV[1])
+local count = counted(KEYS[1], KEYS[3], ARGV[1])
+if redis.call("ZSCORE", KEYS[1], ARGV[3]) then
+	return {trimmed, 1, count}
+end
+if count >= tonumber(redis.call("GET", KEYS[2]) or ARGV[4]) then
+	return {trimmed, 0, count + 1}
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[3])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[5]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[5])
+end
+return {trimmed, 1, count + 1}
+`)
+
+// PassUnique sends an item through the Stopper like Pass, but records the
+// action under memberID, such as the idempotency key of a request, so that
+// retries of an action which passed pass again without taking up another
+// slot for as long as it is in the window. An action which was rejected
+// took up no room, so its retries are decided afresh. The action is scored
+// by the time it first passed, by which it expires as usual. Grace periods,
+// the FreeAllowance and the SoftLimit don't apply to it, while Unlimited
+// and a Limit of zero or less do as for Pass. While item is locked out by the
+// Penalty, every action is rejected, retries included, but its rejections
+// don't count as offenses.
+func (s *Stopper) PassUnique(item, memberID string) (bool, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return false, err
+	}
+	limitKey, err := s.limitKey(item)
+	if err != nil {
+		return false, err
+	}
+	if s.Unlimited || s.Limit <= 0 {
+		s.decided(item, s.Unlimited, 0, true)
+		return s.Unlimited, nil
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	if s.Penalty != nil {
+		until, err := s.lockedUntil(c, key, now)
+		if err != nil {
+			return false, s.itemError(item, err)
+		}
+		if !until.IsZero() {
+			s.decided(item, false, 0, true)
+			return false, nil
+		}
+	}
+
+	// The prefix keeps the identifiers apart from the timestamps Pass records
+	// actions under.
+	values, err := redis.Values(passUniqueScript.run(c, key, limitKey, auxKey(key, "weights"), now.Add(s.Interval*-1).UnixNano(), now.UnixNano(),
+		"id:"+memberID, s.Limit, durationMillis(s.Interval)))
+	if err != nil {
+		return false, s.itemError(item, err)
+	}
+	var trimmed, count int64
+	var allowed bool
+	if _, err := redis.Scan(values, &trimmed, &allowed, &count); err != nil {
+		return false, s.itemError(item, err)
+	}
+	s.trimmed(item, trimmed)
+	s.decided(item, allowed, count, true)
+	return allowed, nil
+}
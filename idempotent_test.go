@@ -0,0 +1,81 @@
+package flowstopper
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPassUnique(t *testing.T) {
+	Convey("Given a stopper deduplicating actions", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "passunique",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func(id string) bool {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.PassUnique("foo", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+		count := func() int64 {
+			count, err := stopper.Peek("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+
+		Convey("Unlimited lets every action through without recording it", func() {
+			stopper.Unlimited = true
+			for i := 0; i < 3; i++ {
+				So(pass("req-"+strconv.Itoa(i)), ShouldBeTrue)
+			}
+			So(count(), ShouldEqual, 0)
+		})
+
+		Convey("A closed gate rejects every action", func() {
+			stopper.Limit = 0
+			So(pass("req-1"), ShouldBeFalse)
+		})
+
+		Convey("Retries of an action count once", func() {
+			for i := 0; i < 3; i++ {
+				So(pass("req-1"), ShouldBeTrue)
+			}
+			So(count(), ShouldEqual, 1)
+
+			Convey("While other actions are limited as usual", func() {
+				So(pass("req-2"), ShouldBeTrue)
+				So(pass("req-3"), ShouldBeFalse)
+				So(pass("req-1"), ShouldBeTrue)
+				So(count(), ShouldEqual, 2)
+
+				Convey("And rejected actions are decided afresh", func() {
+					clock.AddTime(stopper.Interval)
+					So(pass("req-3"), ShouldBeTrue)
+					So(count(), ShouldEqual, 1)
+				})
+			})
+		})
+
+		Convey("Identifiers don't collide with the actions of Pass", func() {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(pass(strconv.FormatInt(now.Add(time.Millisecond).UnixNano(), 10)), ShouldBeTrue)
+			So(count(), ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// leakyBucketScript pours an action into the bucket stored as a hash at
+// KEYS[1], holding up to ARGV[2] actions and leaking ARGV[3] actions per
+// second, at time ARGV[1] in microseconds since the epoch. A bucket not seen
+// before starts out empty. It returns 1 if the action fit into the bucket
+// and 0 if it would have overflowed. The bucket expires after ARGV[4]
+// milliseconds, by when it would have drained anyway.
+var leakyBucketScript = newScript(1, `
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local state = redis.call("HMGET", KEYS[1], "level", "ts")
+local level = tonumber(state[1]) or 0
+local ts = tonumber(state[2]) or now
+if now > ts then
+	level = math.max(0, level - (now - ts) * tonumber(ARGV[3]) / 1000000)
+	ts = now
+end
+local poured = 0
+if level + 1 <= capacity then
+	level = level + 1
+	poured = 1
+end
+redis.call("HMSET", KEYS[1], "level", level, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return poured
+`)
+
+// LeakyBucket is a rate limiter shaping the actions for each item into a
+// steady flow. Every action passed is poured into the item's bucket, which
+// leaks at a steady Rate, and actions which would make it overflow its
+// Capacity are rejected.
+//
+// Where a TokenBucket stores the credit left to an item, a LeakyBucket
+// stores the volume queued for it, which drains at Rate whether actions
+// arrive or not. A new bucket starts out empty, so a burst of up to Capacity
+// actions passes before the bucket is full and actions are admitted at Rate.
+type LeakyBucket struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain ":".
+	Namespace string
+
+	// The maximum number of actions a bucket holds before overflowing.
+	Capacity int64
+
+	// The number of actions leaking from a bucket per second.
+	Rate float64
+
+	c clock.Clock
+}
+
+// Pass sends an item through the LeakyBucket, returning false should its
+// bucket overflow.
+func (b *LeakyBucket) Pass(item string) (bool, error) {
+	if strings.Contains(b.Namespace, defaultSeparator) {
+		return false, ErrInvalidNamespace
+	}
+	key := b.Namespace + defaultSeparator + item
+
+	c, err := getConn(context.Background(), poolOf(b.Pool, b.ConnPool), key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	now := Now()
+	if b.c != nil {
+		now = b.c.Now()
+	}
+	micronow := now.UnixNano() / int64(time.Microsecond)
+	rate := strconv.FormatFloat(b.Rate, 'f', -1, 64)
+	poured, err := redis.Int64(leakyBucketScript.run(c, key, micronow, b.Capacity, rate, b.drainMillis()))
+	if err != nil {
+		return false, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	return poured == 1, nil
+}
+
+// drainMillis returns the number of milliseconds it takes a full bucket to
+// drain, and so how long a bucket is kept without any actions.
+func (b *LeakyBucket) drainMillis() int64 {
+	if b.Rate <= 0 {
+		return math.MaxInt64 / int64(time.Millisecond)
+	}
+	return int64(math.Ceil(float64(b.Capacity) / b.Rate * 1000))
+}
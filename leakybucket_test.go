@@ -0,0 +1,64 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLeakyBucket(t *testing.T) {
+	Convey("Given a leaky bucket", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		bucket := &LeakyBucket{
+			Namespace: "leakybucket",
+			Capacity:  3,
+			Rate:      2,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := bucket.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("Actions pass until the bucket overflows", func() {
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+
+			Convey("And it drains at the rate", func() {
+				clock.AddTime(500 * time.Millisecond)
+				So([]bool{pass(), pass()}, ShouldResemble, []bool{true, false})
+			})
+
+			Convey("But never below empty", func() {
+				clock.AddTime(time.Minute)
+				So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+			})
+		})
+
+		Convey("A steady flow at the rate passes", func() {
+			for i := 0; i < 10; i++ {
+				clock.AddTime(500 * time.Millisecond)
+				So(pass(), ShouldBeTrue)
+			}
+		})
+
+		Convey("Only the level and leak time are stored", func() {
+			pass()
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			fields, err := redis.Strings(conn.Do("HKEYS", "leakybucket:foo"))
+			So(err, ShouldBeNil)
+			So(fields, ShouldHaveLength, 2)
+			ttl, err := redis.Int64(conn.Do("PTTL", "leakybucket:foo"))
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeBetweenOrEqual, 1000, 1500)
+		})
+	})
+}
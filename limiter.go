@@ -0,0 +1,23 @@
+package flowstopper
+
+// Limiter is the behavior shared by the window rate limiters of this
+// package, sliding or fixed, so that code depending on one can be handed
+// another, or a fake in tests.
+type Limiter interface {
+	// Pass sends an item through the Limiter, returning false should the
+	// rate-limit for this item be exceeded.
+	Pass(item string) (bool, error)
+
+	// Peek returns the number of actions recorded for item during the
+	// current interval, without recording one.
+	Peek(item string) (int64, error)
+}
+
+var (
+	_ Limiter = (*Stopper)(nil)
+	_ Limiter = (*MemoryLimiter)(nil)
+	_ Limiter = (*DecayWindow)(nil)
+	_ Limiter = (*BucketWindow)(nil)
+	_ Limiter = (*FixedWindow)(nil)
+	_ Limiter = (*ApproxWindow)(nil)
+)
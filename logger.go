@@ -0,0 +1,32 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+)
+
+// Logger receives the diagnostics of a Stopper. It is satisfied by the
+// standard library's *log.Logger, and adapters for other loggers are best
+// made to log at debug level, as the messages are meant for triaging
+// incidents rather than for normal operation.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf writes a diagnostic to the Logger, if any.
+func (s *Stopper) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// logError logs err unless it is an error of the caller, such as a
+// cancelled context.
+func (s *Stopper) logError(err error) {
+	for _, caller := range []error{context.Canceled, ErrClosed, ErrInvalidNamespace, ErrEmptyItem} {
+		if errors.Is(err, caller) {
+			return
+		}
+	}
+	s.logf("%v", err)
+}
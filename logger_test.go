@@ -0,0 +1,68 @@
+package flowstopper
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordingLogger keeps the messages logged to it.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	Convey("Given a stopper with a logger", t, func() {
+		conn := redigomock.NewConn()
+		stopper := newMockStopper(conn)
+		logger := &recordingLogger{}
+		stopper.Logger = logger
+		exec := expectPass(conn, stopper, "foo")
+
+		Convey("Successful decisions are not logged", func() {
+			exec.Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			_, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(logger.lines, ShouldBeEmpty)
+		})
+
+		Convey("Redis errors are logged", func() {
+			exec.ExpectError(errors.New("connection reset"))
+			_, err := stopper.Pass("foo")
+			So(err, ShouldNotBeNil)
+			So(logger.lines, ShouldResemble, []string{err.Error()})
+
+			Convey("Along with the actions let through despite them", func() {
+				logger.lines = nil
+				stopper.FailOpen = true
+				_, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(logger.lines, ShouldHaveLength, 1)
+				So(logger.lines[0], ShouldEndWith, "connection reset, failing open")
+			})
+		})
+
+		Convey("Script reloads are logged", func() {
+			exec.ExpectError(redis.Error("NOSCRIPT No matching script. Please use EVAL.")).
+				Expect([]interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil})
+			conn.Command("SCRIPT", "LOAD", passScript.source).Expect(passScript.Hash())
+			_, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(logger.lines, ShouldResemble, []string{"flowstopper: loading script " + passScript.Hash()})
+		})
+
+		Convey("Errors of the caller are not logged", func() {
+			_, err := stopper.Pass("")
+			So(err, ShouldEqual, ErrEmptyItem)
+			So(logger.lines, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package flowstopper
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WatchBeam/clock"
+)
+
+// MemoryLimiter is a Limiter keeping the sliding window of each item in
+// memory rather than redis. It makes the same decisions as a Stopper with
+// the same Interval and Limit, but is only shared within a single process,
+// which suits tests and small single-process deployments.
+type MemoryLimiter struct {
+	// The duration for which actions are tracked.
+	Interval time.Duration
+
+	// The maximum amount of actions allowed during the Interval.
+	Limit int64
+
+	// When non-zero, the most items whose windows are kept, so that memory
+	// stays bounded however many items are seen. Once reached, the window of
+	// another item, picked at random, is forgotten to make room for each new
+	// one, and its actions no longer count.
+	MaxItems int
+
+	c clock.Clock
+
+	mu      sync.Mutex
+	windows map[string][]int64
+}
+
+// Pass sends an item through the MemoryLimiter, returning false should the
+// rate-limit for this item be exceeded. Rejected actions are not recorded.
+// It never returns an error.
+func (m *MemoryLimiter) Pass(item string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nanonow := m.now().UnixNano()
+	window := m.trim(item, nanonow)
+	if int64(len(window)) >= m.Limit {
+		return false, nil
+	}
+
+	if len(window) == 0 && m.MaxItems > 0 && len(m.windows) >= m.MaxItems {
+		for other := range m.windows {
+			delete(m.windows, other)
+			break
+		}
+	}
+	i := sort.Search(len(window), func(i int) bool { return window[i] > nanonow })
+	window = append(window, 0)
+	copy(window[i+1:], window[i:])
+	window[i] = nanonow
+	if m.windows == nil {
+		m.windows = make(map[string][]int64)
+	}
+	m.windows[item] = window
+	return true, nil
+}
+
+// Peek returns the number of actions recorded for item during the current
+// interval. It never returns an error.
+func (m *MemoryLimiter) Peek(item string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return int64(len(m.trim(item, m.now().UnixNano()))), nil
+}
+
+// trim removes the entries of item's window at or before the start of the
+// interval ending at nanonow, forgetting windows left empty, and returns
+// what remains.
+func (m *MemoryLimiter) trim(item string, nanonow int64) []int64 {
+	window := m.windows[item]
+	windowStart := nanonow - m.Interval.Nanoseconds()
+	i := sort.Search(len(window), func(i int) bool { return window[i] > windowStart })
+	window = window[i:]
+	if len(window) == 0 {
+		delete(m.windows, item)
+		return nil
+	}
+	m.windows[item] = window
+	return window
+}
+
+func (m *MemoryLimiter) now() time.Time {
+	if m.c == nil {
+		return Now()
+	}
+	return m.c.Now()
+}
@@ -0,0 +1,39 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	Convey("Given an in-memory limiter", t, func() {
+		clock := clock.NewMockClock(now)
+		limiter := &MemoryLimiter{Interval: 5 * time.Second, Limit: 2, c: clock}
+		pass := func(item string) bool {
+			clock.AddTime(time.Millisecond)
+			passed, err := limiter.Pass(item)
+			So(err, ShouldBeNil)
+			return passed
+		}
+
+		Convey("Peek counts the actions in the window", func() {
+			So(pass("foo"), ShouldBeTrue)
+			So(pass("foo"), ShouldBeTrue)
+			So(pass("foo"), ShouldBeFalse)
+			count, err := limiter.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+
+			Convey("Until they expire", func() {
+				clock.AddTime(limiter.Interval)
+				count, err := limiter.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+				So(limiter.windows, ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,136 @@
+package flowstopper
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// MiddlewareOption configures the handling of blocked requests by
+// Middleware.
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	onBlocked   func(w http.ResponseWriter, r *http.Request, res PassResult)
+	monitorOnly bool
+}
+
+// WithOnBlocked makes Middleware answer blocked requests by calling
+// onBlocked with the decision, which takes full control of the response,
+// such as to return a status or body of its own.
+func WithOnBlocked(onBlocked func(w http.ResponseWriter, r *http.Request, res PassResult)) MiddlewareOption {
+	return func(cfg *middlewareConfig) {
+		cfg.onBlocked = onBlocked
+	}
+}
+
+// WithMonitorOnly makes Middleware forward blocked requests to the next
+// handler regardless, logging them to the Logger, so that a limit can be
+// rolled out by watching what it would block before enforcing it. Blocked
+// requests are still recorded in the Stats and reported to OnDecision.
+func WithMonitorOnly() MiddlewareOption {
+	return func(cfg *middlewareConfig) {
+		cfg.monitorOnly = true
+	}
+}
+
+// Middleware returns net/http middleware passing each request through the
+// Stopper under the item keyFunc derives from it. Requests exceeding the
+// rate-limit are answered with 429 Too Many Requests and the headers of a
+// RateLimitError, unless configured otherwise by opts, and others are
+// forwarded to the next handler. Should the Stopper fail, requests are
+// answered with 503 Service Unavailable, carrying a Retry-After header of
+// the ErrorRetryAfter if there is one. FailOpen lets them through should
+// redis fail, but not for errors of the caller, such as an empty item.
+func (s *Stopper) Middleware(keyFunc func(*http.Request) string, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := middlewareConfig{onBlocked: s.rejectBlocked}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			item := keyFunc(r)
+			res, err := s.pass(r.Context(), CheckRequest{Item: item}, nil)
+			switch {
+			case err != nil:
+				WriteRetryAfter(w.Header(), s.ErrorRetryAfter)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			case err == nil && !res.Allowed && cfg.monitorOnly:
+				s.logf("flowstopper: monitoring %q, which the limit would reject", s.displayItem(item))
+			case err == nil && !res.Allowed:
+				cfg.onBlocked(w, r, res)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectBlocked answers a blocked request for the item of res with 429 Too
+// Many Requests and the headers of a RateLimitError, like returned by
+// CheckOrError.
+func (s *Stopper) rejectBlocked(w http.ResponseWriter, r *http.Request, res PassResult) {
+	herr := &RateLimitError{Limit: res.Limit, RetryAfter: res.RetryAfter}
+	for k, v := range herr.Headers() {
+		w.Header()[k] = v
+	}
+	http.Error(w, http.StatusText(herr.StatusCode()), herr.StatusCode())
+}
+
+// ClientIP returns the IP address of the client which made r, for use as the
+// keyFunc of Middleware. The first address listed in the X-Forwarded-For
+// header is preferred over the address of the peer. The header is easily
+// forged, so this is only suitable behind a proxy which sets it.
+func ClientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		if i := strings.IndexByte(fwd, ','); i >= 0 {
+			fwd = fwd[:i]
+		}
+		if ip := strings.TrimSpace(fwd); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// UserOrIPKey returns a keyFunc for Middleware limiting authenticated users
+// by their ID, as found in the context of the request under ctxKey, and
+// anonymous ones by their IP address. The ID must be a non-empty string,
+// as stored by the authentication middleware in front. Items are prefixed
+// with "user:" or "ip:", so that IDs and addresses never collide.
+//
+// The address is the first in the X-Forwarded-For header which is neither
+// private, loopback nor link-local, skipping the hops of internal proxies,
+// and the address of the peer when there is none. Like with ClientIP, the
+// header is easily forged, so this is only suitable behind a proxy which
+// sets it.
+func UserOrIPKey(ctxKey interface{}) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if id, ok := r.Context().Value(ctxKey).(string); ok && id != "" {
+			return "user:" + id
+		}
+		return "ip:" + publicClientIP(r)
+	}
+}
+
+// publicClientIP returns the first public address in the X-Forwarded-For
+// header of r, or the address of the peer.
+func publicClientIP(r *http.Request) string {
+	for _, hop := range strings.Split(r.Header.Get("X-Forwarded-For"), ",") {
+		ip := net.ParseIP(strings.TrimSpace(hop))
+		if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
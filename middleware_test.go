@@ -0,0 +1,187 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiddleware(t *testing.T) {
+	Convey("Given a handler behind the middleware", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "middleware",
+			Interval:  5 * time.Second,
+			Limit:     int64(1),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		handler := stopper.Middleware(ClientIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		serve := func(remoteAddr string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Requests within the limit are forwarded", func() {
+			So(serve("192.0.2.1:1234").Code, ShouldEqual, http.StatusNoContent)
+
+			Convey("Those beyond it are rejected", func() {
+				w := serve("192.0.2.1:4321")
+				So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "5")
+
+				Convey("Until the window has room again", func() {
+					clock.AddTime(2 * time.Second)
+					w := serve("192.0.2.1:4321")
+					So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+					So(w.Header().Get("Retry-After"), ShouldEqual, "3")
+				})
+			})
+
+			Convey("Other clients are limited independently", func() {
+				So(serve("192.0.2.2:1234").Code, ShouldEqual, http.StatusNoContent)
+			})
+		})
+
+		Convey("Requests rejected by a closed gate carry no Retry-After", func() {
+			stopper.Limit = 0
+			w := serve("192.0.2.1:1234")
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "")
+			So(w.Header().Get("X-RateLimit-Limit"), ShouldEqual, "0")
+		})
+
+		Convey("Blocked requests may be answered otherwise", func() {
+			handler = stopper.Middleware(ClientIP, WithOnBlocked(func(w http.ResponseWriter, r *http.Request, res PassResult) {
+				w.Header().Set("X-Blocked-Count", strconv.FormatInt(res.Count, 10))
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			So(serve("192.0.2.1:1234").Code, ShouldEqual, http.StatusNoContent)
+			w := serve("192.0.2.1:1234")
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(w.Header().Get("X-Blocked-Count"), ShouldEqual, "2")
+		})
+
+		Convey("Blocked requests are forwarded when only monitoring", func() {
+			logger := &recordingLogger{}
+			stopper.Logger = logger
+			handler = stopper.Middleware(ClientIP, WithMonitorOnly())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			for i := 0; i < 2; i++ {
+				So(serve("192.0.2.1:1234").Code, ShouldEqual, http.StatusNoContent)
+			}
+			So(stopper.Stats(), ShouldResemble, Stats{Allowed: 1, Blocked: 1})
+			So(logger.lines, ShouldResemble, []string{`flowstopper: monitoring "192.0.2.1", which the limit would reject`})
+		})
+
+		Convey("When redis fails", func() {
+			stopper.ConnPool = &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return nil, errors.New("connection refused")
+				},
+			}
+
+			Convey("Requests are rejected", func() {
+				w := serve("192.0.2.1:1234")
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "")
+			})
+
+			Convey("With a retry hint when configured", func() {
+				stopper.ErrorRetryAfter = 1500 * time.Millisecond
+				w := serve("192.0.2.1:1234")
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "2")
+			})
+
+			Convey("Unless failing open", func() {
+				stopper.FailOpen = true
+				So(serve("192.0.2.1:1234").Code, ShouldEqual, http.StatusNoContent)
+			})
+		})
+
+		Convey("Errors of the caller are rejected even when failing open", func() {
+			stopper.FailOpen = true
+
+			Convey("Such as an empty item", func() {
+				handler = stopper.Middleware(func(*http.Request) string { return "" })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNoContent)
+				}))
+				So(serve("192.0.2.1:1234").Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+
+			Convey("Such as a closed Stopper", func() {
+				So(stopper.Close(context.Background()), ShouldBeNil)
+				So(serve("192.0.2.1:1234").Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	Convey("Given a request", t, func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+
+		Convey("The peer's address is used", func() {
+			So(ClientIP(r), ShouldEqual, "192.0.2.1")
+		})
+
+		Convey("The first forwarded address is preferred", func() {
+			r.Header.Set("X-Forwarded-For", "198.51.100.7, 192.0.2.1")
+			So(ClientIP(r), ShouldEqual, "198.51.100.7")
+		})
+	})
+}
+
+type userKey struct{}
+
+func TestUserOrIPKey(t *testing.T) {
+	Convey("Given a request", t, func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		key := UserOrIPKey(userKey{})
+
+		Convey("Anonymous clients are keyed by the peer's address", func() {
+			So(key(r), ShouldEqual, "ip:10.0.0.2")
+		})
+
+		Convey("The first public forwarded address is preferred", func() {
+			r.Header.Set("X-Forwarded-For", "192.168.1.4, garbage, 127.0.0.1, 198.51.100.7, 203.0.113.9")
+			So(key(r), ShouldEqual, "ip:198.51.100.7")
+
+			Convey("Unless every hop is private", func() {
+				r.Header.Set("X-Forwarded-For", "10.1.2.3, fe80::1")
+				So(key(r), ShouldEqual, "ip:10.0.0.2")
+			})
+		})
+
+		Convey("Authenticated users are keyed by their ID", func() {
+			r.Header.Set("X-Forwarded-For", "198.51.100.7")
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, "alice"))
+			So(key(r), ShouldEqual, "user:alice")
+
+			Convey("But not by an empty one", func() {
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, ""))
+				So(key(r), ShouldEqual, "ip:198.51.100.7")
+			})
+		})
+	})
+}
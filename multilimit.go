@@ -0,0 +1,133 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Rule is a limit of actions during an interval enforced by a MultiLimit.
+type Rule struct {
+	// The duration for which actions are tracked.
+	Interval time.Duration
+
+	// The maximum amount of actions allowed during the Interval.
+	Limit int64
+}
+
+// MultiLimit is a sliding log rate limiter enforcing several Rules at once,
+// such as 100 actions per minute and 1000 per hour. An action passes only if
+// every rule allows it, and is only recorded then, so that, unlike with a
+// Stopper per rule, an action rejected by one rule takes up no room in the
+// others. All rules share a single window per item in redis, spanning the
+// longest interval.
+type MultiLimit struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain ":".
+	Namespace string
+
+	// The rules an action must satisfy to pass.
+	Rules []Rule
+
+	c clock.Clock
+}
+
+// MultiResult is the decision of a MultiLimit.
+type MultiResult struct {
+	// Whether the action passed.
+	Allowed bool
+
+	// The index in Rules of the first rule the action exceeded, which is -1
+	// when it passed.
+	Exceeded int
+
+	// The number of actions during the interval of each rule, in the order
+	// of Rules, counting the attempted one whether recorded or not.
+	Counts []int64
+}
+
+// multiLimitScript trims the window stored at KEYS[1] of members scored at
+// or before ARGV[3], and counts the members scored after every window start
+// of ARGV[5], ARGV[7] and so on. Only when each count stays below the limit
+// following its window start is member ARGV[2], made unique as by luaUnique,
+// recorded with score ARGV[1], setting the window to expire after ARGV[4]
+// milliseconds.
+//
+// It returns the 1-based position of the first rule exceeded, or 0 if none
+// was, and the counts before recording.
+var multiLimitScript = newScript(1, luaUnique+`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+local counts = {}
+local exceeded = 0
+for i = 5, #ARGV, 2 do
+	local count = redis.call("ZCOUNT", KEYS[1], "(" .. ARGV[i], "+inf")
+	counts[#counts + 1] = count
+	if exceeded == 0 and count >= tonumber(ARGV[i + 1]) then
+		exceeded = #counts
+	end
+end
+if exceeded == 0 then
+	redis.call("ZADD", KEYS[1], ARGV[1], unique(KEYS[1], ARGV[2], 0, 1))
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return {exceeded, counts}
+`)
+
+// Pass sends an item through the MultiLimit, checking it against every rule
+// in a single script. The result tells the rule rejecting the action, if
+// any.
+func (m *MultiLimit) Pass(item string) (MultiResult, error) {
+	if strings.Contains(m.Namespace, defaultSeparator) {
+		return MultiResult{}, ErrInvalidNamespace
+	}
+	if len(m.Rules) == 0 {
+		return MultiResult{}, fmt.Errorf("%w: no rules", ErrInvalidConfig)
+	}
+	now := Now()
+	if m.c != nil {
+		now = m.c.Now()
+	}
+	key := m.Namespace + defaultSeparator + item
+
+	var longest time.Duration
+	for _, r := range m.Rules {
+		if r.Interval > longest {
+			longest = r.Interval
+		}
+	}
+	nanonow := now.UnixNano()
+	args := []interface{}{key, nanonow, nanonow, now.Add(longest * -1).UnixNano(), durationMillis(longest)}
+	for _, r := range m.Rules {
+		args = append(args, now.Add(r.Interval*-1).UnixNano(), r.Limit)
+	}
+
+	c, err := getConn(context.Background(), poolOf(m.Pool, m.ConnPool), key)
+	if err != nil {
+		return MultiResult{}, err
+	}
+	defer func() { _ = c.Close() }()
+
+	values, err := redis.Values(multiLimitScript.run(c, args...))
+	if err != nil {
+		return MultiResult{}, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	var exceeded int
+	var counts []int64
+	if _, err := redis.Scan(values, &exceeded, &counts); err != nil {
+		return MultiResult{}, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	for i := range counts {
+		counts[i]++
+	}
+	return MultiResult{Allowed: exceeded == 0, Exceeded: exceeded - 1, Counts: counts}, nil
+}
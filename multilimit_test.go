@@ -0,0 +1,55 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMultiLimit(t *testing.T) {
+	Convey("Given a limiter with several rules", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		limiter := &MultiLimit{
+			Namespace: "multilimit",
+			Rules: []Rule{
+				{Interval: time.Second, Limit: 2},
+				{Interval: time.Minute, Limit: 3},
+			},
+			ConnPool: &connPool,
+			c:        clock,
+		}
+		pass := func() MultiResult {
+			clock.AddTime(time.Millisecond)
+			r, err := limiter.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		Convey("Actions pass while every rule allows them", func() {
+			So(pass(), ShouldResemble, MultiResult{Allowed: true, Exceeded: -1, Counts: []int64{1, 1}})
+			So(pass().Allowed, ShouldBeTrue)
+
+			Convey("The shortest rule binds first", func() {
+				So(pass(), ShouldResemble, MultiResult{Allowed: false, Exceeded: 0, Counts: []int64{3, 3}})
+
+				Convey("And the rejection took up no room in the longer one", func() {
+					clock.AddTime(time.Second)
+					So(pass().Allowed, ShouldBeTrue)
+					So(pass(), ShouldResemble, MultiResult{Allowed: false, Exceeded: 1, Counts: []int64{2, 4}})
+				})
+			})
+		})
+
+		Convey("A limiter without rules is invalid", func() {
+			limiter.Rules = nil
+			_, err := limiter.Pass("foo")
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,326 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// scanCount is the number of keys asked for with every SCAN.
+const scanCount = 100
+
+// globEscaper escapes the characters special to redis' glob-style patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// scanNamespace pages through the keys of every item under the Namespace
+// with SCAN, calling fn with each batch, so that large keyspaces are walked
+// without blocking redis like KEYS would. Keys may show up more than once,
+// or no longer exist by the time fn is called. With a ShardedPool, every
+// shard is scanned in turn. It fails with ErrInvalidConfig for a Stopper
+// with a KeyFunc, whose keys it can't tell.
+func (s *Stopper) scanNamespace(ctx context.Context, fn func(c Conn, keys []string) error) error {
+	if s.KeyFunc != nil {
+		return fmt.Errorf("%w: keys built by KeyFunc can't be listed", ErrInvalidConfig)
+	}
+	if strings.Contains(s.Namespace, s.separator()) {
+		return ErrInvalidNamespace
+	}
+	for _, p := range shardsOf(s.pool()) {
+		if err := s.scanShard(ctx, p, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanShard is scanNamespace for the redis behind p.
+func (s *Stopper) scanShard(ctx context.Context, p Pool, fn func(c Conn, keys []string) error) error {
+	c, err := s.connTo(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	pattern := globEscaper.Replace(s.Namespace+s.separator()) + "*"
+	cursor := "0"
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return fmt.Errorf("flowstopper: scanning %q: %w", s.Namespace, err)
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return fmt.Errorf("flowstopper: scanning %q: %w", s.Namespace, err)
+		}
+		if len(keys) > 0 {
+			if err := fn(c, keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// ResetNamespace clears the windows and every other state of all items
+// under the Namespace, such as between tests. Keys are found with SCAN in
+// batches, so it does not block redis, but items passed while it runs may
+// or may not be cleared. It fails with ErrInvalidConfig for a Stopper with a
+// KeyFunc.
+func (s *Stopper) ResetNamespace() error {
+	return s.scanNamespace(context.Background(), func(c Conn, keys []string) error {
+		args := make([]interface{}, len(keys))
+		for i, k := range keys {
+			args[i] = k
+		}
+		if _, err := c.Do("DEL", args...); err != nil {
+			return fmt.Errorf("flowstopper: resetting %q: %w", s.Namespace, err)
+		}
+		return nil
+	})
+}
+
+// DrainNamespace deletes every key under the Namespace like ResetNamespace,
+// but is meant to be called on shutdown for namespaces living only as long
+// as a deployment, so that their state does not pile up across deploys. It
+// stops with ctx's error once ctx is done, so that a slow redis does not
+// hold up the shutdown, and logs how many keys it deleted to the Logger,
+// even if it stopped early. It is best-effort: should redis be unreachable,
+// it returns the error without retrying, leaving the keys to expire on
+// their own. It must be called before Close, and fails with
+// ErrInvalidConfig for a Stopper with a KeyFunc.
+func (s *Stopper) DrainNamespace(ctx context.Context) error {
+	var removed int64
+	err := s.scanNamespace(ctx, func(c Conn, keys []string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		args := make([]interface{}, len(keys))
+		for i, k := range keys {
+			args[i] = k
+		}
+		n, err := redis.Int64(c.Do("DEL", args...))
+		if err != nil {
+			return fmt.Errorf("flowstopper: draining %q: %w", s.Namespace, err)
+		}
+		removed += n
+		return nil
+	})
+	s.logf("flowstopper: drained %q, deleting %d keys", s.Namespace, removed)
+	return err
+}
+
+// auxKinds are the kinds of auxiliary keys kept next to an item's window.
+var auxKinds = []string{"grace", "free", "debounce", "offenses", "lockouts", "penalty", "global", "blocked", "limit", "weights"}
+
+// ActiveItems returns the items under the Namespace whose windows hold
+// actions during the current interval, in lexical order, such as for an
+// admin dashboard. Like ResetNamespace it pages through the keys with SCAN,
+// and fails with ErrInvalidConfig for a Stopper with a KeyFunc.
+func (s *Stopper) ActiveItems() ([]string, error) {
+	counts, err := s.ActiveItemCounts()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, len(counts))
+	for item := range counts {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+// ActiveItemCounts is like ActiveItems, but returns the number of actions in
+// the window of each item as counted by Peek, to show which are close to
+// their limit.
+func (s *Stopper) ActiveItemCounts() (map[string]int64, error) {
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	var items []string
+	err := s.scanNamespace(ctx, func(c Conn, keys []string) error {
+		for _, k := range keys {
+			item, ok := s.itemOf(k)
+			if ok && !seen[item] {
+				seen[item] = true
+				items = append(items, item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	for _, item := range items {
+		count, err := s.count(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			counts[item] = count
+		}
+	}
+	return counts, nil
+}
+
+// NamespaceStats summarizes the items under a Namespace.
+type NamespaceStats struct {
+	// The number of items whose windows hold actions during the current
+	// interval.
+	ActiveItems int
+
+	// The number of those at or over their limit, the one set by SetLimit
+	// if any, whose next action would be rejected.
+	BlockedItems int
+}
+
+// NamespaceStats counts the items under the Namespace which are active and
+// blocked, for a high-level view of its health. The windows are counted page
+// by page as SCAN returns them, without being trimmed, so that large
+// keyspaces are summarized holding only the keys already counted in memory,
+// as SCAN may return a key more than once. Like ResetNamespace it fails with
+// ErrInvalidConfig for a Stopper with a KeyFunc.
+func (s *Stopper) NamespaceStats() (NamespaceStats, error) {
+	var stats NamespaceStats
+	seen := make(map[string]bool)
+	err := s.scanNamespace(context.Background(), func(c Conn, keys []string) error {
+		windowStart := s.now().Add(s.Interval * -1).UnixNano()
+		var tx transaction
+		for _, k := range keys {
+			item, ok := s.itemOf(k)
+			if !ok || seen[k] {
+				continue
+			}
+			limitKey, err := s.limitKey(item)
+			if err != nil {
+				continue
+			}
+			seen[k] = true
+			tx.add("ZCOUNT", k, exclusive(windowStart), "+inf")
+			tx.add("GET", limitKey)
+			tx.add("ZRANGEBYSCORE", weightsArgs(k, windowStart)...)
+		}
+		if len(tx.cmds) == 0 {
+			return nil
+		}
+		values, err := tx.exec(c)
+		if err != nil {
+			return fmt.Errorf("flowstopper: counting %q: %w", s.Namespace, err)
+		}
+		for i := 0; i < len(values); i += 3 {
+			// Keys of other types in the Namespace fail to be counted, and
+			// are left out.
+			count, err := redis.Int64(values[i], nil)
+			if err != nil || count == 0 {
+				continue
+			}
+			weighted, err := redis.Strings(values[i+2], nil)
+			if err != nil {
+				continue
+			}
+			count += parseWeights(weighted).extra()
+			limit, err := s.effectiveLimit(values[i+1])
+			if err != nil {
+				continue
+			}
+			stats.ActiveItems++
+			if !admits(count, 1, limit) {
+				stats.BlockedItems++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return NamespaceStats{}, err
+	}
+	return stats, nil
+}
+
+// Cleanup trims the expired actions from the windows of all items under the
+// Namespace, such as left behind without a TTL by older versions, returning
+// how many windows that emptied, which redis then deletes. Windows still
+// holding actions but lacking a TTL are set to expire after the Interval.
+// As windows are trimmed by the Interval, it must not be used on a Stopper
+// whose items are also checked against longer intervals.
+//
+// Like ResetNamespace it pages through the keys with SCAN, and fails with
+// ErrInvalidConfig for a Stopper with a KeyFunc. It stops with ctx's error
+// once ctx is done, having cleaned up the windows found until then.
+func (s *Stopper) Cleanup(ctx context.Context) (removed int, err error) {
+	err = s.scanNamespace(ctx, func(c Conn, keys []string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		windowStart := s.now().Add(s.Interval * -1).UnixNano()
+		var windows []string
+		var tx transaction
+		for _, k := range keys {
+			if _, ok := s.itemOf(k); !ok {
+				continue
+			}
+			windows = append(windows, k)
+			tx.add("ZREMRANGEBYSCORE", k, "-inf", windowStart)
+			tx.add("PTTL", k)
+		}
+		if len(windows) == 0 {
+			return nil
+		}
+		values, err := tx.exec(c)
+		if err != nil {
+			return fmt.Errorf("flowstopper: cleaning up %q: %w", s.Namespace, err)
+		}
+		for i, k := range windows {
+			// Keys of other types in the Namespace fail to be trimmed,
+			// and are left alone.
+			trimmed, err := redis.Int64(values[2*i], nil)
+			if err != nil {
+				continue
+			}
+			ttl, err := redis.Int64(values[2*i+1], nil)
+			if err != nil {
+				continue
+			}
+			switch {
+			case ttl == -2 && trimmed > 0:
+				removed++
+			case ttl == -1:
+				if _, err := c.Do("PEXPIRE", k, durationMillis(s.Interval)); err != nil {
+					return fmt.Errorf("flowstopper: cleaning up %q: %w", s.Namespace, err)
+				}
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// itemOf returns the item whose window is stored at key, reporting false
+// for auxiliary keys and keys not built by Key.
+func (s *Stopper) itemOf(key string) (string, bool) {
+	for _, kind := range auxKinds {
+		if strings.HasSuffix(key, "#"+kind) {
+			return "", false
+		}
+	}
+	item := strings.TrimPrefix(key, s.Namespace+s.separator())
+	if s.IntervalKeys {
+		// Windows of other intervals are not those of the Stopper.
+		suffix := s.windowKey("", s.Interval)
+		if !strings.HasSuffix(item, suffix) {
+			return "", false
+		}
+		item = strings.TrimSuffix(item, suffix)
+	}
+	if s.HashTag {
+		if !strings.HasPrefix(item, "{") || !strings.HasSuffix(item, "}") {
+			return "", false
+		}
+		item = item[1 : len(item)-1]
+	}
+	return item, true
+}
@@ -0,0 +1,243 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResetNamespace(t *testing.T) {
+	Convey("Given a stopper with many items", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "resetns",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		other := &Stopper{
+			Namespace: "resetnsother",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		items := make([]string, 3*scanCount)
+		for i := range items {
+			items[i] = fmt.Sprintf("item%d", i)
+			_, err := stopper.Pass(items[i])
+			So(err, ShouldBeNil)
+		}
+		So(stopper.ResetWithGrace(items[0], time.Minute), ShouldBeNil)
+		_, err := other.Pass("foo")
+		So(err, ShouldBeNil)
+
+		Convey("Resetting the namespace clears every item", func() {
+			So(stopper.ResetNamespace(), ShouldBeNil)
+			for _, item := range items {
+				count, err := stopper.Peek(item)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			}
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			exists, err := conn.Do("EXISTS", "resetns:"+items[0]+"#grace")
+			So(err, ShouldBeNil)
+			So(exists, ShouldEqual, 0)
+
+			Convey("But leaves other namespaces alone", func() {
+				count, err := other.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+			})
+		})
+
+		Convey("Keys built by a KeyFunc can't be reset", func() {
+			stopper.KeyFunc = func(namespace, item string) string { return item }
+			So(errors.Is(stopper.ResetNamespace(), ErrInvalidConfig), ShouldBeTrue)
+		})
+	})
+}
+
+func TestDrainNamespace(t *testing.T) {
+	Convey("Given a stopper for an ephemeral namespace", t, func() {
+		flushRealRedis(t)
+		logger := &recordingLogger{}
+		stopper := &Stopper{
+			Namespace: "drainns",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			Logger:    logger,
+			c:         clock.NewMockClock(now),
+		}
+		for i := 0; i < 2*scanCount; i++ {
+			_, err := stopper.Pass(fmt.Sprintf("item%d", i))
+			So(err, ShouldBeNil)
+		}
+		So(stopper.ResetWithGrace("item0", time.Minute), ShouldBeNil)
+
+		Convey("Draining deletes every key and logs how many", func() {
+			So(stopper.DrainNamespace(context.Background()), ShouldBeNil)
+			items, err := stopper.ActiveItems()
+			So(err, ShouldBeNil)
+			So(items, ShouldBeEmpty)
+			So(logger.lines, ShouldResemble, []string{fmt.Sprintf(`flowstopper: drained "drainns", deleting %d keys`, 2*scanCount)})
+		})
+
+		Convey("Draining stops once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(stopper.DrainNamespace(ctx), ShouldEqual, context.Canceled)
+			count, err := stopper.Peek("item1")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("Draining an unreachable redis fails without hanging", func() {
+			stopper.ConnPool = &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return nil, errors.New("connection refused")
+				},
+			}
+			err := stopper.DrainNamespace(context.Background())
+			So(errors.Is(err, ErrConnUnavailable), ShouldBeTrue)
+		})
+	})
+}
+
+func TestActiveItems(t *testing.T) {
+	Convey("Given a stopper with a few items", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "activeitems",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func(item string) {
+			clock.AddTime(time.Millisecond)
+			_, err := stopper.Pass(item)
+			So(err, ShouldBeNil)
+		}
+		pass("old")
+		clock.AddTime(stopper.Interval)
+		pass("bob")
+		pass("alice")
+		pass("alice")
+		So(stopper.ResetWithGrace("carol", time.Minute), ShouldBeNil)
+
+		Convey("Those with actions in their window are listed", func() {
+			items, err := stopper.ActiveItems()
+			So(err, ShouldBeNil)
+			So(items, ShouldResemble, []string{"alice", "bob"})
+
+			counts, err := stopper.ActiveItemCounts()
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[string]int64{"alice": 2, "bob": 1})
+		})
+
+		Convey("The namespace stats count the active and blocked items", func() {
+			pass("alice")
+			stats, err := stopper.NamespaceStats()
+			So(err, ShouldBeNil)
+			So(stats, ShouldResemble, NamespaceStats{ActiveItems: 2, BlockedItems: 1})
+		})
+
+		Convey("Hash tagged items are listed without their braces", func() {
+			stopper.Namespace = "activeitemstagged"
+			stopper.HashTag = true
+			pass("dave")
+			items, err := stopper.ActiveItems()
+			So(err, ShouldBeNil)
+			So(items, ShouldResemble, []string{"dave"})
+		})
+
+		Convey("Items are listed under a custom separator", func() {
+			stopper.Namespace = "activeitems:sep"
+			stopper.Separator = "|"
+			pass("erin")
+			So(stopper.Key("erin"), ShouldEqual, "activeitems:sep|erin")
+			items, err := stopper.ActiveItems()
+			So(err, ShouldBeNil)
+			So(items, ShouldResemble, []string{"erin"})
+
+			Convey("And namespaces containing it are rejected", func() {
+				stopper.Namespace = "activeitems|sep"
+				_, err := stopper.Pass("erin")
+				So(err, ShouldEqual, ErrInvalidNamespace)
+			})
+		})
+	})
+}
+
+func TestCleanup(t *testing.T) {
+	Convey("Given a stopper with windows left behind without a TTL", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "cleanup",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		conn := connPool.Get()
+		defer func() { _ = conn.Close() }()
+		expired := now.Add(-time.Minute).UnixNano()
+		for i := 0; i < 3; i++ {
+			_, err := conn.Do("ZADD", stopper.Key(fmt.Sprintf("stale%d", i)), expired, "1")
+			So(err, ShouldBeNil)
+		}
+		_, err := conn.Do("ZADD", stopper.Key("live"), expired, "1", now.UnixNano(), "2")
+		So(err, ShouldBeNil)
+		_, err = conn.Do("SET", stopper.Key("other"), "x")
+		So(err, ShouldBeNil)
+		_, err = stopper.Pass("fresh")
+		So(err, ShouldBeNil)
+
+		Convey("Cleaning up removes the expired windows", func() {
+			removed, err := stopper.Cleanup(context.Background())
+			So(err, ShouldBeNil)
+			So(removed, ShouldEqual, 3)
+			exists, err := redis.Bool(conn.Do("EXISTS", stopper.Key("stale0")))
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+			count, err := stopper.Peek("fresh")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			Convey("And sets the live ones to expire", func() {
+				ttl, err := redis.Int64(conn.Do("PTTL", stopper.Key("live")))
+				So(err, ShouldBeNil)
+				So(ttl, ShouldBeBetweenOrEqual, 1, 5000)
+				count, err := stopper.Peek("live")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+				exists, err := redis.Bool(conn.Do("EXISTS", stopper.Key("other")))
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+			})
+		})
+
+		Convey("Cleaning up stops once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := stopper.Cleanup(ctx)
+			So(err, ShouldEqual, context.Canceled)
+			count, err := redis.Int64(conn.Do("EXISTS", stopper.Key("stale0")))
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+	})
+}
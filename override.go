@@ -0,0 +1,83 @@
+package flowstopper
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// SetLimit overrides the Limit for item with limit, persisted in redis next
+// to the item's window, so that operators can change quotas at runtime
+// without reconstructing the Stopper. The override is kept per item rather
+// than per window, so that it applies to the windows of every interval alike
+// with IntervalKeys, and is read by every method deciding on actions or
+// telling how close to the limit the item is, from Pass, PassBatch and
+// TryPassN to Check, IsBlocked, Remaining and RetryAfter, on every instance
+// from the next call on. It takes the place of the limits of CheckRequests
+// too. A limit below one removes the override, falling back to the Stopper's
+// Limit again, while a Limit of zero or less closes the gate regardless of
+// any override. Overrides outlive Reset, as they are configuration rather
+// than state, but not ResetNamespace. With a ShardedPool and IntervalKeys,
+// it is stored on the shard of the window of the Interval, and only reaches
+// the windows of other intervals stored there.
+func (s *Stopper) SetLimit(item string, limit int64) error {
+	window, err := s.key(item)
+	if err != nil {
+		return err
+	}
+	key, err := s.limitKey(item)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.conn(window)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if limit < 1 {
+		_, err = c.Do("DEL", key)
+	} else {
+		_, err = c.Do("SET", key, limit)
+	}
+	if err != nil {
+		return s.itemError(item, err)
+	}
+	return nil
+}
+
+// limitKey returns the key holding the limit SetLimit set for item, which
+// the windows of all its intervals share.
+func (s *Stopper) limitKey(item string) (string, error) {
+	key, err := s.validKeyIn(s.Namespace, item)
+	if err != nil {
+		return "", err
+	}
+	return auxKey(key, "limit"), nil
+}
+
+// limitFor returns the limit the actions for item are checked against,
+// reading the override stored at limitKey on c.
+func (s *Stopper) limitFor(c Conn, item string) (int64, error) {
+	if s.Limit <= 0 {
+		return s.Limit, nil
+	}
+	key, err := s.limitKey(item)
+	if err != nil {
+		return 0, err
+	}
+	v, err := c.Do("GET", key)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	return s.effectiveLimit(v)
+}
+
+// effectiveLimit returns the limit told by v, the reply to a GET of the
+// limitKey of an item: the one set by SetLimit, or the Limit without an
+// override or while the Limit closes the gate.
+func (s *Stopper) effectiveLimit(v interface{}) (int64, error) {
+	if v == nil || s.Limit <= 0 {
+		return s.Limit, nil
+	}
+	return redis.Int64(v, nil)
+}
@@ -0,0 +1,142 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSetLimit(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "override",
+			Interval:  5 * time.Second,
+			Limit:     int64(1),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func(item string) PassResult {
+			clock.AddTime(time.Millisecond)
+			r, err := stopper.PassResult(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		Convey("An item's limit can be raised at runtime", func() {
+			So(pass("foo").Allowed, ShouldBeTrue)
+			So(pass("foo").Allowed, ShouldBeFalse)
+
+			So(stopper.SetLimit("foo", 3), ShouldBeNil)
+			r := pass("foo")
+			So(r.Allowed, ShouldBeTrue)
+			So(r.Limit, ShouldEqual, 3)
+			So(r.Remaining, ShouldEqual, 1)
+			So(pass("foo").Allowed, ShouldBeTrue)
+			So(pass("foo").Allowed, ShouldBeFalse)
+
+			Convey("Leaving other items at the default", func() {
+				So(pass("bar").Allowed, ShouldBeTrue)
+				So(pass("bar").Allowed, ShouldBeFalse)
+			})
+
+			Convey("Until the override is removed", func() {
+				So(stopper.SetLimit("foo", 0), ShouldBeNil)
+				clock.AddTime(stopper.Interval)
+				So(pass("foo").Allowed, ShouldBeTrue)
+				So(pass("foo").Allowed, ShouldBeFalse)
+			})
+
+			Convey("Surviving a reset", func() {
+				So(stopper.Reset("foo"), ShouldBeNil)
+				So(pass("foo").Allowed, ShouldBeTrue)
+				So(pass("foo").Allowed, ShouldBeTrue)
+			})
+		})
+
+		Convey("Batched checks see the override too", func() {
+			So(stopper.SetLimit("foo", 2), ShouldBeNil)
+			results, err := stopper.PassBatch([]CheckRequest{{Item: "foo"}, {Item: "foo"}, {Item: "foo"}})
+			So(err, ShouldBeNil)
+			So([]bool{results[0].Allowed, results[1].Allowed, results[2].Allowed}, ShouldResemble, []bool{true, true, false})
+		})
+
+		Convey("The checks not recording actions compare to the override", func() {
+			So(pass("foo").Allowed, ShouldBeTrue)
+			So(stopper.SetLimit("foo", 3), ShouldBeNil)
+
+			blocked, err := stopper.IsBlocked("foo")
+			So(err, ShouldBeNil)
+			So(blocked, ShouldBeFalse)
+			remaining, err := stopper.Remaining("foo")
+			So(err, ShouldBeNil)
+			So(remaining, ShouldEqual, 2)
+			usage, err := stopper.Usage("foo")
+			So(err, ShouldBeNil)
+			So(usage, ShouldAlmostEqual, 1.0/3)
+			peek, err := stopper.PeekResult("foo")
+			So(err, ShouldBeNil)
+			So(peek.Limit, ShouldEqual, 3)
+			So(peek.Blocked, ShouldBeFalse)
+			wait, err := stopper.RetryAfter("foo")
+			So(err, ShouldBeNil)
+			So(wait, ShouldEqual, 0)
+
+			Convey("Agreeing with Pass once it is reached", func() {
+				So(pass("foo").Allowed, ShouldBeTrue)
+				So(pass("foo").Allowed, ShouldBeTrue)
+				blocked, err := stopper.IsBlocked("foo")
+				So(err, ShouldBeNil)
+				So(blocked, ShouldBeTrue)
+				So(pass("foo").Allowed, ShouldBeFalse)
+				stats, err := stopper.NamespaceStats()
+				So(err, ShouldBeNil)
+				So(stats, ShouldResemble, NamespaceStats{ActiveItems: 1, BlockedItems: 1})
+			})
+		})
+
+		Convey("Partial batches are admitted up to the override", func() {
+			So(stopper.SetLimit("foo", 4), ShouldBeNil)
+			admitted, err := stopper.TryPassN("foo", 10)
+			So(err, ShouldBeNil)
+			So(admitted, ShouldEqual, 4)
+		})
+
+		Convey("Deduplicated actions are limited by the override", func() {
+			So(stopper.SetLimit("foo", 2), ShouldBeNil)
+			for _, id := range []string{"a", "b"} {
+				passed, err := stopper.PassUnique("foo", id)
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+			passed, err := stopper.PassUnique("foo", "c")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+		})
+
+		Convey("With interval keys, the override applies to every interval", func() {
+			stopper.IntervalKeys = true
+			So(stopper.SetLimit("foo", 2), ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				passed, err := stopper.PassWith("foo", 1, time.Minute)
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+			passed, err := stopper.PassWith("foo", 1, time.Minute)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+		})
+
+		Convey("Lowering it takes effect as well", func() {
+			stopper.Limit = 5
+			So(stopper.SetLimit("foo", 1), ShouldBeNil)
+			So(pass("foo").Allowed, ShouldBeTrue)
+			So(pass("foo").Allowed, ShouldBeFalse)
+		})
+	})
+}
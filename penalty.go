@@ -0,0 +1,169 @@
+package flowstopper
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Penalty configures the escalating lockouts of a Stopper. Once an item has
+// been rejected for exceeding the limit Offenses times within Window, every
+// action for it is rejected for a lockout period, whatever its window holds.
+// The first lockout lasts Base, and each one following it twice as long as
+// the previous, up to Max. An item which goes a Window past the end of its
+// lockout without being locked out again starts over from Base.
+//
+// Rejections during a lockout, and those of SoftLimit, are not offenses.
+// Only the rejections of Pass and the methods deciding like it, such as
+// PassN and PassResult, count as offenses, while the lockouts apply to
+// PassBatch, PassMulti, TryPassN, PassUnique, PassGlobal and Reserve as well.
+type Penalty struct {
+	// The number of rejections within Window which trigger a lockout.
+	// NewStopper refuses values below 1, which are otherwise taken as 1.
+	Offenses int64
+
+	// The duration over which offenses are counted, which NewStopper
+	// requires to be positive.
+	Window time.Duration
+
+	// The length of the first lockout, which NewStopper requires to be
+	// positive. Lockouts last at least a millisecond, however short it is.
+	Base time.Duration
+
+	// The length no lockout exceeds. Lockouts don't escalate when it is
+	// below Base, and NewStopper refuses it when negative.
+	Max time.Duration
+}
+
+// validate returns an error wrapping ErrInvalidConfig should any of the
+// fields of p be out of range, as checked by NewStopper.
+func (p *Penalty) validate() error {
+	switch {
+	case p.Offenses < 1:
+		return fmt.Errorf("%w: penalty offenses %d is not positive", ErrInvalidConfig, p.Offenses)
+	case p.Window <= 0:
+		return fmt.Errorf("%w: penalty window %s is not positive", ErrInvalidConfig, p.Window)
+	case p.Base <= 0:
+		return fmt.Errorf("%w: penalty base %s is not positive", ErrInvalidConfig, p.Base)
+	case p.Max < 0:
+		return fmt.Errorf("%w: penalty max %s is negative", ErrInvalidConfig, p.Max)
+	}
+	return nil
+}
+
+// offenseScript counts an offense at KEYS[1], which expires ARGV[3]
+// milliseconds after the first. Once there are ARGV[2] of them, they are
+// cleared and the item is locked out: the lockouts counted at KEYS[2] set the
+// lockout's length, ARGV[4] microseconds doubling with each one up to ARGV[5],
+// and its end is stored at KEYS[3], for at least a millisecond, as redis
+// refuses to expire keys any sooner. Times are in microseconds since the
+// epoch, which Lua's numbers represent exactly.
+//
+// It returns the end of the lockout, or nil if the item was not locked out.
+var offenseScript = newScript(3, `
+local offenses = redis.call("INCR", KEYS[1])
+if offenses == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+if offenses < tonumber(ARGV[2]) then
+	return false
+end
+redis.call("DEL", KEYS[1])
+local lockouts = redis.call("INCR", KEYS[2])
+local penalty = math.min(tonumber(ARGV[4]) * 2 ^ (lockouts - 1), math.max(tonumber(ARGV[4]), tonumber(ARGV[5])))
+local ms = math.max(1, math.ceil(penalty / 1000))
+local lockedUntil = string.format("%.0f", tonumber(ARGV[1]) + penalty)
+redis.call("SET", KEYS[3], lockedUntil, "PX", ms)
+redis.call("PEXPIRE", KEYS[2], ms + tonumber(ARGV[3]))
+return lockedUntil
+`)
+
+// PenaltyUntil returns the time until which item is locked out by the
+// Penalty, or the zero time if it isn't.
+func (s *Stopper) PenaltyUntil(item string) (time.Time, error) {
+	key, err := s.key(item)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { _ = c.Close() }()
+
+	until, err := s.lockedUntil(c, key, s.now())
+	if err != nil {
+		return time.Time{}, s.itemError(item, err)
+	}
+	return until, nil
+}
+
+// lockedUntil returns the end of the lockout of the item stored at key, or
+// the zero time if it is not locked out at now.
+func (s *Stopper) lockedUntil(c Conn, key string, now time.Time) (time.Time, error) {
+	reply, err := c.Do("GET", auxKey(key, "penalty"))
+	return lockoutEnd(reply, err, now)
+}
+
+// lockedOut returns whether each of the items stored at keys is locked out
+// at now, reading the ends of their lockouts in a single round trip.
+func (s *Stopper) lockedOut(c Conn, keys []string, now time.Time) ([]bool, error) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = auxKey(key, "penalty")
+	}
+	values, err := redis.Values(c.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(keys) {
+		return nil, fmt.Errorf("flowstopper: MGET returned %d replies to %d keys", len(values), len(keys))
+	}
+	locked := make([]bool, len(keys))
+	for i, v := range values {
+		until, err := lockoutEnd(v, nil, now)
+		if err != nil {
+			return nil, err
+		}
+		locked[i] = !until.IsZero()
+	}
+	return locked, nil
+}
+
+// lockoutEnd returns the end of the lockout replied by GET, or the zero time
+// if there is none or it is over at now.
+func lockoutEnd(reply interface{}, err error, now time.Time) (time.Time, error) {
+	micros, err := redis.Int64(reply, err)
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	until := time.Unix(0, micros*int64(time.Microsecond))
+	if !now.Before(until) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// offend counts an offense of the item stored at key at now, returning the
+// end of the lockout it triggers, or the zero time if it triggers none.
+func (s *Stopper) offend(c Conn, key string, now time.Time) (time.Time, error) {
+	p := s.Penalty
+	offenses := p.Offenses
+	if offenses < 1 {
+		offenses = 1
+	}
+	until, err := redis.Int64(offenseScript.run(c, auxKey(key, "offenses"), auxKey(key, "lockouts"), auxKey(key, "penalty"),
+		now.UnixNano()/int64(time.Microsecond), offenses, durationMillis(p.Window), int64(p.Base/time.Microsecond), int64(p.Max/time.Microsecond)))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, until*int64(time.Microsecond)), nil
+}
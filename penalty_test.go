@@ -0,0 +1,124 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPenalty(t *testing.T) {
+	Convey("Given a stopper with escalating lockouts", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "penalty",
+			Interval:  5 * time.Second,
+			Limit:     int64(1),
+			ConnPool:  &connPool,
+			Penalty: &Penalty{
+				Offenses: 2,
+				Window:   time.Minute,
+				Base:     time.Minute,
+				Max:      3 * time.Minute,
+			},
+			c: clock,
+		}
+		pass := func() PassResult {
+			r, err := stopper.PassResult("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+		until := func() time.Time {
+			u, err := stopper.PenaltyUntil("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return u
+		}
+		offend := func() {
+			pass()
+			So(pass().Allowed, ShouldBeFalse)
+			So(pass().Allowed, ShouldBeFalse)
+		}
+
+		Convey("A single offense doesn't lock the item out", func() {
+			pass()
+			So(pass().Allowed, ShouldBeFalse)
+			So(until().IsZero(), ShouldBeTrue)
+			clock.AddTime(5 * time.Second)
+			So(pass().Allowed, ShouldBeTrue)
+		})
+
+		Convey("Repeated offenses lock the item out", func() {
+			offend()
+			So(until(), ShouldResemble, clock.Now().Add(time.Minute))
+
+			Convey("Actions are rejected throughout the lockout", func() {
+				clock.AddTime(30 * time.Second)
+				r := pass()
+				So(r.Allowed, ShouldBeFalse)
+				So(r.RetryAfter, ShouldEqual, 30*time.Second)
+
+				clock.AddTime(30 * time.Second)
+				So(pass().Allowed, ShouldBeTrue)
+				So(until().IsZero(), ShouldBeTrue)
+			})
+
+			Convey("Every variant of Pass rejects the item throughout", func() {
+				clock.AddTime(30 * time.Second)
+				results, err := stopper.PassBatch([]CheckRequest{{Item: "foo"}, {Item: "bar"}})
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []Result{{Allowed: false}, {Allowed: true, Count: 1}})
+				passed, err := stopper.PassMulti([]string{"foo"})
+				So(err, ShouldBeNil)
+				So(passed, ShouldResemble, []bool{false})
+				admitted, err := stopper.TryPassN("foo", 1)
+				So(err, ShouldBeNil)
+				So(admitted, ShouldEqual, 0)
+				unique, err := stopper.PassUnique("foo", "req-1")
+				So(err, ShouldBeNil)
+				So(unique, ShouldBeFalse)
+				stopper.GlobalLimit = 10
+				global, err := stopper.PassGlobal("foo")
+				So(err, ShouldBeNil)
+				So(global, ShouldResemble, GlobalResult{Constraint: ConstraintItem})
+				r, err := stopper.Reserve("foo")
+				So(err, ShouldBeNil)
+				So(r.OK(), ShouldBeFalse)
+
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			})
+
+			Convey("Further lockouts double up to the cap", func() {
+				clock.AddTime(time.Minute)
+				offend()
+				So(until(), ShouldResemble, clock.Now().Add(2*time.Minute))
+
+				clock.AddTime(2 * time.Minute)
+				offend()
+				So(until(), ShouldResemble, clock.Now().Add(3*time.Minute))
+			})
+
+			Convey("Resetting the item lifts the lockout", func() {
+				So(stopper.Reset("foo"), ShouldBeNil)
+				So(until().IsZero(), ShouldBeTrue)
+				So(pass().Allowed, ShouldBeTrue)
+			})
+		})
+
+		Convey("Lockouts shorter than a millisecond still lock the item out", func() {
+			stopper.Penalty.Base = 500 * time.Microsecond
+			offend()
+			So(until(), ShouldResemble, clock.Now().Add(500*time.Microsecond))
+			So(pass().Allowed, ShouldBeFalse)
+			clock.AddTime(time.Millisecond)
+			So(until().IsZero(), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,122 @@
+package flowstopper
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrInvalidToken is returned by Commit for a token which was not returned
+// by Probe.
+var ErrInvalidToken = errors.New("flowstopper: invalid probe token")
+
+// defaultProbeTTL is the ProbeTTL of a Stopper not setting one.
+const defaultProbeTTL = 30 * time.Second
+
+// Probe takes a slot in the window for item like Pass, but holds it only
+// for the ProbeTTL unless committed, returning a token by which Commit
+// turns it into a regular pass, such as for a saga confirming the action in
+// a later step. Unlike a Reservation, the token carries all Commit needs,
+// so that the slot may be committed by another process sharing the
+// Namespace. Like with ReserveWithTTL, an uncommitted slot is released once
+// the ProbeTTL elapses, without a call to Cancel. The slot is taken by
+// ReserveWithTTL, so that the same checks apply to it.
+//
+// When the rate-limit for item is exceeded no slot is taken, and the token
+// is empty.
+func (s *Stopper) Probe(item string) (token string, ok bool, err error) {
+	ttl := s.ProbeTTL
+	if ttl <= 0 {
+		ttl = defaultProbeTTL
+	}
+	r, err := s.ReserveWithTTL(item, ttl)
+	if err != nil || !r.OK() {
+		return "", false, err
+	}
+	raw := strings.Join([]string{strconv.FormatInt(r.at.UnixNano(), 10), strconv.FormatInt(r.expires.UnixNano(), 10), r.member, item}, " ")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw)), true, nil
+}
+
+// Commit turns the slot taken by Probe under token into a regular pass
+// recorded at the time of the probe, reporting whether it did. It reports
+// false once the ProbeTTL of the probe has elapsed on the Stopper's clock,
+// having released the slot, in which case the action must be probed anew.
+// The expiry is judged by the clock of the committing Stopper, which must
+// agree with that of the probing one. Committing a token more than once
+// reports true each time, so that confirmations may be retried. It fails
+// with ErrInvalidToken for a token not returned by Probe.
+func (s *Stopper) Commit(token string) (bool, error) {
+	r, err := s.probed(token)
+	if err != nil {
+		return false, err
+	}
+	if r.permanent {
+		return true, nil
+	}
+
+	c, err := s.conn(r.key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	score, err := redis.Float64(c.Do("ZSCORE", r.key, r.member))
+	switch {
+	case err == redis.ErrNil:
+		return false, nil
+	case err != nil:
+		return false, s.itemError(r.item, err)
+	case score == float64(r.at.UnixNano()):
+		// Committed already.
+		return true, nil
+	case !s.now().Before(r.expires):
+		return false, nil
+	}
+	if _, err := c.Do("ZADD", r.key, "XX", r.at.UnixNano(), r.member); err != nil {
+		return false, s.itemError(r.item, err)
+	}
+	return true, nil
+}
+
+// probed returns the reservation made by Probe which token was returned
+// for.
+func (s *Stopper) probed(token string) (*Reservation, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// The token holds the time of the probe, its expiry and the member,
+	// none of which contain a space, unlike the item may.
+	parts := strings.SplitN(string(raw), " ", 4)
+	if len(parts) != 4 {
+		return nil, ErrInvalidToken
+	}
+	at, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	item := parts[3]
+	key, err := s.key(item)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reservation{
+		s:       s,
+		item:    item,
+		key:     key,
+		member:  parts[2],
+		at:      time.Unix(0, at),
+		expires: time.Unix(0, expires),
+	}
+	// Probes made with Unlimited took no slot, and so need no commit.
+	r.permanent = r.expires.Sub(r.at) >= s.Interval || r.member == ""
+	return r, nil
+}
@@ -0,0 +1,85 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProbe(t *testing.T) {
+	Convey("Given stoppers sharing a namespace", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "probes",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ProbeTTL:  time.Second,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		other := &Stopper{
+			Namespace: "probes",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		probe := func(item string) (string, bool) {
+			clock.AddTime(time.Millisecond)
+			token, ok, err := stopper.Probe(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token, ok
+		}
+
+		Convey("When I probe up to the limit", func() {
+			first, ok := probe("a:b")
+			So(ok, ShouldBeTrue)
+			_, ok = probe("a:b")
+			So(ok, ShouldBeTrue)
+
+			Convey("Further probes are refused", func() {
+				token, ok := probe("a:b")
+				So(ok, ShouldBeFalse)
+				So(token, ShouldBeEmpty)
+			})
+
+			Convey("Another process commits a probe by its token", func() {
+				committed, err := other.Commit(first)
+				So(err, ShouldBeNil)
+				So(committed, ShouldBeTrue)
+
+				Convey("So that its slot outlives the TTL", func() {
+					clock.AddTime(time.Second)
+					count, err := other.Peek("a:b")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 1)
+
+					committed, err := other.Commit(first)
+					So(err, ShouldBeNil)
+					So(committed, ShouldBeTrue)
+				})
+			})
+
+			Convey("Probes expire after the TTL", func() {
+				clock.AddTime(time.Second)
+				committed, err := other.Commit(first)
+				So(err, ShouldBeNil)
+				So(committed, ShouldBeFalse)
+				_, ok := probe("a:b")
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("Tokens not returned by Probe are rejected", func() {
+			for _, token := range []string{"", "!", "Zm9v"} {
+				_, err := stopper.Commit(token)
+				So(err, ShouldEqual, ErrInvalidToken)
+			}
+		})
+	})
+}
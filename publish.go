@@ -0,0 +1,40 @@
+package flowstopper
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockedEvent is the message published for a rejected action when
+// PublishBlocked is set.
+type BlockedEvent struct {
+	// The item whose action was rejected.
+	Item string
+
+	// When the action was attempted.
+	At time.Time
+}
+
+// BlockedChannel returns the redis channel on which the actions rejected by
+// the Stopper are published when PublishBlocked is set.
+func (s *Stopper) BlockedChannel() string {
+	return s.Namespace + s.separator() + "blocked"
+}
+
+// ParseBlockedEvent parses a message received on a BlockedChannel, which
+// holds the time of the action in nanoseconds since the epoch followed by a
+// space and the item.
+func ParseBlockedEvent(payload []byte) (BlockedEvent, error) {
+	at, item, ok := strings.Cut(string(payload), " ")
+	if !ok {
+		return BlockedEvent{}, errors.New("flowstopper: malformed blocked event")
+	}
+	nanos, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return BlockedEvent{}, fmt.Errorf("flowstopper: malformed blocked event: %w", err)
+	}
+	return BlockedEvent{Item: item, At: time.Unix(0, nanos)}, nil
+}
@@ -0,0 +1,53 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPublishBlocked(t *testing.T) {
+	Convey("Given a stopper publishing rejections", t, func() {
+		flushRealRedis(t)
+		stopper := Stopper{
+			Namespace:      "publish",
+			Interval:       5 * time.Second,
+			Limit:          int64(1),
+			ConnPool:       &connPool,
+			PublishBlocked: true,
+			c:              clock.NewMockClock(now),
+		}
+		psc := redis.PubSubConn{Conn: connPool.Get()}
+		defer func() { _ = psc.Close() }()
+		So(psc.Subscribe(stopper.BlockedChannel()), ShouldBeNil)
+		_, ok := psc.Receive().(redis.Subscription)
+		So(ok, ShouldBeTrue)
+
+		Convey("Rejected actions are announced with the item and time", func() {
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			passed, err = stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+
+			msg, ok := psc.Receive().(redis.Message)
+			So(ok, ShouldBeTrue)
+			So(msg.Channel, ShouldEqual, "publish:blocked")
+			event, err := ParseBlockedEvent(msg.Data)
+			So(err, ShouldBeNil)
+			So(event.Item, ShouldEqual, "foo")
+			So(event.At.Equal(now), ShouldBeTrue)
+		})
+	})
+
+	Convey("Malformed events fail to parse", t, func() {
+		_, err := ParseBlockedEvent([]byte("foo"))
+		So(err, ShouldNotBeNil)
+		_, err = ParseBlockedEvent([]byte("yesterday foo"))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,62 @@
+package flowstopper
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrUnknownLimit is returned by Registry.Get for a name none of its limits
+// was defined with. The errors returned wrap it with the name.
+var ErrUnknownLimit = errors.New("flowstopper: unknown limit")
+
+// LimitDef defines one of the named limits of a Registry, such as read from
+// a configuration file.
+type LimitDef struct {
+	// The name the limit is looked up by, which also serves as the
+	// Namespace of its Stopper.
+	Name string
+
+	// The duration for which actions are tracked.
+	Interval time.Duration
+
+	// The maximum amount of actions allowed during the Interval.
+	Limit int64
+}
+
+// Registry holds named Stoppers sharing a connection pool, so that limits
+// driven by configuration are built in one place and looked up by name.
+type Registry struct {
+	stoppers map[string]*Stopper
+}
+
+// NewRegistry returns a Registry with a Stopper for each of defs, taking
+// redis connections from pool and configured by opts. Every definition is
+// validated like by NewStopper, and the whole Registry fails with the first
+// invalid one, or with ErrInvalidConfig for a name defined twice.
+func NewRegistry(pool *redis.Pool, defs []LimitDef, opts ...Option) (*Registry, error) {
+	r := &Registry{stoppers: make(map[string]*Stopper, len(defs))}
+	for _, def := range defs {
+		if _, ok := r.stoppers[def.Name]; ok {
+			return nil, fmt.Errorf("%w: limit %q defined twice", ErrInvalidConfig, def.Name)
+		}
+		s, err := NewStopper(pool, def.Name, def.Interval, def.Limit, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("flowstopper: limit %q: %w", def.Name, err)
+		}
+		r.stoppers[def.Name] = s
+	}
+	return r, nil
+}
+
+// Get returns the Stopper of the limit defined as name, failing with
+// ErrUnknownLimit if there is none.
+func (r *Registry) Get(name string) (*Stopper, error) {
+	s, ok := r.stoppers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownLimit, name)
+	}
+	return s, nil
+}
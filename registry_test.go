@@ -0,0 +1,58 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("Given a registry of limits", t, func() {
+		flushRealRedis(t)
+		registry, err := NewRegistry(&connPool, []LimitDef{
+			{Name: "login", Interval: 5 * time.Second, Limit: 1},
+			{Name: "api", Interval: 5 * time.Second, Limit: 2},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Each limit is looked up by its name", func() {
+			login, err := registry.Get("login")
+			So(err, ShouldBeNil)
+			So(login.Namespace, ShouldEqual, "login")
+			api, err := registry.Get("api")
+			So(err, ShouldBeNil)
+			So(api.Limit, ShouldEqual, 2)
+			So(api.ConnPool, ShouldEqual, login.ConnPool)
+
+			for _, s := range []*Stopper{login, api} {
+				passed, err := s.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+			}
+			passed, err := login.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+		})
+
+		Convey("Unknown names fail clearly", func() {
+			s, err := registry.Get("signup")
+			So(s, ShouldBeNil)
+			So(errors.Is(err, ErrUnknownLimit), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, `"signup"`)
+		})
+	})
+
+	Convey("Definitions are validated", t, func() {
+		_, err := NewRegistry(&connPool, []LimitDef{{Name: "login", Interval: 5 * time.Second}})
+		So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, `"login"`)
+
+		_, err = NewRegistry(&connPool, []LimitDef{
+			{Name: "login", Interval: 5 * time.Second, Limit: 1},
+			{Name: "login", Interval: time.Minute, Limit: 5},
+		})
+		So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,181 @@
+package flowstopper
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrReservationExpired is returned when committing a Reservation whose TTL
+// has already elapsed.
+var ErrReservationExpired = errors.New("flowstopper: reservation expired")
+
+// Reservation is a slot taken in a Stopper's window which may later be
+// committed or cancelled.
+type Reservation struct {
+	s       *Stopper
+	item    string
+	key     string
+	member  string
+	at      time.Time
+	expires time.Time
+	ok      bool
+
+	// Whether the reserved member already carries the score of a regular
+	// pass, and so needs no commit.
+	permanent bool
+}
+
+// Reserve takes a slot in the window for item like Pass, returning a
+// reservation which remembers the exact member it added, so that Cancel can
+// refund the slot should the reserved operation abort before doing any real
+// work. A reservation which is never cancelled simply counts like a regular
+// pass and expires with the window.
+//
+// When the rate-limit for item is exceeded no slot is taken and the returned
+// reservation reports false from OK.
+func (s *Stopper) Reserve(item string) (*Reservation, error) {
+	return s.ReserveWithTTL(item, s.Interval)
+}
+
+// ReserveWithTTL takes a slot in the window for item which is released
+// automatically once ttl elapses, unless committed first.
+//
+// Unlike a regular pass, which occupies its slot for the full Interval, the
+// reserved member is scored as if it had been added ttl before the end of
+// the window, so the usual trimming removes it after ttl. This way a caller
+// which crashes or forgets to call Commit or Cancel does not leak capacity
+// for longer than ttl. Committing the reservation turns it into a regular
+// pass recorded at the time of reservation. A ttl of Interval or more is
+// equivalent to a regular pass.
+//
+// The slot is taken by the same script as Pass, so that grace periods, limits
+// set by SetLimit, UseServerTime, the ClockRewind policy and MaxStored apply
+// alike, and a reservation which doesn't fit takes up no room even for a
+// moment. Items locked out by the Penalty are refused, though refusals don't
+// count as offenses. With Unlimited every reservation is OK without taking a
+// slot, and a Limit of zero or less refuses them all.
+//
+// When the rate-limit for item is exceeded no slot is taken and the returned
+// reservation reports false from OK.
+func (s *Stopper) ReserveWithTTL(item string, ttl time.Duration) (*Reservation, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return nil, err
+	}
+	limitKey, err := s.limitKey(item)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reservation{s: s, item: item, key: key, at: now, expires: now.Add(ttl), permanent: ttl >= s.Interval}
+	switch {
+	case s.Unlimited:
+		r.ok, r.permanent = true, true
+		return r, nil
+	case s.Limit <= 0:
+		return r, nil
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+
+	if s.Penalty != nil {
+		until, err := s.lockedUntil(c, key, now)
+		if err != nil {
+			return nil, s.itemError(item, err)
+		}
+		if !until.IsZero() {
+			return r, nil
+		}
+	}
+
+	opts := s.optionArgs(item, s.Limit)
+	if !r.permanent {
+		if opts == nil {
+			opts = []interface{}{"", "", 0, "", ""}
+		}
+		opts = append(opts, ttl.Nanoseconds())
+	}
+	args := append(recordArgs(key, limitKey, now, s.Interval, 1, 0, s.Limit, s.UseServerTime), opts...)
+	reply, err := scanRecord(passScript.run(c, args...))
+	if err != nil {
+		return nil, s.itemError(item, err)
+	}
+	s.trimmed(item, reply.trimmed)
+
+	limit := s.Limit
+	if reply.limit > 0 {
+		limit = reply.limit
+	}
+	if limit < 1 || !reply.inGrace && reply.count > limit {
+		return r, nil
+	}
+	// The script tells the member and time it recorded the slot at, which
+	// differ from those asked for with UseServerTime or a ClockRewind policy.
+	r.member = reply.member
+	r.at = time.Unix(0, reply.now)
+	r.expires = r.at.Add(ttl)
+	r.ok = true
+	return r, nil
+}
+
+// OK returns whether a slot was taken for the reservation.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Commit turns the reservation into a regular pass, so it is no longer
+// released after its TTL. It returns ErrReservationExpired if the TTL has
+// already elapsed. Committing a reservation which is not OK does nothing.
+func (r *Reservation) Commit() error {
+	if !r.ok || r.permanent {
+		return nil
+	}
+	if !r.s.now().Before(r.expires) {
+		return ErrReservationExpired
+	}
+
+	c, err := r.s.conn(r.key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	changed, err := redis.Int64(c.Do("ZADD", r.key, "XX", "CH", r.at.UnixNano(), r.member))
+	if err != nil {
+		return r.s.itemError(r.item, err)
+	}
+	if changed == 0 {
+		return ErrReservationExpired
+	}
+	r.permanent = true
+	return nil
+}
+
+// Cancel releases the slot taken by the reservation, whether committed or
+// not. Once cancelled, a reservation is no longer OK. Cancelling a
+// reservation which is not OK does nothing.
+func (r *Reservation) Cancel() error {
+	if !r.ok || r.member == "" {
+		// Reservations made with Unlimited took no slot to release.
+		r.ok = false
+		return nil
+	}
+
+	c, err := r.s.conn(r.key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if _, err := c.Do("ZREM", r.key, r.member); err != nil {
+		return r.s.itemError(r.item, err)
+	}
+	r.ok = false
+	return nil
+}
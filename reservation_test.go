@@ -0,0 +1,170 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReserveWithTTL(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "reservations",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+
+		reserve := func(item string, ttl time.Duration) *Reservation {
+			clock.AddTime(1 * time.Millisecond)
+			r, err := stopper.ReserveWithTTL(item, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		Convey("When I reserve up to the limit", func() {
+			first := reserve("foo", time.Second)
+			second := reserve("foo", time.Second)
+			So(first.OK(), ShouldBeTrue)
+			So(second.OK(), ShouldBeTrue)
+
+			Convey("Further reservations are refused", func() {
+				So(reserve("foo", time.Second).OK(), ShouldBeFalse)
+			})
+
+			Convey("The reservations expire and free capacity after the TTL", func() {
+				clock.AddTime(time.Second)
+				So(reserve("foo", time.Second).OK(), ShouldBeTrue)
+				So(reserve("foo", time.Second).OK(), ShouldBeTrue)
+				So(reserve("foo", time.Second).OK(), ShouldBeFalse)
+			})
+
+			Convey("Cancelling one frees its slot immediately", func() {
+				So(first.Cancel(), ShouldBeNil)
+				So(first.OK(), ShouldBeFalse)
+				So(reserve("foo", time.Second).OK(), ShouldBeTrue)
+			})
+
+			Convey("Committed reservations outlive the TTL", func() {
+				So(first.Commit(), ShouldBeNil)
+				clock.AddTime(time.Second)
+				So(reserve("foo", time.Second).OK(), ShouldBeTrue)
+				So(reserve("foo", time.Second).OK(), ShouldBeFalse)
+
+				Convey("Until the end of the interval", func() {
+					clock.AddTime(stopper.Interval)
+					So(reserve("foo", time.Second).OK(), ShouldBeTrue)
+					So(reserve("foo", time.Second).OK(), ShouldBeTrue)
+				})
+			})
+
+			Convey("Committing after the TTL fails", func() {
+				clock.AddTime(time.Second)
+				So(first.Commit(), ShouldEqual, ErrReservationExpired)
+			})
+		})
+	})
+}
+
+func TestReserve(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "reservations",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+
+		reserve := func(item string) *Reservation {
+			clock.AddTime(1 * time.Millisecond)
+			r, err := stopper.Reserve(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}
+
+		Convey("When I reserve up to the limit", func() {
+			first := reserve("foo")
+			So(first.OK(), ShouldBeTrue)
+			So(reserve("foo").OK(), ShouldBeTrue)
+
+			Convey("Further actions are refused", func() {
+				So(reserve("foo").OK(), ShouldBeFalse)
+				clock.AddTime(time.Millisecond)
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeFalse)
+			})
+
+			Convey("Reservations left alone count for the whole interval", func() {
+				clock.AddTime(stopper.Interval - 10*time.Millisecond)
+				So(reserve("foo").OK(), ShouldBeFalse)
+				clock.AddTime(10 * time.Millisecond)
+				So(reserve("foo").OK(), ShouldBeTrue)
+			})
+
+			Convey("Cancelling one refunds its slot", func() {
+				So(first.Cancel(), ShouldBeNil)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+				So(reserve("foo").OK(), ShouldBeTrue)
+			})
+
+			Convey("A limit set for the item applies", func() {
+				So(stopper.SetLimit("foo", 3), ShouldBeNil)
+				So(reserve("foo").OK(), ShouldBeTrue)
+				So(reserve("foo").OK(), ShouldBeFalse)
+			})
+
+			Convey("Grace periods apply", func() {
+				So(stopper.ResetWithGrace("foo", time.Minute), ShouldBeNil)
+				for i := 0; i < 3; i++ {
+					So(reserve("foo").OK(), ShouldBeTrue)
+				}
+			})
+		})
+
+		Convey("Reserving never shortens the expiry of the window", func() {
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			So(reserve("foo").OK(), ShouldBeTrue)
+			_, err := conn.Do("PEXPIRE", "reservations:foo", time.Hour.Milliseconds())
+			So(err, ShouldBeNil)
+			So(reserve("foo").OK(), ShouldBeTrue)
+			ttl, err := redis.Int64(conn.Do("PTTL", "reservations:foo"))
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeGreaterThan, stopper.Interval.Milliseconds())
+		})
+
+		Convey("With Unlimited every reservation is OK without taking a slot", func() {
+			stopper.Unlimited = true
+			for i := 0; i < 3; i++ {
+				r := reserve("foo")
+				So(r.OK(), ShouldBeTrue)
+				So(r.Commit(), ShouldBeNil)
+				So(r.Cancel(), ShouldBeNil)
+			}
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("Without a limit no reservation is OK", func() {
+			stopper.Limit = 0
+			So(reserve("foo").OK(), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,200 @@
+package flowstopper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// script is a Lua script evaluated in redis by its SHA1 digest.
+type script struct {
+	*redis.Script
+	keyCount int
+	source   string
+
+	// The Hash, boxed once rather than on every evaluation.
+	hash interface{}
+}
+
+// luaUnique defines the Lua function unique(key, member, seq, cost, suffix),
+// which returns the member to record cost actions with in the sorted set at
+// key, numbered from seq onwards like by passScript and followed by suffix,
+// if given. It is member itself, unless actions at the same instant took any
+// of them already, in which case ".n" is appended to it for the lowest n
+// leaving them all free, so that each action is counted even if others share
+// its timestamp mid-flight.
+const luaUnique = `
+local function unique(key, member, seq, cost, suffix)
+	suffix = suffix or ""
+	local base, n = member, 0
+	local i = 0
+	while i < cost do
+		local m = member
+		if seq + i > 0 then
+			m = m .. "-" .. (seq + i)
+		end
+		if redis.call("ZSCORE", key, m .. suffix) then
+			n = n + 1
+			member = base .. "." .. n
+			i = 0
+		else
+			i = i + 1
+		end
+	end
+	return member
+end
+`
+
+// luaWeights defines the Lua functions by which scripts count the actions in
+// the window stored at key, where several actions recorded at once, as by
+// PassN, are stored as a single member with "*" and their number appended,
+// which the sorted set at weights holds as well, with the same score, so
+// that only those need to be looked at to count them. It follows luaUnique.
+//
+// weight(weights, m) returns the number of actions member m stands for.
+// counted(key, weights, start) returns the number of actions scored after
+// start, and trim(key, weights, start) removes the members scored at or
+// before start, returning how many it removed from the window. roomAt(key,
+// weights, start, limit) returns the score of the action whose expiry leaves
+// fewer than limit actions after start, or false if there are fewer already.
+// reweigh(key, weights, m, score, n) replaces member m, scored score, by one
+// standing for n actions, keeping the key of either set from ever emptying
+// in between, which would drop its expiry.
+const luaWeights = `
+local function weight(weights, m)
+	local n = string.match(m, "%*(%d+)$")
+	if n and redis.call("ZSCORE", weights, m) then
+		return tonumber(n)
+	end
+	return 1
+end
+local function counted(key, weights, start)
+	local count = redis.call("ZCOUNT", key, "(" .. start, "+inf")
+	for _, m in ipairs(redis.call("ZRANGEBYSCORE", weights, "(" .. start, "+inf")) do
+		count = count + tonumber(string.match(m, "%*(%d+)$")) - 1
+	end
+	return count
+end
+local function trim(key, weights, start)
+	redis.call("ZREMRANGEBYSCORE", weights, "-inf", start)
+	return redis.call("ZREMRANGEBYSCORE", key, "-inf", start)
+end
+local function roomAt(key, weights, start, limit)
+	if redis.call("ZCOUNT", weights, "(" .. start, "+inf") == 0 then
+		return redis.call("ZREVRANGEBYSCORE", key, "+inf", "(" .. start, "WITHSCORES", "LIMIT", limit - 1, 1)[2] or false
+	end
+	local members = redis.call("ZREVRANGEBYSCORE", key, "+inf", "(" .. start, "WITHSCORES", "LIMIT", 0, limit)
+	local sum = 0
+	for i = 1, #members, 2 do
+		sum = sum + weight(weights, members[i])
+		if sum >= limit then
+			return members[i + 1]
+		end
+	end
+	return false
+end
+local function reweigh(key, weights, m, score, n)
+	local suffix = "*" .. n
+	local base = string.gsub(m, "%*%d+$", "")
+	local rest = unique(key, base, 0, 1, suffix) .. suffix
+	redis.call("ZADD", key, score, rest)
+	redis.call("ZADD", weights, score, rest)
+	redis.call("ZREM", key, m)
+	redis.call("ZREM", weights, m)
+end
+`
+
+// stopperScripts are the scripts evaluated by the methods of Stopper, which
+// Preload loads.
+var stopperScripts = []script{passScript, tryPassScript, passUniqueScript, globalScript, offenseScript, debounceScript, undoScript, grantScript}
+
+func newScript(keyCount int, src string) script {
+	s := redis.NewScript(keyCount, src)
+	return script{s, keyCount, src, s.Hash()}
+}
+
+// run evaluates the script on c with EVALSHA. Should redis not know the
+// script yet, it is loaded with SCRIPT LOAD and evaluated again, so that the
+// source is only sent once per redis server rather than on every call.
+// Errors redis reports for the script wrap ErrScriptFailed.
+func (s script) run(c Conn, keysAndArgs ...interface{}) (interface{}, error) {
+	reply, err := c.Do("EVALSHA", s.args(keysAndArgs)...)
+	if isNoScript(err) {
+		if err := s.load(c); err != nil {
+			return nil, err
+		}
+		reply, err = c.Do("EVALSHA", s.args(keysAndArgs)...)
+	}
+	return reply, scriptError(err)
+}
+
+// load loads the script into redis' script cache.
+func (s script) load(c Conn) error {
+	if op, ok := c.(*operationConn); ok && op.logger != nil {
+		op.logger.Printf("flowstopper: loading script %s", s.Hash())
+	}
+	_, err := c.Do("SCRIPT", "LOAD", s.source)
+	return err
+}
+
+func (s script) args(keysAndArgs []interface{}) []interface{} {
+	args := make([]interface{}, 0, 2+len(keysAndArgs))
+	args = append(args, s.hash, s.keyCount)
+	return append(args, keysAndArgs...)
+}
+
+// isNoScript reports whether v is redis reporting that it does not know a
+// script.
+func isNoScript(v interface{}) bool {
+	e, ok := v.(error)
+	return ok && strings.HasPrefix(e.Error(), "NOSCRIPT")
+}
+
+// scriptError wraps err with ErrScriptFailed if redis reported it for a
+// script, returning other errors, including transient ones, as they are.
+func scriptError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var rerr redis.Error
+	if errors.As(err, &rerr) && !isTransient(err) {
+		return fmt.Errorf("%w: %w", ErrScriptFailed, err)
+	}
+	return err
+}
+
+// isConnError reports whether err is the connection to redis failing, rather
+// than redis or the caller rejecting a command.
+func isConnError(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrPoolExhausted)
+}
+
+// transientErrors are the prefixes of the errors redis reports while it is
+// temporarily unable to serve commands, such as during a restart or a
+// failover.
+var transientErrors = []string{"LOADING", "BUSY", "TRYAGAIN", "MASTERDOWN", "CLUSTERDOWN", "READONLY"}
+
+// isTransient reports whether err is a failure which may go away by trying
+// again: the connection failing, or redis being temporarily unable to serve
+// commands.
+func isTransient(err error) bool {
+	if errors.Is(err, ErrConnUnavailable) || isConnError(err) {
+		return true
+	}
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return false
+	}
+	for _, prefix := range transientErrors {
+		if strings.HasPrefix(string(rerr), prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNoMaster is returned by a SentinelPool when none of its sentinels
+// knows the address of the master.
+var ErrNoMaster = errors.New("flowstopper: no sentinel knows the master")
+
+// SentinelPool is a Pool for redis deployments whose master is monitored by
+// Redis Sentinel. It asks the sentinels for the address of the current
+// master and hands out connections to it. Once the master fails, or is
+// demoted to a replica and so refuses writes with READONLY errors, the
+// sentinels are asked again, so that after a brief window of errors during
+// a failover the Stoppers using it carry on against the promoted replica.
+type SentinelPool struct {
+	// The addresses of the sentinels, asked in order.
+	Sentinels []string
+
+	// The name the sentinels monitor the master under.
+	MasterName string
+
+	// When set, dials the sentinels and the master at address. Without it,
+	// TCP connections are opened with redis.Dial.
+	Dial func(address string) (redis.Conn, error)
+
+	mu     sync.Mutex
+	master string
+	pool   *redis.Pool
+}
+
+var _ Pool = (*SentinelPool)(nil)
+
+// GetContext returns a connection to the current master, asking the
+// sentinels for it first if it isn't known yet.
+func (p *SentinelPool) GetContext(ctx context.Context) (Conn, error) {
+	pool, err := p.masterPool()
+	if err != nil {
+		return nil, err
+	}
+	c, err := pool.GetContext(ctx)
+	if err != nil {
+		p.forget(pool)
+		return nil, err
+	}
+	return &sentinelConn{Conn: c, pool: pool, p: p}, nil
+}
+
+// Master returns the address of the master the SentinelPool currently
+// connects to, or the empty string if it isn't known yet.
+func (p *SentinelPool) Master() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.master
+}
+
+// Close closes the connections to the current master.
+func (p *SentinelPool) Close() error {
+	p.mu.Lock()
+	pool := p.pool
+	p.pool, p.master = nil, ""
+	p.mu.Unlock()
+
+	if pool == nil {
+		return nil
+	}
+	return pool.Close()
+}
+
+// masterPool returns the pool of connections to the current master,
+// creating it after asking the sentinels where the master is.
+func (p *SentinelPool) masterPool() (*redis.Pool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pool != nil {
+		return p.pool, nil
+	}
+
+	master, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.master = master
+	p.pool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return p.dial(master)
+		},
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+	}
+	return p.pool, nil
+}
+
+// discover asks the sentinels in turn for the address of the master.
+func (p *SentinelPool) discover() (string, error) {
+	var errs []error
+	for _, sentinel := range p.Sentinels {
+		addr, err := p.askSentinel(sentinel)
+		if err == nil {
+			return addr, nil
+		}
+		errs = append(errs, fmt.Errorf("sentinel %s: %w", sentinel, err))
+	}
+	return "", fmt.Errorf("%w %q: %w", ErrNoMaster, p.MasterName, errors.Join(errs...))
+}
+
+func (p *SentinelPool) askSentinel(sentinel string) (string, error) {
+	c, err := p.dial(sentinel)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = c.Close() }()
+
+	hostPort, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", p.MasterName))
+	if err != nil {
+		return "", err
+	}
+	if len(hostPort) != 2 {
+		return "", fmt.Errorf("unexpected reply %q", hostPort)
+	}
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
+
+func (p *SentinelPool) dial(address string) (redis.Conn, error) {
+	if p.Dial != nil {
+		return p.Dial(address)
+	}
+	return redis.Dial("tcp", address)
+}
+
+// forget drops pool should it still be the pool of the current master, so
+// that the sentinels are asked again for the next connection.
+func (p *SentinelPool) forget(pool *redis.Pool) {
+	p.mu.Lock()
+	if p.pool != pool {
+		p.mu.Unlock()
+		return
+	}
+	p.pool, p.master = nil, ""
+	p.mu.Unlock()
+
+	// Connections still in use are closed as they are returned.
+	_ = pool.Close()
+}
+
+// sentinelConn is a connection to the master of a SentinelPool, which makes
+// the pool forget the master once the connection reveals it failed.
+type sentinelConn struct {
+	redis.Conn
+	pool *redis.Pool
+	p    *SentinelPool
+}
+
+func (c *sentinelConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.check(c.Conn.Do(cmd, args...))
+}
+
+func (c *sentinelConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.check(redis.DoWithTimeout(c.Conn, timeout, cmd, args...))
+}
+
+// check forgets the master when err shows it unreachable or demoted, and
+// passes reply and err on. EXEC replies are checked for nested demotion
+// errors as well, as they carry the errors of a transaction's commands.
+func (c *sentinelConn) check(reply interface{}, err error) (interface{}, error) {
+	failed := err != nil && (isConnError(err) || isReadOnly(err))
+	if values, ok := reply.([]interface{}); ok && !failed {
+		for _, v := range values {
+			if e, ok := v.(error); ok && isReadOnly(e) {
+				failed = true
+				break
+			}
+		}
+	}
+	if failed {
+		c.p.forget(c.pool)
+	}
+	return reply, err
+}
+
+// isReadOnly reports whether err is a replica refusing a write.
+func isReadOnly(err error) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "READONLY")
+}
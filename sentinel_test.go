@@ -0,0 +1,67 @@
+package flowstopper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSentinelPool(t *testing.T) {
+	Convey("Given a stopper using sentinel", t, func() {
+		sentinel := redigomock.NewConn()
+		discovery := sentinel.Command("SENTINEL", "get-master-addr-by-name", "mymaster").
+			Expect([]interface{}{[]byte("192.0.2.1"), []byte("6379")})
+		first, second := redigomock.NewConn(), redigomock.NewConn()
+		conns := map[string]*redigomock.Conn{
+			"192.0.2.100:26379": sentinel,
+			"192.0.2.1:6379":    first,
+			"192.0.2.2:6379":    second,
+		}
+		pool := &SentinelPool{
+			Sentinels:  []string{"192.0.2.99:26379", "192.0.2.100:26379"},
+			MasterName: "mymaster",
+			Dial: func(address string) (redis.Conn, error) {
+				if c, ok := conns[address]; ok {
+					return c, nil
+				}
+				return nil, errors.New("connection refused")
+			},
+		}
+		stopper, err := NewStopper(nil, "sentinel", 5*time.Second, 5, WithPool(pool))
+		So(err, ShouldBeNil)
+		ok := []interface{}{int64(0), int64(1), int64(0), nil, nil, nil, nil, nil}
+		firstEval := first.GenericCommand("EVALSHA").Expect(ok)
+		second.GenericCommand("EVALSHA").Expect(ok)
+
+		Convey("The master is found through the sentinels which answer", func() {
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(pool.Master(), ShouldEqual, "192.0.2.1:6379")
+
+			Convey("And found again once it is demoted", func() {
+				firstEval.ExpectError(redis.Error("READONLY You can't write against a read only replica."))
+				discovery.Expect([]interface{}{[]byte("192.0.2.2"), []byte("6379")})
+
+				_, err := stopper.Pass("foo")
+				So(err, ShouldNotBeNil)
+				passed, err := stopper.Pass("foo")
+				So(err, ShouldBeNil)
+				So(passed, ShouldBeTrue)
+				So(pool.Master(), ShouldEqual, "192.0.2.2:6379")
+			})
+		})
+
+		Convey("Without a sentinel knowing the master, passing fails", func() {
+			pool.Sentinels = pool.Sentinels[:1]
+			_, err := stopper.Pass("foo")
+			So(errors.Is(err, ErrNoMaster), ShouldBeTrue)
+		})
+
+		Reset(func() { _ = pool.Close() })
+	})
+}
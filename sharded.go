@@ -0,0 +1,151 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// KeyedPool is a Pool which hands out connections to the redis holding a
+// given key, such as a ShardedPool. Stoppers, and the other limiters, take
+// the connections for an item with GetKeyContext when their pool is one.
+type KeyedPool interface {
+	Pool
+
+	// GetKeyContext returns a connection to the redis holding key.
+	GetKeyContext(ctx context.Context, key string) (Conn, error)
+}
+
+// Shard is one of the redis servers of a ShardedPool.
+type Shard struct {
+	// The name of the shard, which places it on the hash ring. It must be
+	// unique within the pool, and must not change, as the items a shard
+	// holds follow from it.
+	Name string
+
+	// The pool to take connections to the shard from.
+	Pool Pool
+}
+
+// shardReplicas is the number of points each shard takes on the hash ring,
+// which evens out the share of items each one holds.
+const shardReplicas = 160
+
+// ShardedPool spreads items across several independent redis servers by
+// consistent hashing, so that a keyspace too large for a single server can
+// be limited: every item deterministically lands on one shard, which holds
+// all of its keys, and adding or removing a shard only moves the items of
+// about one shard's share.
+//
+// The windows of items moved to another shard are lost. Operations on a
+// single item are routed transparently, while ResetNamespace, ActiveItems,
+// ActiveItemCounts and Ping fan out across all shards. PassBatch, PassMulti
+// and PeekMulti fail with ErrInvalidConfig unless their items all land on
+// the same shard.
+type ShardedPool struct {
+	// The shards to spread the items across.
+	Shards []Shard
+
+	once sync.Once
+	ring []ringPoint
+}
+
+var _ KeyedPool = (*ShardedPool)(nil)
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+// GetContext fails with ErrInvalidConfig, as a ShardedPool can only hand
+// out connections for a key.
+func (p *ShardedPool) GetContext(ctx context.Context) (Conn, error) {
+	return nil, fmt.Errorf("%w: a sharded pool needs a key to pick a shard", ErrInvalidConfig)
+}
+
+// GetKeyContext returns a connection to the shard holding key.
+func (p *ShardedPool) GetKeyContext(ctx context.Context, key string) (Conn, error) {
+	shard := p.shard(key)
+	if shard < 0 {
+		return nil, fmt.Errorf("%w: a sharded pool needs shards", ErrInvalidConfig)
+	}
+	return p.Shards[shard].Pool.GetContext(ctx)
+}
+
+// ShardName returns the name of the shard holding key, or the empty string
+// if there are no shards.
+func (p *ShardedPool) ShardName(key string) string {
+	shard := p.shard(key)
+	if shard < 0 {
+		return ""
+	}
+	return p.Shards[shard].Name
+}
+
+// shard returns the index of the shard holding key, or -1 if there are no
+// shards.
+func (p *ShardedPool) shard(key string) int {
+	p.once.Do(p.build)
+	if len(p.ring) == 0 {
+		return -1
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].shard
+}
+
+// build places the shards on the hash ring.
+func (p *ShardedPool) build() {
+	for i, shard := range p.Shards {
+		for r := 0; r < shardReplicas; r++ {
+			h := crc32.ChecksumIEEE([]byte(shard.Name + "-" + strconv.Itoa(r)))
+			p.ring = append(p.ring, ringPoint{h, i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+// getConn takes a connection for the item whose keys are routed by key from
+// p, which picks the redis holding them should it be a KeyedPool.
+func getConn(ctx context.Context, p Pool, key string) (Conn, error) {
+	if kp, ok := p.(KeyedPool); ok {
+		return kp.GetKeyContext(ctx, key)
+	}
+	return p.GetContext(ctx)
+}
+
+// shardsOf returns the pools of every shard of p, which is p alone unless
+// it is a ShardedPool.
+func shardsOf(p Pool) []Pool {
+	sp, ok := p.(*ShardedPool)
+	if !ok {
+		return []Pool{p}
+	}
+	pools := make([]Pool, len(sp.Shards))
+	for i, shard := range sp.Shards {
+		pools[i] = shard.Pool
+	}
+	return pools
+}
+
+// sameShard fails with ErrInvalidConfig unless every one of keys lands on
+// the same shard of p.
+func sameShard(p Pool, keys []string) error {
+	sp, ok := p.(*ShardedPool)
+	if !ok || len(keys) == 0 {
+		return nil
+	}
+	first := sp.shard(keys[0])
+	for _, key := range keys[1:] {
+		if sp.shard(key) != first {
+			return fmt.Errorf("%w: items on several shards can't be batched", ErrInvalidConfig)
+		}
+	}
+	return nil
+}
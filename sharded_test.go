@@ -0,0 +1,112 @@
+package flowstopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// databasePool returns a pool of connections to database db of the test
+// redis, standing in for a redis server of its own.
+func databasePool(db int) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", fmt.Sprintf("localhost:%d", redisServerPort), redis.DialDatabase(db))
+		},
+	}
+}
+
+func TestShardedPool(t *testing.T) {
+	Convey("Given a stopper sharding items across three redis servers", t, func() {
+		flushRealRedis(t)
+		shards := []Shard{
+			{Name: "a", Pool: RedigoPool(databasePool(1))},
+			{Name: "b", Pool: RedigoPool(databasePool(2))},
+			{Name: "c", Pool: RedigoPool(databasePool(3))},
+		}
+		pool := &ShardedPool{Shards: shards}
+		clock := clock.NewMockClock(now)
+		stopper, err := NewStopper(nil, "sharded", 5*time.Second, 2, WithPool(pool), WithClock(clock))
+		So(err, ShouldBeNil)
+		items := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot"}
+		for _, item := range items {
+			passed, err := stopper.Pass(item)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		}
+		dbOf := map[string]int{"a": 1, "b": 2, "c": 3}
+		exists := func(db int, key string) bool {
+			c, err := databasePool(db).Dial()
+			So(err, ShouldBeNil)
+			defer func() { _ = c.Close() }()
+			n, err := redis.Int(c.Do("EXISTS", key))
+			So(err, ShouldBeNil)
+			return n == 1
+		}
+
+		Convey("Each item's window is kept on its shard alone", func() {
+			used := map[string]bool{}
+			for _, item := range items {
+				key := stopper.Key(item)
+				shard := pool.ShardName(key)
+				used[shard] = true
+				for name, db := range dbOf {
+					So(exists(db, key), ShouldEqual, name == shard)
+				}
+			}
+			So(len(used), ShouldBeGreaterThan, 1)
+		})
+
+		Convey("Items are limited on their shard", func() {
+			passed, err := stopper.Pass("alpha")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			passed, err = stopper.Pass("alpha")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+		})
+
+		Convey("Operations across items fan out across the shards", func() {
+			active, err := stopper.ActiveItems()
+			So(err, ShouldBeNil)
+			So(active, ShouldResemble, []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot"})
+			So(stopper.Ping(context.Background()), ShouldBeNil)
+
+			So(stopper.ResetNamespace(), ShouldBeNil)
+			active, err = stopper.ActiveItems()
+			So(err, ShouldBeNil)
+			So(active, ShouldBeEmpty)
+		})
+
+		Convey("Batches across shards are rejected", func() {
+			var a, b string
+			for _, item := range items[1:] {
+				if pool.ShardName(stopper.Key(item)) != pool.ShardName(stopper.Key(items[0])) {
+					a, b = items[0], item
+					break
+				}
+			}
+			_, err := stopper.PassMulti([]string{a, b})
+			So(errors.Is(err, ErrInvalidConfig), ShouldBeTrue)
+		})
+
+		Convey("Adding a shard only moves some of the items", func() {
+			grown := &ShardedPool{Shards: append(shards[:3:3], Shard{Name: "d", Pool: RedigoPool(databasePool(4))})}
+			moved := 0
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("sharded:%d", i)
+				if name := grown.ShardName(key); name != pool.ShardName(key) {
+					So(name, ShouldEqual, "d")
+					moved++
+				}
+			}
+			So(moved, ShouldBeBetween, 100, 400)
+		})
+	})
+}
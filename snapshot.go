@@ -0,0 +1,136 @@
+package flowstopper
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Export returns the scores of the actions in the window for item, the times
+// they were recorded at in nanoseconds since the epoch, oldest first, for
+// moving windows between redis servers or taking test fixtures. Expired
+// actions are left out. Import restores them.
+func (s *Stopper) Export(item string) ([]int64, error) {
+	key, err := s.key(item)
+	if err != nil {
+		return nil, err
+	}
+	windowStart := s.now().Add(s.Interval * -1).UnixNano()
+
+	c, err := s.conn(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+
+	values, err := redis.Strings(c.Do("ZRANGEBYSCORE", key, exclusive(windowStart), "+inf", "WITHSCORES"))
+	if err != nil {
+		return nil, s.itemError(item, err)
+	}
+	w, err := weightsOf(c, key, windowStart)
+	if err != nil {
+		return nil, s.itemError(item, err)
+	}
+	scores := make([]int64, 0, int64(len(values)/2)+w.extra())
+	for i := 1; i < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i], 64)
+		if err != nil {
+			return nil, s.itemError(item, err)
+		}
+		for n := w.of(values[i-1]); n > 0; n-- {
+			scores = append(scores, int64(score))
+		}
+	}
+	return scores, nil
+}
+
+// defaultDumpLimit is the DumpLimit of a Stopper not setting one.
+const defaultDumpLimit = 1000
+
+// Dump returns the times of the actions in the window for item, oldest
+// first, after trimming the expired ones, such as to diagnose why an item is
+// blocked. It is a diagnostic tool rather than meant for the hot path, and
+// returns at most the DumpLimit oldest actions, so that a huge window is not
+// pulled into memory whole.
+func (s *Stopper) Dump(item string) ([]time.Time, error) {
+	key, err := s.key(item)
+	if err != nil {
+		return nil, err
+	}
+	limit := s.DumpLimit
+	if limit <= 0 {
+		limit = defaultDumpLimit
+	}
+	windowStart := s.now().Add(s.Interval * -1).UnixNano()
+
+	c, err := s.conn(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+
+	var tx transaction
+	tx.add("ZREMRANGEBYSCORE", key, "-inf", windowStart)
+	tx.add("ZRANGE", key, 0, limit-1, "WITHSCORES")
+	tx.add("ZRANGEBYSCORE", weightsArgs(key, windowStart)...)
+	values, err := tx.execAll(c)
+	if err != nil {
+		return nil, s.itemError(item, s.typeError(item, err))
+	}
+	var trimmed int64
+	var members, weighted []string
+	if _, err := redis.Scan(values, &trimmed, &members, &weighted); err != nil {
+		return nil, s.itemError(item, err)
+	}
+	s.trimmed(item, trimmed)
+	w := parseWeights(weighted)
+
+	times := make([]time.Time, 0, len(members)/2)
+	for i := 1; i < len(members) && int64(len(times)) < limit; i += 2 {
+		score, err := strconv.ParseFloat(members[i], 64)
+		if err != nil {
+			return nil, s.itemError(item, err)
+		}
+		for n := w.of(members[i-1]); n > 0 && int64(len(times)) < limit; n-- {
+			times = append(times, time.Unix(0, int64(score)).UTC())
+		}
+	}
+	return times, nil
+}
+
+// Import replaces the window for item with actions recorded at the given
+// scores, as returned by Export, in a single transaction, so that the window
+// is never seen half rebuilt. Importing no scores clears the window. Scores
+// which have expired by the time of the import are trimmed as usual.
+func (s *Stopper) Import(item string, scores []int64) error {
+	key, err := s.key(item)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	var tx transaction
+	tx.add("DEL", key, auxKey(key, "weights"))
+	if len(scores) > 0 {
+		args := []interface{}{key}
+		for i, score := range scores {
+			member := strconv.FormatInt(score, 10)
+			if i > 0 {
+				member += "-" + strconv.Itoa(i)
+			}
+			args = append(args, score, member)
+		}
+		tx.add("ZADD", args...)
+		tx.add("PEXPIRE", key, durationMillis(s.Interval))
+	}
+	if _, err := tx.execAll(c); err != nil {
+		return s.itemError(item, err)
+	}
+	return nil
+}
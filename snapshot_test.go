@@ -0,0 +1,91 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExportImport(t *testing.T) {
+	Convey("Given a stopper with a few actions", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "snapshot",
+			Interval:  5 * time.Second,
+			Limit:     int64(3),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func(item string) bool {
+			passed, err := stopper.Pass(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+		So(pass("foo"), ShouldBeTrue)
+		clock.AddTime(time.Second)
+		So(pass("foo"), ShouldBeTrue)
+		So(pass("foo"), ShouldBeTrue)
+
+		Convey("Dump returns their times, oldest first", func() {
+			times, err := stopper.Dump("foo")
+			So(err, ShouldBeNil)
+			So(times, ShouldHaveLength, 3)
+			So(float64(times[0].Sub(now)), ShouldAlmostEqual, 0, float64(time.Microsecond))
+			So(float64(times[2].Sub(now.Add(time.Second))), ShouldAlmostEqual, 0, float64(time.Microsecond))
+
+			Convey("Up to the DumpLimit", func() {
+				stopper.DumpLimit = 2
+				times, err := stopper.Dump("foo")
+				So(err, ShouldBeNil)
+				So(times, ShouldHaveLength, 2)
+			})
+
+			Convey("Leaving out expired actions", func() {
+				clock.AddTime(stopper.Interval - time.Second)
+				times, err := stopper.Dump("foo")
+				So(err, ShouldBeNil)
+				So(times, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("Export returns their scores, oldest first", func() {
+			scores, err := stopper.Export("foo")
+			So(err, ShouldBeNil)
+			So(scores, ShouldResemble, []int64{now.UnixNano(), now.Add(time.Second).UnixNano(), now.Add(time.Second).UnixNano()})
+
+			Convey("Which Import restores under another item", func() {
+				So(pass("bar"), ShouldBeTrue)
+				So(stopper.Import("bar", scores), ShouldBeNil)
+				imported, err := stopper.Export("bar")
+				So(err, ShouldBeNil)
+				So(imported, ShouldResemble, scores)
+				So(pass("bar"), ShouldBeFalse)
+
+				Convey("And the imported actions expire as usual", func() {
+					clock.AddTime(4 * time.Second)
+					So(pass("bar"), ShouldBeTrue)
+					So(pass("bar"), ShouldBeFalse)
+				})
+			})
+		})
+
+		Convey("Expired actions are not exported", func() {
+			clock.AddTime(4*time.Second + time.Millisecond)
+			scores, err := stopper.Export("foo")
+			So(err, ShouldBeNil)
+			So(scores, ShouldHaveLength, 2)
+		})
+
+		Convey("Importing no scores clears the window", func() {
+			So(stopper.Import("foo", nil), ShouldBeNil)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+)
+
+// tokenBucketScript takes a token from the bucket stored as a hash at
+// KEYS[1], holding up to ARGV[2] tokens and refilled with ARGV[3] tokens per
+// second, at time ARGV[1] in microseconds since the epoch. A bucket not
+// seen before starts out full. It returns 1 if a token was taken and 0 if
+// the bucket was empty. The bucket expires after ARGV[4] milliseconds, by
+// when it would have been full again anyway.
+var tokenBucketScript = newScript(1, `
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * tonumber(ARGV[3]) / 1000000)
+	ts = now
+end
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return taken
+`)
+
+// TokenBucket is a rate limiter granting each item a bucket of tokens, one of
+// which is taken by every action passed. Buckets are refilled at a steady
+// Rate up to Capacity, so that bursts of up to Capacity actions pass while
+// the long-term rate is bounded by Rate.
+//
+// Unlike a Stopper, which records every action, only the number of tokens
+// and the time of the last refill are stored per item, which makes it
+// cheaper for items seeing many actions.
+type TokenBucket struct {
+	// The redigo pool to take redis connections from, unless Pool is set.
+	ConnPool *redis.Pool
+
+	// The pool to take redis connections from when using a client other
+	// than redigo. When set, ConnPool is ignored.
+	Pool Pool
+
+	// The key prefix to use for the name in redis. It must not contain ":".
+	Namespace string
+
+	// The maximum number of tokens in a bucket, and so the largest burst of
+	// actions which pass.
+	Capacity int64
+
+	// The number of tokens added to a bucket per second.
+	Rate float64
+
+	c clock.Clock
+}
+
+// Pass sends an item through the TokenBucket, returning false should its
+// bucket be empty.
+func (b *TokenBucket) Pass(item string) (bool, error) {
+	if strings.Contains(b.Namespace, defaultSeparator) {
+		return false, ErrInvalidNamespace
+	}
+	key := b.Namespace + defaultSeparator + item
+
+	c, err := getConn(context.Background(), poolOf(b.Pool, b.ConnPool), key)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = c.Close() }()
+
+	now := Now()
+	if b.c != nil {
+		now = b.c.Now()
+	}
+	micronow := now.UnixNano() / int64(time.Microsecond)
+	rate := strconv.FormatFloat(b.Rate, 'f', -1, 64)
+	taken, err := redis.Int64(tokenBucketScript.run(c, key, micronow, b.Capacity, rate, b.refillMillis()))
+	if err != nil {
+		return false, fmt.Errorf("flowstopper: %q: %w", item, err)
+	}
+	return taken == 1, nil
+}
+
+// refillMillis returns the number of milliseconds it takes to refill an
+// empty bucket, and so how long a bucket is kept without any actions.
+func (b *TokenBucket) refillMillis() int64 {
+	if b.Rate <= 0 {
+		return math.MaxInt64 / int64(time.Millisecond)
+	}
+	return int64(math.Ceil(float64(b.Capacity) / b.Rate * 1000))
+}
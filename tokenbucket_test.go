@@ -0,0 +1,64 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenBucket(t *testing.T) {
+	Convey("Given a token bucket", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		bucket := &TokenBucket{
+			Namespace: "tokenbucket",
+			Capacity:  3,
+			Rate:      2,
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		pass := func() bool {
+			passed, err := bucket.Pass("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return passed
+		}
+
+		Convey("A burst up to the capacity passes", func() {
+			So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+
+			Convey("And tokens are refilled at the rate", func() {
+				clock.AddTime(500 * time.Millisecond)
+				So([]bool{pass(), pass()}, ShouldResemble, []bool{true, false})
+			})
+
+			Convey("But never beyond the capacity", func() {
+				clock.AddTime(time.Minute)
+				So([]bool{pass(), pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true, false})
+			})
+		})
+
+		Convey("Items have buckets of their own", func() {
+			So([]bool{pass(), pass(), pass()}, ShouldResemble, []bool{true, true, true})
+			passed, err := bucket.Pass("bar")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		})
+
+		Convey("Only the token count and refill time are stored", func() {
+			pass()
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			fields, err := redis.Strings(conn.Do("HKEYS", "tokenbucket:foo"))
+			So(err, ShouldBeNil)
+			So(fields, ShouldHaveLength, 2)
+			ttl, err := redis.Int64(conn.Do("PTTL", "tokenbucket:foo"))
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeBetweenOrEqual, 1000, 1500)
+		})
+	})
+}
@@ -0,0 +1,92 @@
+package flowstopper
+
+import (
+	"context"
+	"fmt"
+)
+
+// The stages evaluated by Pass, in order.
+const (
+	StageFreeAllowance = "free-allowance"
+	StagePenalty       = "penalty"
+	StageGrace         = "grace"
+	StageLimit         = "limit"
+	StageSoftLimit     = "soft-limit"
+)
+
+// Outcome is the contribution of a single stage to a decision.
+type Outcome int
+
+const (
+	// OutcomeSkipped means the stage does not apply to the Stopper.
+	OutcomeSkipped Outcome = iota
+
+	// OutcomeContinue means the stage was evaluated but left the decision
+	// to the following stages.
+	OutcomeContinue
+
+	// OutcomeAllowed means the stage let the action pass.
+	OutcomeAllowed
+
+	// OutcomeBlocked means the stage rejected the action.
+	OutcomeBlocked
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSkipped:
+		return "skipped"
+	case OutcomeContinue:
+		return "continue"
+	case OutcomeAllowed:
+		return "allowed"
+	case OutcomeBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+// Stage records the evaluation of a single stage of a decision.
+type Stage struct {
+	// The name of the stage, one of the Stage constants.
+	Name string
+
+	// The contribution of the stage to the decision.
+	Outcome Outcome
+
+	// A human-readable explanation of the outcome.
+	Detail string
+}
+
+// DecisionTrace records how the decision for an action was reached.
+type DecisionTrace struct {
+	// Whether the action passed.
+	Allowed bool
+
+	// The number of actions recorded during the current interval.
+	Count int64
+
+	// The evaluated stages, in order. The last one decided the outcome.
+	Stages []Stage
+}
+
+// add records a stage, doing nothing on a nil trace.
+func (t *DecisionTrace) add(name string, outcome Outcome, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Stages = append(t.Stages, Stage{Name: name, Outcome: outcome, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Trace sends an item through the Stopper like Pass, returning a trace of
+// every stage evaluated to reach the decision. It is meant for debugging
+// why an action was allowed or blocked.
+func (s *Stopper) Trace(item string) (DecisionTrace, error) {
+	var tr DecisionTrace
+	r, err := s.pass(context.Background(), CheckRequest{Item: item}, &tr)
+	if err != nil {
+		return DecisionTrace{}, err
+	}
+	tr.Allowed, tr.Count = r.Allowed, r.Count
+	return tr, nil
+}
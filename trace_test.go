@@ -0,0 +1,89 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTrace(t *testing.T) {
+	Convey("Given a stopper with several policies", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace:     "trace",
+			Interval:      5 * time.Second,
+			Limit:         int64(3),
+			SoftLimit:     int64(2),
+			FreeAllowance: int64(1),
+			Rand:          func() float64 { return 0.99 },
+			ConnPool:      &connPool,
+			c:             clock,
+		}
+
+		trace := func() DecisionTrace {
+			clock.AddTime(time.Millisecond)
+			tr, err := stopper.Trace("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tr
+		}
+		outcomes := func(tr DecisionTrace) map[string]Outcome {
+			m := map[string]Outcome{}
+			for _, stage := range tr.Stages {
+				m[stage.Name] = stage.Outcome
+			}
+			return m
+		}
+		names := func(tr DecisionTrace) []string {
+			var n []string
+			for _, stage := range tr.Stages {
+				n = append(n, stage.Name)
+			}
+			return n
+		}
+
+		Convey("A free action is decided by the free allowance", func() {
+			tr := trace()
+			So(tr.Allowed, ShouldBeTrue)
+			So(names(tr), ShouldResemble, []string{StageFreeAllowance})
+			So(tr.Stages[0].Outcome, ShouldEqual, OutcomeAllowed)
+		})
+
+		Convey("Later actions go through every stage in order", func() {
+			trace()
+			tr := trace()
+			So(tr.Allowed, ShouldBeTrue)
+			So(tr.Count, ShouldEqual, 1)
+			So(names(tr), ShouldResemble, []string{StageFreeAllowance, StagePenalty, StageGrace, StageLimit, StageSoftLimit})
+			So(outcomes(tr), ShouldResemble, map[string]Outcome{
+				StageFreeAllowance: OutcomeContinue,
+				StagePenalty:       OutcomeSkipped,
+				StageGrace:         OutcomeContinue,
+				StageLimit:         OutcomeContinue,
+				StageSoftLimit:     OutcomeAllowed,
+			})
+
+			Convey("Beyond the limit the limit stage blocks", func() {
+				trace()
+				trace()
+				tr := trace()
+				So(tr.Allowed, ShouldBeFalse)
+				So(names(tr), ShouldResemble, []string{StageFreeAllowance, StagePenalty, StageGrace, StageLimit})
+				So(tr.Stages[3].Outcome, ShouldEqual, OutcomeBlocked)
+				So(tr.Stages[3].Detail, ShouldEqual, "4 actions exceed the limit of 3")
+			})
+
+			Convey("During a grace period the grace stage allows", func() {
+				So(stopper.ResetWithGrace("foo", time.Second), ShouldBeNil)
+				tr := trace()
+				So(tr.Allowed, ShouldBeTrue)
+				So(names(tr), ShouldResemble, []string{StageFreeAllowance, StagePenalty, StageGrace})
+				So(tr.Stages[2].Outcome, ShouldEqual, OutcomeAllowed)
+			})
+		})
+	})
+}
@@ -0,0 +1,33 @@
+package flowstopper
+
+import "context"
+
+// Tracer opens spans around the operations of a Stopper which talk to redis,
+// so that their round trips show up in distributed traces. It is kept free of
+// any particular tracing library; package flowstopperotel implements it with
+// OpenTelemetry.
+type Tracer interface {
+	// Start opens a span for operation, such as "flowstopper.Pass", on item
+	// of the Stopper limiting namespace. Items are redacted here if the
+	// Stopper redacts them in errors. The returned context carries the span
+	// for the redis calls made.
+	Start(ctx context.Context, operation, namespace, item string) (context.Context, Span)
+}
+
+// Span is a span opened by a Tracer.
+type Span interface {
+	// SetAllowed records whether the action passed.
+	SetAllowed(allowed bool)
+
+	// End closes the span, marking it failed when err is non-nil.
+	End(err error)
+}
+
+// startSpan opens a span for operation on item with the Stopper's Tracer,
+// returning a nil Span when there is none.
+func (s *Stopper) startSpan(ctx context.Context, operation, item string) (context.Context, Span) {
+	if s.Tracer == nil {
+		return ctx, nil
+	}
+	return s.Tracer.Start(ctx, operation, s.Namespace, s.displayItem(item))
+}
@@ -0,0 +1,146 @@
+package flowstopper
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// tryPassScript trims the window stored at KEYS[1] of members scored at or
+// before ARGV[1] and records as many of ARGV[4] actions scored ARGV[2] as
+// the limit of ARGV[5], or the one stored at KEYS[2] by SetLimit, leaves
+// room for. They are recorded as member ARGV[3], made unique as by
+// luaUnique, which stands for all of them, among the weights at KEYS[3] as by
+// luaWeights, if there are several. Recording any sets the window to expire
+// no sooner than ARGV[6] milliseconds. Like for passScript, ARGV[7] of 1
+// takes the times from the redis server's clock and the interval of ARGV[8]
+// nanoseconds, a non-empty ARGV[9] is passed to ZADD as a flag, and ARGV[10]
+// of "clamp" or "reject" handles actions attempted before the newest one in
+// the window.
+//
+// It returns the number of members trimmed, the number of actions recorded
+// and the number of actions in the window after recording them.
+var tryPassScript = newScript(3, luaUnique+luaWeights+`
+local start, now, member = ARGV[1], ARGV[2], ARGV[3]
+if ARGV[7] == "1" then
+	redis.replicate_commands()
+	local t = redis.call("TIME")
+	now = t[1] .. string.format("%06d", tonumber(t[2])) .. "000"
+	member = now .. ":" .. member
+	start = string.format("%.0f", tonumber(now) - tonumber(ARGV[8]))
+end
+if ARGV[10] ~= "" then
+	local newest = redis.call("ZREVRANGE", KEYS[1], 0, 0, "WITHSCORES")[2]
+	if newest and tonumber(now) < tonumber(newest) then
+		newest = string.format("%.0f", tonumber(newest))
+		if ARGV[10] == "reject" then
+			return redis.error_reply("CLOCKREWIND " .. now .. " " .. newest)
+		end
+		now = newest
+	end
+end
+local trimmed = trim(KEYS[1], KEYS[3], start)
+local count = counted(KEYS[1], KEYS[3], start)
+local limit = tonumber(redis.call("GET", KEYS[2]) or ARGV[5])
+local admitted = math.max(0, math.min(tonumber(ARGV[4]), limit - count))
+if admitted > 0 then
+	local suffix = ""
+	if admitted > 1 then
+		suffix = "*" .. admitted
+	end
+	local m = unique(KEYS[1], member, 0, 1, suffix) .. suffix
+	if ARGV[9] ~= "" then
+		redis.call("ZADD", KEYS[1], ARGV[9], now, m)
+	else
+		redis.call("ZADD", KEYS[1], now, m)
+	end
+	if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[6]) then
+		redis.call("PEXPIRE", KEYS[1], ARGV[6])
+	end
+	if admitted > 1 then
+		redis.call("ZADD", KEYS[3], now, m)
+		if redis.call("PTTL", KEYS[3]) < tonumber(ARGV[6]) then
+			redis.call("PEXPIRE", KEYS[3], ARGV[6])
+		end
+	end
+end
+return {trimmed, admitted, count + admitted}
+`)
+
+// TryPassN sends an item accounting for up to n actions through the
+// Stopper, recording as many of them as the rate-limit for this item leaves
+// room for and returning how many that was, from 0 to n. Unlike PassN, which
+// rejects all n actions unless they all fit, it lets a large batch through
+// in part, so that it can be flow-controlled smoothly. The actions are
+// counted and recorded by a single script, so concurrent callers never
+// admit more than the limit between them, which is the one set by SetLimit
+// for item if any. Grace periods, the FreeAllowance and the SoftLimit don't
+// apply to it, while UseServerTime, the ZAddFlag and the ClockRewind policy
+// do as for PassN. MaxStored has nothing to cap, as TryPassN never records
+// actions beyond the limit. With Unlimited all n actions pass, and
+// with a Limit of zero or less none do, without involving redis. While item
+// is locked out by the Penalty none pass either, but actions left out don't
+// count as offenses.
+func (s *Stopper) TryPassN(item string, n int64) (int64, error) {
+	if n < 1 {
+		return 0, nil
+	}
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return 0, err
+	}
+	limitKey, err := s.limitKey(item)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case s.Unlimited:
+		s.decided(item, true, 0, true)
+		return n, nil
+	case s.Limit <= 0:
+		s.decided(item, false, 0, true)
+		return 0, nil
+	}
+
+	c, err := s.connContext(context.Background(), key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	if s.Penalty != nil {
+		until, err := s.lockedUntil(c, key, now)
+		if err != nil {
+			return 0, s.itemError(item, err)
+		}
+		if !until.IsZero() {
+			s.decided(item, false, 0, true)
+			return 0, nil
+		}
+	}
+
+	nanonow := now.UnixNano()
+	useServerTime := 0
+	if s.UseServerTime {
+		useServerTime = 1
+	}
+	reply, err := tryPassScript.run(c, key, limitKey, auxKey(key, "weights"), now.Add(s.Interval*-1).UnixNano(), nanonow,
+		strconv.FormatInt(nanonow, 10), n, s.Limit, durationMillis(s.Interval), useServerTime, s.Interval.Nanoseconds(),
+		string(s.ZAddFlag), s.ClockRewind.arg())
+	if rerr := rewindError(reply, err); rerr != nil {
+		return 0, s.itemError(item, rerr)
+	}
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	var trimmed, admitted, count int64
+	if _, err := redis.Scan(values, &trimmed, &admitted, &count); err != nil {
+		return 0, s.itemError(item, err)
+	}
+	s.trimmed(item, trimmed)
+	s.decided(item, admitted > 0, count, true)
+	return admitted, nil
+}
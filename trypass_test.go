@@ -0,0 +1,109 @@
+package flowstopper
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTryPassN(t *testing.T) {
+	Convey("Given a stopper", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := Stopper{
+			Namespace: "trypassn",
+			Interval:  5 * time.Second,
+			Limit:     int64(10),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		try := func(n int64) int64 {
+			admitted, err := stopper.TryPassN("foo", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return admitted
+		}
+
+		Convey("Batches are admitted in part once the limit is reached", func() {
+			for _, want := range []int64{4, 4, 2, 0} {
+				So(try(4), ShouldEqual, want)
+				clock.AddTime(time.Millisecond)
+			}
+
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 10)
+
+			Convey("Room frees up as the window slides", func() {
+				clock.AddTime(5*time.Second - 3*time.Millisecond)
+				So(try(4), ShouldEqual, 4)
+			})
+		})
+
+		Convey("Unlimited admits every action without recording any", func() {
+			stopper.Unlimited = true
+			So(try(40), ShouldEqual, 40)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("A closed gate admits none", func() {
+			stopper.Limit = 0
+			So(try(4), ShouldEqual, 0)
+		})
+
+		Convey("Actions before the newest one follow the ClockRewind policy", func() {
+			clock.AddTime(time.Second)
+			So(try(1), ShouldEqual, 1)
+			clock.AddTime(-500 * time.Millisecond)
+			stopper.ClockRewind = RewindReject
+			_, err := stopper.TryPassN("foo", 1)
+			var rerr *ClockRewindError
+			So(errors.As(err, &rerr), ShouldBeTrue)
+			So(rerr.At, ShouldEqual, clock.Now().UTC())
+		})
+
+		Convey("The time may be taken from the redis server", func() {
+			stopper.UseServerTime = true
+			So(try(4), ShouldEqual, 4)
+			So(try(10), ShouldEqual, 6)
+
+			conn := connPool.Get()
+			defer func() { _ = conn.Close() }()
+			values, err := redis.Strings(conn.Do("ZRANGE", stopper.Key("foo"), 0, 0, "WITHSCORES"))
+			So(err, ShouldBeNil)
+			score, err := strconv.ParseFloat(values[1], 64)
+			So(err, ShouldBeNil)
+			So(time.Since(time.Unix(0, int64(score))), ShouldBeLessThan, time.Minute)
+		})
+
+		Convey("Concurrent callers don't overshoot the limit", func() {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var total int64
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					admitted, err := stopper.TryPassN("foo", 3)
+					if err != nil {
+						t.Error(err)
+					}
+					mu.Lock()
+					total += admitted
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			So(total, ShouldEqual, 10)
+		})
+	})
+}
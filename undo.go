@@ -0,0 +1,54 @@
+package flowstopper
+
+import (
+	"time"
+)
+
+// undoScript removes one of the actions of the window stored at KEYS[1]
+// scored ARGV[1], returning 1 if there was one and 0 otherwise. Of a member
+// standing for several actions among the weights at KEYS[2], as by
+// luaWeights, it takes away one, leaving the others recorded.
+var undoScript = newScript(2, luaUnique+luaWeights+`
+local members = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1], "LIMIT", 0, 1)
+if #members == 0 then
+	return 0
+end
+local n = weight(KEYS[2], members[1])
+if n > 1 then
+	reweigh(KEYS[1], KEYS[2], members[1], ARGV[1], n - 1)
+	return 1
+end
+return redis.call("ZREM", KEYS[1], members[1])
+`)
+
+// PassStamped sends an item through the Stopper like Pass, additionally
+// returning the time the action was recorded at, which Undo takes to hand
+// its slot back. The time is zero unless the action was recorded.
+func (s *Stopper) PassStamped(item string) (bool, time.Time, error) {
+	r, err := s.PassResult(item)
+	return r.Allowed, r.At, err
+}
+
+// Undo hands back the slot of an action for item which passed, recorded at
+// the time returned by PassStamped or in the At of a PassResult, such as
+// when a later stage rejects work already admitted. Of several actions
+// recorded at the same time, as by PassN, one is removed per call. Undoing
+// an action which is no longer in the window does nothing. Reservations
+// are handed back by their Cancel instead.
+func (s *Stopper) Undo(item string, at time.Time) error {
+	key, err := s.key(item)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.conn(key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	if _, err := undoScript.run(c, key, auxKey(key, "weights"), at.UnixNano()); err != nil {
+		return s.itemError(item, err)
+	}
+	return nil
+}
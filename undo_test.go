@@ -0,0 +1,66 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUndo(t *testing.T) {
+	Convey("Given a stopper whose window is full", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "undo",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		var stamps []time.Time
+		for i := 0; i < 2; i++ {
+			clock.AddTime(time.Millisecond)
+			passed, at, err := stopper.PassStamped("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(at, ShouldEqual, clock.Now().UTC())
+			stamps = append(stamps, at)
+		}
+		passed, at, err := stopper.PassStamped("foo")
+		So(err, ShouldBeNil)
+		So(passed, ShouldBeFalse)
+		So(at.IsZero(), ShouldBeTrue)
+
+		Convey("Undoing an action hands its slot back", func() {
+			So(stopper.Undo("foo", stamps[0]), ShouldBeNil)
+			count, err := stopper.Peek("foo")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			ok, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			Convey("And undoing it again does nothing", func() {
+				So(stopper.Undo("foo", stamps[0]), ShouldBeNil)
+				count, err := stopper.Peek("foo")
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 2)
+			})
+		})
+
+		Convey("Actions recorded at the same time are undone one at a time", func() {
+			clock.AddTime(stopper.Interval)
+			r, err := stopper.PassResult("bar")
+			So(err, ShouldBeNil)
+			ok, err := stopper.PassN("bar", 1)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(stopper.Undo("bar", r.At), ShouldBeNil)
+			count, err := stopper.Peek("bar")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,144 @@
+package flowstopper
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Wait blocks until an action for item passes the Stopper, like
+// golang.org/x/time/rate's Limiter.Wait. Whenever the action is rejected, it
+// sleeps until the window is expected to have room again before trying
+// once more. It returns ctx.Err() if ctx is done before the action passes.
+func (s *Stopper) Wait(ctx context.Context, item string) error {
+	for blocked := false; ; blocked = true {
+		r, err := s.pass(ctx, CheckRequest{Item: item}, nil)
+		if err != nil {
+			return err
+		}
+		if r.Allowed {
+			return nil
+		}
+		if !blocked {
+			s.wait(item, 1)
+			defer s.wait(item, -1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.after(s.backoff(r.RetryAfter)):
+		}
+	}
+}
+
+// wait adds delta to the number of calls to Wait blocked on item.
+func (s *Stopper) wait(item string, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiting == nil {
+		s.waiting = make(map[string]int)
+	}
+	s.waiting[item] += delta
+	if s.waiting[item] <= 0 {
+		delete(s.waiting, item)
+	}
+}
+
+// WaitEstimate returns how long an action for item is projected to wait
+// before passing, without blocking, so that callers can decide whether to
+// wait, queue or reject it within their deadlines. Unlike RetryAfter, it
+// counts the calls to Wait already blocked on item as ahead of the action:
+// each takes the next slot to free up, and once those of the current window
+// are taken, the action waits a further Interval for each limit more, which
+// is the one set by SetLimit for item if any. Calls from other processes are
+// not known, so it is a lower bound.
+func (s *Stopper) WaitEstimate(item string) (time.Duration, error) {
+	now := s.now()
+	key, err := s.key(item)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	ahead := int64(s.waiting[item])
+	s.mu.Unlock()
+
+	c, err := s.conn(key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = c.Close() }()
+
+	limit, err := s.limitFor(c, item)
+	if err != nil {
+		return 0, err
+	}
+	windowStart := now.Add(s.Interval * -1).UnixNano()
+	count, err := redis.Int64(c.Do("ZCOUNT", key, exclusive(windowStart), "+inf"))
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	w, err := weightsOf(c, key, windowStart)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	count += w.extra()
+
+	// The action passes once the slot-th oldest action in the window
+	// expires, or an Interval after the one a limit earlier does.
+	var extra time.Duration
+	slot := count - limit + ahead
+	for slot >= count && limit > 0 {
+		slot -= limit
+		extra += s.Interval
+	}
+	if slot < 0 {
+		return extra, nil
+	}
+	offset, n := slot, int64(1)
+	if len(w) > 0 {
+		offset, n = 0, slot+1
+	}
+	values, err := redis.Strings(c.Do("ZRANGEBYSCORE", key, exclusive(windowStart), "+inf", "WITHSCORES", "LIMIT", offset, n))
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	found, ok := nthAction(values, w, slot-offset)
+	if !ok {
+		return extra, nil
+	}
+	score, err := strconv.ParseFloat(found, 64)
+	if err != nil {
+		return 0, s.itemError(item, err)
+	}
+	wait := time.Duration(int64(score) - windowStart)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait + extra, nil
+}
+
+// backoff returns how long Wait sleeps after a rejection for which room is
+// expected in retryAfter. Rejections without an estimate, such as soft limit
+// drops, wait for the average spacing of actions within the limit instead,
+// so that Wait never busy-loops against redis.
+func (s *Stopper) backoff(retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	if s.Limit < 1 {
+		return s.Interval
+	}
+	return s.Interval / time.Duration(s.Limit)
+}
+
+// after returns a channel receiving the time once d has elapsed on the
+// Stopper's clock.
+func (s *Stopper) after(d time.Duration) <-chan time.Time {
+	if s.c == nil {
+		return time.After(d)
+	}
+	return s.c.After(d)
+}
@@ -0,0 +1,119 @@
+package flowstopper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWait(t *testing.T) {
+	Convey("Given a stopper whose window is full", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "wait",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		for i := 0; i < 2; i++ {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done := make(chan error, 1)
+		go func() { done <- stopper.Wait(ctx, "foo") }()
+
+		Convey("Wait returns once the oldest action expires", func() {
+			var err error
+			waited := time.Duration(0)
+		loop:
+			for ; waited < time.Minute; waited += 100 * time.Millisecond {
+				select {
+				case err = <-done:
+					break loop
+				case <-time.After(time.Millisecond):
+					clock.AddTime(100 * time.Millisecond)
+				}
+			}
+			So(err, ShouldBeNil)
+			So(waited, ShouldBeGreaterThanOrEqualTo, 4900*time.Millisecond)
+			So(waited, ShouldBeLessThan, 6*time.Second)
+		})
+
+		Convey("Wait gives up when the context is done", func() {
+			cancel()
+			So(<-done, ShouldEqual, context.Canceled)
+		})
+	})
+}
+
+func TestWaitEstimate(t *testing.T) {
+	Convey("Given a stopper whose window is full", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "waitestimate",
+			Interval:  5 * time.Second,
+			Limit:     int64(2),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		estimate := func() time.Duration {
+			d, err := stopper.WaitEstimate("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d
+		}
+		So(estimate(), ShouldEqual, 0)
+		for i := 0; i < 2; i++ {
+			clock.AddTime(time.Second)
+			passed, err := stopper.Pass("foo")
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		}
+
+		Convey("The estimate is the time until the oldest action expires", func() {
+			So(estimate(), ShouldEqual, 4*time.Second)
+		})
+
+		Convey("Calls blocked in Wait are counted as ahead", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			waiting := func() int {
+				stopper.mu.Lock()
+				defer stopper.mu.Unlock()
+				return stopper.waiting["foo"]
+			}
+			done := make(chan error, 3)
+			for i := 1; i <= 2; i++ {
+				go func() { done <- stopper.Wait(ctx, "foo") }()
+				for waiting() < i {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			So(estimate(), ShouldEqual, 4*time.Second+stopper.Interval)
+
+			go func() { done <- stopper.Wait(ctx, "foo") }()
+			for waiting() < 3 {
+				time.Sleep(time.Millisecond)
+			}
+			So(estimate(), ShouldEqual, 5*time.Second+stopper.Interval)
+
+			cancel()
+			for i := 0; i < 3; i++ {
+				So(<-done, ShouldEqual, context.Canceled)
+			}
+			So(waiting(), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,75 @@
+package flowstopper
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// weights maps the members of a window standing for several actions, as
+// recorded by PassN, to the number of actions each stands for. Every other
+// member stands for one. See luaWeights for how they are stored.
+type weights map[string]int64
+
+// parseWeights returns the weights of the members read from the weights
+// key of a window.
+func parseWeights(members []string) weights {
+	w := make(weights, len(members))
+	for _, m := range members {
+		i := strings.LastIndexByte(m, '*')
+		if i < 0 {
+			continue
+		}
+		if n, err := strconv.ParseInt(m[i+1:], 10, 64); err == nil && n > 1 {
+			w[m] = n
+		}
+	}
+	return w
+}
+
+// of returns the number of actions member m stands for.
+func (w weights) of(m string) int64 {
+	if n, ok := w[m]; ok {
+		return n
+	}
+	return 1
+}
+
+// extra returns how many more actions the members stand for than there are
+// members, which is what to add to the count of members of a window.
+func (w weights) extra() int64 {
+	var extra int64
+	for _, n := range w {
+		extra += n - 1
+	}
+	return extra
+}
+
+// weightsArgs returns the arguments of the ZRANGEBYSCORE reading the
+// weights of the window stored at key scored after windowStart.
+func weightsArgs(key string, windowStart int64) []interface{} {
+	return []interface{}{auxKey(key, "weights"), exclusive(windowStart), "+inf"}
+}
+
+// weightsOf reads the weights of the window stored at key scored after
+// windowStart.
+func weightsOf(c Conn, key string, windowStart int64) (weights, error) {
+	members, err := redis.Strings(c.Do("ZRANGEBYSCORE", weightsArgs(key, windowStart)...))
+	if err != nil {
+		return nil, err
+	}
+	return parseWeights(members), nil
+}
+
+// nthAction returns the score of the n-th action, counting from zero, among
+// the members read WITHSCORES from a window, and whether there is one.
+func nthAction(values []string, w weights, n int64) (string, bool) {
+	for i := 0; i+1 < len(values); i += 2 {
+		n -= w.of(values[i])
+		if n < 0 {
+			return values[i+1], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,122 @@
+package flowstopper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WatchBeam/clock"
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWeights(t *testing.T) {
+	Convey("Given a stopper which passed several actions at once", t, func() {
+		flushRealRedis(t)
+		clock := clock.NewMockClock(now)
+		stopper := &Stopper{
+			Namespace: "weights",
+			Interval:  5 * time.Second,
+			Limit:     int64(10),
+			ConnPool:  &connPool,
+			c:         clock,
+		}
+		conn := connPool.Get()
+		defer func() { _ = conn.Close() }()
+		members := func(item string) int64 {
+			n, err := redis.Int64(conn.Do("ZCARD", stopper.Key(item)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		peek := func(item string) int64 {
+			count, err := stopper.Peek(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+		passed, err := stopper.PassN("foo", 6)
+		So(err, ShouldBeNil)
+		So(passed, ShouldBeTrue)
+
+		Convey("They are stored as a single member counting for all of them", func() {
+			So(members("foo"), ShouldEqual, 1)
+			So(peek("foo"), ShouldEqual, 6)
+			live, err := stopper.PeekLive("foo")
+			So(err, ShouldBeNil)
+			So(live, ShouldEqual, 6)
+			r, err := stopper.PeekResult("foo")
+			So(err, ShouldBeNil)
+			So(r.Count, ShouldEqual, 6)
+			So(r.Remaining, ShouldEqual, 4)
+			counts, err := stopper.PeekMulti([]string{"foo"})
+			So(err, ShouldBeNil)
+			So(counts["foo"], ShouldEqual, 6)
+			scores, err := stopper.Export("foo")
+			So(err, ShouldBeNil)
+			So(scores, ShouldHaveLength, 6)
+			times, err := stopper.Dump("foo")
+			So(err, ShouldBeNil)
+			So(times, ShouldHaveLength, 6)
+		})
+
+		Convey("They count against the limit", func() {
+			clock.AddTime(time.Millisecond)
+			passed, err := stopper.PassN("foo", 5)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeFalse)
+			passed, err = stopper.PassN("foo", 4)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+			So(members("foo"), ShouldEqual, 2)
+
+			ok, err := stopper.Check("foo")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			wait, err := stopper.RetryAfter("foo")
+			So(err, ShouldBeNil)
+			So(wait, ShouldEqual, stopper.Interval-time.Millisecond)
+			wait, err = stopper.WaitEstimate("foo")
+			So(err, ShouldBeNil)
+			So(wait, ShouldEqual, stopper.Interval-time.Millisecond)
+		})
+
+		Convey("Undo takes them back one at a time", func() {
+			So(stopper.Undo("foo", now), ShouldBeNil)
+			So(peek("foo"), ShouldEqual, 5)
+			So(members("foo"), ShouldEqual, 1)
+		})
+
+		Convey("Grant frees part of them", func() {
+			So(stopper.Grant("foo", 4), ShouldBeNil)
+			So(peek("foo"), ShouldEqual, 2)
+			So(members("foo"), ShouldEqual, 1)
+			So(stopper.Grant("foo", 5), ShouldBeNil)
+			So(peek("foo"), ShouldEqual, 0)
+		})
+
+		Convey("They expire together", func() {
+			clock.AddTime(stopper.Interval)
+			So(peek("foo"), ShouldEqual, 0)
+			passed, err := stopper.PassN("foo", 10)
+			So(err, ShouldBeNil)
+			So(passed, ShouldBeTrue)
+		})
+
+		Convey("Resetting the window clears them", func() {
+			So(stopper.Reset("foo"), ShouldBeNil)
+			exists, err := redis.Int64(conn.Do("EXISTS", stopper.Key("foo")+"#weights"))
+			So(err, ShouldBeNil)
+			So(exists, ShouldEqual, 0)
+		})
+
+		Convey("TryPassN stores the ones it admits as a single member as well", func() {
+			admitted, err := stopper.TryPassN("bar", 20)
+			So(err, ShouldBeNil)
+			So(admitted, ShouldEqual, 10)
+			So(members("bar"), ShouldEqual, 1)
+			So(peek("bar"), ShouldEqual, 10)
+		})
+	})
+}